@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// attachmentLineLength is the longest line of combined attachments we send to IRC.
+// Attachments that don't fit are sent on their own lines.
+const attachmentLineLength = 300
+
+// attachmentLines formats the attachments of a Discord message for IRC, according to mode.
+func attachmentLines(attachments []*discordgo.MessageAttachment, mode string) []string {
+	if mode == AttachmentModeSuppress {
+		return nil
+	}
+
+	lines := []string{}
+	line := ""
+	for _, attachment := range attachments {
+		text := attachment.URL
+		if mode == AttachmentModeURLWithMeta {
+			text = attachmentMeta(attachment) + " " + text
+		}
+
+		if line != "" && len(line)+3+len(text) > attachmentLineLength {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if line != "" {
+			line += " | "
+		}
+		line += text
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// attachmentMeta describes an attachment, e.g "cat.png (1.2 MB, 800x600)"
+func attachmentMeta(attachment *discordgo.MessageAttachment) string {
+	details := []string{formatSize(attachment.Size)}
+	if attachment.Width > 0 && attachment.Height > 0 {
+		details = append(details, fmt.Sprintf("%dx%d", attachment.Width, attachment.Height))
+	}
+
+	return fmt.Sprintf("%s (%s)", attachment.Filename, strings.Join(details, ", "))
+}
+
+// formatSize returns a human readable file size, e.g "1.2 MB"
+func formatSize(bytes int) string {
+	const unit = 1000
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	size := float64(bytes) / unit
+	prefix := 'k'
+	for _, p := range "MG" {
+		if size < unit {
+			break
+		}
+		size /= unit
+		prefix = p
+	}
+	return fmt.Sprintf("%.1f %cB", size, prefix)
+}
+
+// stickerURL returns the image of a sticker, or an empty string for Lottie
+// stickers which are animations that can't be viewed in a browser.
+func stickerURL(sticker *discordgo.StickerItem) string {
+	switch sticker.FormatType {
+	case discordgo.StickerFormatTypeLottie:
+		return ""
+	case discordgo.StickerFormatTypeGIF:
+		return "https://media.discordapp.net/stickers/" + sticker.ID + ".gif"
+	default:
+		return "https://media.discordapp.net/stickers/" + sticker.ID + ".png"
+	}
+}
+
+// stickerLines formats the stickers of a Discord message for IRC, using Config.StickerFormat.
+func (b *Bridge) stickerLines(stickers []*discordgo.StickerItem) []string {
+	lines := []string{}
+	for _, sticker := range stickers {
+		buf := &strings.Builder{}
+		err := b.stickerFormat.Execute(buf, stickerFields{
+			Name: sticker.Name,
+			URL:  stickerURL(sticker),
+		})
+		if err != nil {
+			log.WithField("error", err).Errorln("could not format sticker for IRC")
+			continue
+		}
+
+		lines = append(lines, buf.String())
+	}
+	return lines
+}
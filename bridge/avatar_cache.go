@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+)
+
+// avatarCache remembers the result of the avatar lookup for each username,
+// as finding a member means looking through everyone in the guild.
+//
+// Results, including not finding anyone, are kept until a member they could be about changes.
+type avatarCache struct {
+	sync.Mutex
+
+	// avatars contains the avatar URL for each guild and username
+	avatars map[string]map[string]string
+}
+
+func newAvatarCache() *avatarCache {
+	return &avatarCache{
+		avatars: make(map[string]map[string]string),
+	}
+}
+
+func (c *avatarCache) Get(guildID, username string) (avatar string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	avatar, ok = c.avatars[guildID][username]
+	return
+}
+
+func (c *avatarCache) Set(guildID, username, avatar string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.avatars[guildID]; !ok {
+		c.avatars[guildID] = make(map[string]string)
+	}
+	c.avatars[guildID][username] = avatar
+}
+
+// Forget forgets the results that could be different now that the member has changed,
+// which are those for any of their names, and any that found their avatar.
+func (c *avatarCache) Forget(guildID, userID string, names ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for username, avatar := range c.avatars[guildID] {
+		if strings.Contains(avatar, "/"+userID+"/") {
+			delete(c.avatars[guildID], username)
+			continue
+		}
+
+		for _, name := range names {
+			if name != "" && strings.EqualFold(username, name) {
+				delete(c.avatars[guildID], username)
+				break
+			}
+		}
+	}
+}
+
+// ClearAll forgets all avatars.
+func (c *avatarCache) ClearAll() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.avatars = make(map[string]map[string]string)
+}
@@ -0,0 +1,55 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestAvatarCacheForget(t *testing.T) {
+	alice := discordgo.EndpointUserAvatar("500000000000000001", "a1")
+	bob := discordgo.EndpointUserAvatar("500000000000000002", "b1")
+
+	c := newAvatarCache()
+	c.Set(testGuildID, "alice", alice)
+	c.Set(testGuildID, "Ally", alice)
+	c.Set(testGuildID, "bob", bob)
+	c.Set(testGuildID, "carol", "") // nobody is called carol, yet
+	c.Set("100000000000000002", "alice", alice)
+
+	// alice changes their nick to carol
+	c.Forget(testGuildID, "500000000000000001", "carol", "alice")
+
+	for _, name := range []string{"alice", "Ally", "carol"} {
+		if avatar, ok := c.Get(testGuildID, name); ok {
+			t.Errorf("%s is still cached as %q", name, avatar)
+		}
+	}
+
+	if avatar, ok := c.Get(testGuildID, "bob"); !ok || avatar != bob {
+		t.Errorf("bob was forgotten")
+	}
+	if avatar, ok := c.Get("100000000000000002", "alice"); !ok || avatar != alice {
+		t.Errorf("alice was forgotten in another guild")
+	}
+}
+
+func TestMemberUpdateForgetsAvatars(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	d := tb.Bridge.discord
+	bob := discordgo.EndpointUserAvatar("500000000000000002", "b1")
+
+	d.avatars.Set(testGuildID, "ally", "") // two people were called Ally
+	d.avatars.Set(testGuildID, "bob", bob)
+
+	before := &discordgo.Member{GuildID: testGuildID, Nick: "Ally", User: &discordgo.User{ID: "500000000000000001", Username: "alice"}}
+	after := &discordgo.Member{GuildID: testGuildID, Nick: "Alice", User: before.User}
+	d.onMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: after, BeforeUpdate: before})
+
+	if _, ok := d.avatars.Get(testGuildID, "ally"); ok {
+		t.Error("the old nick was not forgotten")
+	}
+	if _, ok := d.avatars.Get(testGuildID, "bob"); !ok {
+		t.Error("someone else's avatar was forgotten")
+	}
+}
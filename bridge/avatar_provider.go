@@ -0,0 +1,149 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for Config.AvatarSource
+const (
+	AvatarSourceURL   = "url"   // use Config.DefaultAvatarURL
+	AvatarSourceLocal = "local" // generate identicons, served by the bridge's HTTP server
+)
+
+// AvatarProvider gives IRC users without a matching Discord user an avatar.
+type AvatarProvider interface {
+	// Avatar returns the URL of the avatar for the IRC nick, or an empty string if there isn't one.
+	Avatar(nick, channel string) string
+}
+
+// templateAvatars formats Config.DefaultAvatarURL for each nick
+type templateAvatars struct {
+	format *template.Template
+}
+
+func (a *templateAvatars) Avatar(nick, channel string) string {
+	buf := &strings.Builder{}
+	err := a.format.Execute(buf, avatarFields{
+		Username: nick,
+		Channel:  channel,
+	})
+	if err != nil {
+		log.WithField("error", err).Errorln("could not format default avatar url")
+		return ""
+	}
+	return buf.String()
+}
+
+// identicon sizes, in pixels. A 5x5 grid of cells, with a margin around it.
+const (
+	identiconCell   = 20
+	identiconMargin = 14
+	identiconSize   = identiconCell*5 + identiconMargin*2
+)
+
+// defaultAvatarPalette is used for identicons when Config.AvatarPalette is empty
+var defaultAvatarPalette = []string{
+	"#e06c75", "#d19a66", "#e5c07b", "#98c379", "#56b6c2",
+	"#61afef", "#c678dd", "#be5046", "#4c8c4a", "#5b6ee1",
+}
+
+// localAvatars generates identicons from a hash of each nick.
+//
+// The hash is part of the URL, so the HTTP handler doesn't need to know any nicks,
+// and each nick always gets the same avatar.
+type localAvatars struct {
+	publicURL string
+	palette   []color.RGBA
+}
+
+func newLocalAvatars(publicURL string, palette []string) (*localAvatars, error) {
+	if len(palette) == 0 {
+		palette = defaultAvatarPalette
+	}
+
+	a := &localAvatars{publicURL: strings.TrimRight(publicURL, "/")}
+	for _, hexColor := range palette {
+		c, err := parseHexColor(hexColor)
+		if err != nil {
+			return nil, err
+		}
+		a.palette = append(a.palette, c)
+	}
+	return a, nil
+}
+
+func (a *localAvatars) Avatar(nick, channel string) string {
+	// Nicks are case insensitive on IRC
+	hash := sha256.Sum256([]byte(strings.ToLower(nick)))
+	return a.publicURL + "/avatars/" + hex.EncodeToString(hash[:16]) + ".png"
+}
+
+// ServeHTTP serves the identicon for the hash in the path, e.g /avatars/0123...cdef.png
+func (a *localAvatars) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/avatars/"), ".png")
+	hash, err := hex.DecodeString(name)
+	if err != nil || len(hash) != 16 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The same hash always gives the same image
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	if err := png.Encode(w, a.identicon(hash)); err != nil {
+		log.WithField("error", err).Errorln("could not write avatar")
+	}
+}
+
+// identicon draws a horizontally symmetric 5x5 pattern, coloured from the palette.
+func (a *localAvatars) identicon(hash []byte) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, identiconSize, identiconSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{240, 240, 240, 255}}, image.Point{}, draw.Src)
+
+	fg := &image.Uniform{a.palette[int(hash[0])%len(a.palette)]}
+	for row := 0; row < 5; row++ {
+		// Only the left three columns are chosen, the rest mirror them
+		for col := 0; col < 3; col++ {
+			bit := row*3 + col
+			if hash[1+bit/8]&(1<<uint(bit%8)) == 0 {
+				continue
+			}
+
+			for _, x := range []int{col, 4 - col} {
+				cell := image.Rect(0, 0, identiconCell, identiconCell).Add(image.Point{
+					X: identiconMargin + x*identiconCell,
+					Y: identiconMargin + row*identiconCell,
+				})
+				draw.Draw(img, cell, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	return img
+}
+
+// parseHexColor parses colors like "#ff8800"
+func parseHexColor(s string) (color.RGBA, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return color.RGBA{}, errors.Errorf("color %q should look like #ff8800", s)
+	}
+
+	rgb, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, errors.Errorf("color %q should look like #ff8800", s)
+	}
+
+	return color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
@@ -1,28 +1,188 @@
 package bridge
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
 	"strings"
-
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
 	irc "github.com/qaisjp/go-ircevent"
 	log "github.com/sirupsen/logrus"
 )
 
+// bridgedMessagesCacheSize is the number of recently bridged Discord messages
+// to remember, so that edits to them can be relayed.
+const bridgedMessagesCacheSize = 512
+
+// Values for Config.IRCFormatting
+const (
+	IRCFormattingTranslate = "translate" // convert formatting codes to markdown
+	IRCFormattingStrip     = "strip"     // remove formatting codes entirely
+)
+
+// Values for Config.AttachmentMode
+const (
+	AttachmentModeURL         = "url"           // just the URL
+	AttachmentModeURLWithMeta = "url-with-meta" // the filename, size and image dimensions, then the URL
+	AttachmentModeSuppress    = "suppress"      // don't bridge attachments
+)
+
+// Values for Config.SystemMessages
+const (
+	SystemMessageJoins   = "joins"   // "alice joined the server"
+	SystemMessageBoosts  = "boosts"  // "alice boosted the server"
+	SystemMessageThreads = "threads" // "alice started a thread: name"
+)
+
+// DefaultWebIRCGateway is the gateway name sent with WEBIRC
+const DefaultWebIRCGateway = "discord"
+
+// DefaultWebIRCHostnameFormat produces e.g "123456789.user.discord" or "123456789.bot.discord"
+const DefaultWebIRCHostnameFormat = "{{.ID}}.{{if .Bot}}bot{{else}}user{{end}}.discord"
+
+// DefaultIRCMessageFormat produces e.g "<A\u200Blice> hello"
+const DefaultIRCMessageFormat = "<{{.DisplayName}}> {{.Content}}"
+
+// DefaultIRCActionFormat produces e.g "* A\u200Blice waves"
+const DefaultIRCActionFormat = "* {{.DisplayName}} {{.Content}}"
+
+// DefaultNickFormat appends the suffix to each Discord user's nick, e.g "alice~d"
+const DefaultNickFormat = "{{.Nick}}{{.Suffix}}"
+
+// DefaultCTCPVersion is the reply to CTCP VERSION
+const DefaultCTCPVersion = "go-discord-irc bridge"
+
+// DefaultDiscordUsernameFormat uses the IRC nick as it is
+const DefaultDiscordUsernameFormat = "{{.Username}}"
+
+// discordUsernameLimit is the maximum length of a webhook username
+const discordUsernameLimit = 80
+
+// DefaultAvatarURL generates an identicon for each IRC nick
+const DefaultAvatarURL = "https://api.dicebear.com/9.x/identicon/png?seed={{urlquery .Username}}"
+
+// DefaultStickerFormat produces e.g "sent a sticker: wave"
+const DefaultStickerFormat = "sent a sticker: {{.Name}}"
+
+// Values for Config.IRCMentions
+const (
+	IRCMentionsNicks = "nicks" // only users mentioned by their IRC nick are pinged
+	IRCMentionsAll   = "all"   // any user or role mention is honoured, including those typed as <@id>
+	IRCMentionsNone  = "none"  // nobody is pinged
+)
+
+// Values for Config.IRCNotices
+const (
+	IRCNoticesPrefix = "prefix" // bridged like messages, prefixed with "[notice]"
+	IRCNoticesDrop   = "drop"   // never bridged
+	IRCNoticesNicks  = "nicks"  // only bridged (with the prefix) from IRCNoticeNicks
+)
+
+// ircServiceNicks never have their notices bridged, unless they are in Config.IRCNoticeNicks
+var ircServiceNicks = []string{"NickServ", "ChanServ", "MemoServ", "OperServ", "HostServ", "BotServ", "SaslServ", "Global"}
+
+// Values for Config.BotMentions
+const (
+	BotMentionsIgnore  = "ignore"  // relay mentions of the bot like any other
+	BotMentionsStrip   = "strip"   // remove mentions of the bot before relaying
+	BotMentionsRespond = "respond" // reply with what the channel is bridged to and the commands
+)
+
+// Values for ChannelOverride.Direction
+const (
+	MappingDirectionBoth      = "both"           // messages are bridged both ways
+	MappingDirectionToIRC     = "discord-to-irc" // e.g for announcement channels, which IRC can't post in
+	MappingDirectionToDiscord = "irc-to-discord"
+)
+
+// Values for Config.SpoilerMode
+const (
+	SpoilerModeRedact = "redact" // replace spoilers with [spoiler]
+	SpoilerModeKeep   = "keep"   // send spoilers as they are, with the || markers
+)
+
+// Values for Config.MultilineMode
+const (
+	MultilineModeSplit   = "split"   // send each line separately, prefixing continuation lines
+	MultilineModeFlatten = "flatten" // join the lines together with spaces
+	MultilineModePaste   = "paste"   // upload long messages to PasteServiceURL and send a link
+)
+
 // Config to be passed to New
 type Config struct {
 	DiscordBotToken, GuildID string
 
-	// Map from Discord to IRC
+	// Map from IRC to Discord, for the guild given by GuildID
 	ChannelMappings map[string]string
 
+	// Guilds contains any additional guilds to bridge, each with their own mappings.
+	Guilds []GuildConfig
+
 	IRCServer        string
-	IRCServerPass    string
+	IRCServerPass    string // sent with PASS before NICK/USER, by the listener and every user connection
 	IRCListenerName  string // i.e, "DiscordBot", required to listen for messages in all cases
 	WebIRCPass       string
 	NickServIdentify string // string: "[account] password"
 
+	// WebIRCGateway is the gateway name sent with WEBIRC, which some networks use
+	// to tell which gateway a connection came through. Defaults to DefaultWebIRCGateway.
+	WebIRCGateway string
+
+	// WebIRCHostnameFormat is the text/template for the hostname sent with WEBIRC for
+	// each Discord user's connection, with the fields .ID, .Hash (of the ID, for those
+	// that shouldn't be shown), .Username and .Bot, so that IRC ops can tell them apart,
+	// e.g "{{.Hash}}.discord". The IP is used instead if the result isn't a valid
+	// hostname. Defaults to DefaultWebIRCHostnameFormat.
+	WebIRCHostnameFormat string
+
+	// IRCUser and IRCRealname are the ident and realname of the listener, for
+	// channels that give access by ident@host. They default to "discord" and
+	// the ident. Connections for Discord users are unaffected.
+	IRCUser     string
+	IRCRealname string
+
+	// NickServWait delays joining channels until NickServ has identified the
+	// listener (or for 15 seconds), for channels that only allow identified users.
+	NickServWait bool
+
+	// IRCSASLLogin and IRCSASLPassword, when set, authenticate every
+	// IRC connection using SASL PLAIN before registration completes.
+	IRCSASLLogin    string
+	IRCSASLPassword string
+
+	// DiscordBotTokenFile, IRCServerPassFile, WebIRCPassFile and IRCSASLPasswordFile
+	// optionally name files to read those secrets from instead, such as Docker or
+	// Kubernetes secrets, so they needn't be written in the config. See ResolveSecrets.
+	DiscordBotTokenFile string
+	IRCServerPassFile   string
+	WebIRCPassFile      string
+	IRCSASLPasswordFile string
+
+	// IRCClientCertFile and IRCClientKeyFile are an optional PEM certificate and key
+	// presented by the listener, for networks that identify users by their
+	// certificate fingerprint (CertFP). Puppets don't present it, as they would
+	// all be identified as the bridge's account.
+	//
+	// SASL EXTERNAL can't be used, as go-ircevent only supports SASL PLAIN.
+	IRCClientCertFile string
+	IRCClientKeyFile  string
+
 	// NoTLS constrols whether to use TLS at all when connecting to the IRC server
 	NoTLS bool
 
@@ -34,21 +194,454 @@ type Config struct {
 	// This should be used only for testing.
 	InsecureSkipVerify bool
 
+	// IRCCAFile is an optional PEM file of CA certificates to verify the IRC server
+	// against, for servers using a private or self-signed CA. The system roots
+	// are used if empty.
+	IRCCAFile string
+
 	// SimpleMode, when enabled, will ensure that IRCManager not spawn
 	// an IRC connection for each of the online Discord users.
+	//
+	// Instead the listener speaks for everyone, like a classic relay bot,
+	// sending each message prefixed with who sent it using IRCMessageFormat.
+	// This is for networks that don't allow many connections from one host.
 	SimpleMode bool
 
+	// MaxPuppets is the most IRC connections to make for Discord users, or zero for no limit.
+	// Once reached, the listener relays for everyone else, like in SimpleMode. Someone without
+	// a connection gets one when they send a message, by closing the least recently active
+	// connection if it has been inactive for 10 minutes. Lowering it doesn't close connections.
+	MaxPuppets int
+
 	// WebhookPrefix is prefixed to each webhook created by the Discord bot.
 	WebhookPrefix string
 
-	// WebhookLimit is the max number of webhooks to create
+	// WebhookLimit is the max number of webhooks to create in each guild, or zero for no limit.
+	// Channels without a webhook take one from the channel that has gone unused the longest.
 	WebhookLimit int
 
+	// WebhooksPerChannel is the number of webhooks each channel rotates between,
+	// multiplying the number of messages it can receive before being rate limited.
+	// Defaults to 1.
+	WebhooksPerChannel int
+
+	// WebhookRateLimit is the number of messages that can be sent with each
+	// webhook every WebhookRateInterval. Excess messages are queued.
+	// Defaults to 5 messages every 2 seconds.
+	WebhookRateLimit    int
+	WebhookRateInterval time.Duration
+
+	// WebhookWaitForDelivery waits for Discord to create each message from IRC,
+	// rather than just accept it, before sending the next one to the same channel.
+	// Errors are then reported by Discord with the message that caused them.
+	WebhookWaitForDelivery bool
+
+	// WebhookWorkers is the most messages sent to Discord at once. Messages to each
+	// channel are always sent one at a time, in order. Defaults to 10.
+	WebhookWorkers int
+
+	// NotifyDeliveryFailures tells an IRC channel when its messages aren't reaching
+	// Discord, e.g because the bot is missing permissions in the Discord channel.
+	// The failures are always logged and listed in the /status endpoint.
+	NotifyDeliveryFailures bool
+
 	Suffix string // Suffix is the suffix to append to Discord users on the IRC side.
 
+	// NickFormat is the text/template for the IRC nick of each Discord user, with the
+	// fields .Nick and .Suffix, e.g "[D]{{.Nick}}". .Nick must appear exactly once,
+	// as what comes before and after it is how we recognise our own users on IRC.
+	// Defaults to DefaultNickFormat.
+	NickFormat string
+
+	// IRCFormatting controls what happens to bold, italic, underline
+	// and strikethrough codes in messages sent from IRC to Discord.
+	// Colors are always removed.
+	//
+	// Either IRCFormattingTranslate (default) or IRCFormattingStrip.
+	IRCFormatting string
+
+	// DiscordFormatting translates Discord markdown (bold, italics, code...)
+	// in messages sent to IRC into IRC formatting codes.
+	DiscordFormatting bool
+
+	// AttachmentMode controls how attachments on Discord messages are sent to IRC.
+	//
+	// One of AttachmentModeURL (default), AttachmentModeURLWithMeta or AttachmentModeSuppress.
+	AttachmentMode string
+
+	// SpoilerMode controls how Discord spoilers (||text||) are sent to IRC,
+	// which has no way to hide them.
+	//
+	// Either SpoilerModeRedact (default) or SpoilerModeKeep.
+	SpoilerMode string
+
+	// MultilineMode controls how Discord messages with several lines are sent to IRC.
+	//
+	// One of MultilineModeSplit (default), MultilineModeFlatten or MultilineModePaste.
+	MultilineMode string
+
+	// MultilineMaxLines is the most IRC lines a single Discord message is split into.
+	// The last line says how many were left out. Defaults to 10.
+	//
+	// In MultilineModePaste, messages with more lines than this are pasted instead.
+	MultilineMaxLines int
+
+	// PasteServiceURL is where long messages are POSTed in MultilineModePaste,
+	// e.g "https://hastebin.com/documents". See PasteUploader.
+	PasteServiceURL string
+
+	// PasteMaxLength is the most characters a message can have before it is
+	// pasted in MultilineModePaste. If pasting fails, messages are cut to this length.
+	// Defaults to 1000.
+	PasteMaxLength int
+
+	// IRCMessageFormat is the text/template used for Discord messages sent to IRC
+	// by the listener, i.e. in simple mode or for users without their own connection.
+	// Fields are .DisplayName, .Nick, .Username, .Discriminator, .Channel and .Content.
+	// Defaults to DefaultIRCMessageFormat.
+	IRCMessageFormat string
+
+	// IRCActionFormat is used instead of IRCMessageFormat for actions, e.g "_waves_".
+	// Defaults to DefaultIRCActionFormat.
+	IRCActionFormat string
+
+	// IRCRoleColors colours .DisplayName and .Nick in IRCMessageFormat and IRCActionFormat
+	// with the nearest IRC colour to the author's highest coloured Discord role.
+	// Users with their own IRC connection are coloured by IRC clients instead.
+	IRCRoleColors bool
+
+	// DiscordUsernameFormat is the text/template used for the webhook username
+	// of IRC messages sent to Discord, e.g "{{.Username}} [IRC]".
+	// Fields are .Username, .Channel and .Linked (see LinksPath).
+	// Defaults to DefaultDiscordUsernameFormat.
+	DiscordUsernameFormat string
+
+	// AvatarSource controls where the avatars of IRC users without a matching
+	// Discord user come from.
+	//
+	// Either AvatarSourceURL (default) or AvatarSourceLocal. AvatarSourceLocal
+	// needs HTTPAddr, and PublicURL for Discord to fetch the avatars from.
+	AvatarSource string
+
+	// DefaultAvatarURL is the text/template used for avatars in AvatarSourceURL.
+	// Fields are .Username (their IRC nick) and .Channel. Defaults to DefaultAvatarURL.
+	DefaultAvatarURL string
+
+	// AvatarPalette contains the colors (like "#ff8800") used for AvatarSourceLocal
+	// identicons. A default palette is used if empty.
+	AvatarPalette []string
+
+	// PublicURL is the address Discord can reach HTTPAddr at, e.g "https://bridge.example.com".
+	PublicURL string
+
+	// StickerFormat is the text/template used for each sticker on a Discord message,
+	// sent to IRC as an action. Fields are .Name and .URL (which is empty for
+	// animated stickers). Defaults to DefaultStickerFormat.
+	StickerFormat string
+
+	// RelayJoinsParts sends a message to Discord when someone
+	// joins or leaves a bridged IRC channel.
+	RelayJoinsParts bool
+
+	// IRCRenameNotices has the listener send a notice like "alice is now known as alicia"
+	// to the channels of a Discord user whose IRC nick changes with their display name,
+	// as some IRC clients hide nick changes.
+	IRCRenameNotices bool
+
+	// RelayTopicsToDiscord sets the topic of each Discord channel when the topic of
+	// its IRC channel changes. If the bot can't manage the channel, the new topic
+	// is sent as a message instead.
+	RelayTopicsToDiscord bool
+
+	// RelayTopicsToIRC sets the topic of each IRC channel when the topic of its
+	// Discord channel changes. The listener must be a channel operator.
+	RelayTopicsToIRC bool
+
+	// RelayVoiceStates tells IRC when Discord users join, leave or move between voice channels.
+	// Changes are sent to VoiceIRCChannel, or if empty, the IRC channel of the first
+	// text channel bridged to IRC in the same category as the voice channel.
+	RelayVoiceStates bool
+	VoiceIRCChannel  string
+
+	// RelayPins tells IRC when a message is pinned in a bridged Discord channel,
+	// quoting the start of the pinned message.
+	RelayPins bool
+
+	// SystemMessages are the kinds of Discord system messages sent to IRC as notices,
+	// any of SystemMessageJoins, SystemMessageBoosts and SystemMessageThreads.
+	// Other system messages, and those not listed, are never sent to IRC.
+	// Pins are controlled by RelayPins.
+	SystemMessages []string
+
+	// RelayReactionSummaries sends a summary of the reactions to each Discord message
+	// to IRC, at most once every ReactionSummaryWindow, instead of each puppet
+	// saying what they reacted with. Defaults to 30 seconds.
+	RelayReactionSummaries bool
+	ReactionSummaryWindow  time.Duration
+
+	// RelayTyping tells IRC when a Discord user starts typing,
+	// at most once every 10 seconds per user.
+	RelayTyping bool
+
+	// IRCReconnectBaseDelay is the initial delay before reconnecting a dropped
+	// IRC connection. It doubles with each failed attempt. Defaults to 5 seconds.
+	IRCReconnectBaseDelay time.Duration
+
+	// IRCReconnectMaxRetries is the number of times to try reconnecting
+	// before giving up. Zero means retry forever.
+	IRCReconnectMaxRetries int
+
+	// IRCSendRate is how many lines a second each IRC connection can send, after
+	// sending IRCSendBurst at once, so that servers don't disconnect us for excess
+	// flood. Lines over the limit wait. Zero (the default) means no limit.
+	IRCSendRate  float64
+	IRCSendBurst int // Defaults to 5.
+
+	// DiscordResumeTimeout is how long to let discordgo reconnect to Discord
+	// by itself after a disconnect, before closing the session and opening a
+	// new one. Defaults to 2 minutes.
+	DiscordResumeTimeout time.Duration
+
+	// DiscordStatus is the bot's status on Discord: "online" (the default), "idle", "dnd" or "invisible".
+	DiscordStatus string
+
+	// DiscordActivity is shown under the bot's name, e.g "#irc" with a DiscordActivityType
+	// of "watching" shows "Watching #irc". Nothing is shown if it is empty.
+	DiscordActivity string
+
+	// DiscordActivityType is "playing", "listening", "watching" (the default), "competing",
+	// or "custom" to show DiscordActivity by itself.
+	DiscordActivityType string
+
+	// DiscordStatusIRCHealth sets the bot's status to idle whilst the IRC listener is disconnected.
+	DiscordStatusIRCHealth bool
+
+	// FloodLimit is the number of messages each user can have bridged every
+	// FloodInterval, in each direction. Zero (the default) means no limit.
+	FloodLimit    int
+	FloodInterval time.Duration
+
+	// FloodSummary, when enabled, sends "sent N more messages" in place of
+	// the messages dropped by the flood limit, at the end of the interval.
+	FloodSummary bool
+
+	// PresenceDebounce is how long to wait before telling IRC that a Discord user
+	// has gone offline. If they come back within this time, nothing happens.
+	// Defaults to 30 seconds.
+	PresenceDebounce time.Duration
+
+	// StatePath is an optional JSON file used to remember the IRC nick
+	// assigned to each Discord user, so that they don't change across restarts.
+	StatePath string
+
+	// LinksPath is an optional JSON file used to store which Discord user each IRC
+	// account is linked to. If it is set, Discord users can use /link to get a code,
+	// and send it to the listener from IRC whilst identified with NickServ.
+	//
+	// Messages from linked IRC users have their Discord avatar, and their Discord
+	// name is available to DiscordUsernameFormat.
+	LinksPath string
+
+	// EchoWindow is how long to remember the messages sent to each side, for when
+	// another bridge is in the same channel. Messages from the other bridge that are
+	// something we sent within the window, either as it was or after its relay prefix
+	// (like "<alice> "), are echoes, and are ignored. Zero (the default) disables this.
+	//
+	// On Discord, only messages from bots and webhooks are checked. On IRC, only
+	// messages from EchoNicks are, as other bridges can't be told apart from people.
+	EchoWindow time.Duration
+
+	// EchoNicks are the nicks of other bridges on IRC, see EchoWindow.
+	// Like IgnoredIRCNicks, they are case insensitive and can use * and ? as wildcards.
+	EchoNicks []string
+
+	// QueuePath is an optional file used to keep the IRC messages that haven't
+	// been delivered to Discord yet, so that they are sent after a restart.
+	QueuePath string
+
+	// QueueSize is the most messages kept in QueuePath. When full, the
+	// oldest message is dropped. Defaults to 1000 if zero.
+	QueueSize int
+
+	// HTTPAddr is the address to serve the /healthz and /status endpoints on,
+	// e.g ":8080". Nothing is served if empty.
+	HTTPAddr string
+
+	// ReplyQuoteLength is the maximum length of the quoted snippet
+	// shown on IRC when a Discord user replies to a message.
+	// Defaults to 80 if zero.
+	ReplyQuoteLength int
+
+	// ThreadNamePrefix prefixes messages sent in Discord threads with the
+	// thread's name, e.g "[thread] hello". Threads are bridged to the IRC
+	// channel of their parent channel.
+	//
+	// Forum channels can be mapped too, and each post is a thread. The first
+	// message of a new post is always prefixed, e.g "[new post: title] hello".
+	// Messages from IRC are not sent to forums, as they can only contain posts.
+	ThreadNamePrefix bool
+
+	// RelayThreadCreation tells IRC when a thread is started in a bridged Discord channel,
+	// e.g "alice started a thread: name". Unlike SystemMessageThreads, this includes
+	// threads started from a message. Private threads and forum posts aren't announced.
+	RelayThreadCreation bool
+
+	// CTCPVersion is the reply our IRC connections give to CTCP VERSION.
+	// Defaults to DefaultCTCPVersion.
+	CTCPVersion string
+
+	// PingReply replies "Pong!" to messages that are just "ping" in bridged Discord channels.
+	PingReply bool
+
+	// CommandPrefix is prefixed to the commands users can send in bridged
+	// channels on either side, like "!who" and "!help". Defaults to "!".
+	CommandPrefix string
+
+	// DMRelayIRCChannel is an IRC channel that direct messages to the bot are sent to,
+	// e.g "#ops". Anyone in it can answer with "!reply <discord id> <message>", but only
+	// to people who have sent the bot a DM. When unset, DMs of the form "name, message"
+	// are sent to that IRC user instead.
+	DMRelayIRCChannel string
+
+	// BotMentions controls what happens when someone mentions the bot on Discord.
+	//
+	// One of BotMentionsIgnore (default), BotMentionsStrip or BotMentionsRespond.
+	BotMentions string
+
+	// IRCNotices controls what happens to notices sent to bridged IRC channels.
+	// Notices from services and servers are only bridged if they are in IRCNoticeNicks.
+	//
+	// One of IRCNoticesPrefix (default), IRCNoticesDrop or IRCNoticesNicks.
+	IRCNotices string
+
+	// IRCNoticeNicks are the nicks whose notices are bridged with IRCNoticesNicks.
+	// Like IgnoredIRCNicks, they are case insensitive and can use * and ? as wildcards.
+	IRCNoticeNicks []string
+
+	// IRCMentions controls which mentions in messages from IRC ping anyone on Discord.
+	//
+	// One of IRCMentionsNicks (default), IRCMentionsAll or IRCMentionsNone.
+	IRCMentions string
+
+	// AllowEveryoneFromIRC lets IRC users ping everyone on Discord with @everyone and @here.
+	AllowEveryoneFromIRC bool
+
+	// AdminRoleIDs are the Discord roles allowed to use the /bridge slash command,
+	// which is only registered if there are any.
+	AdminRoleIDs []string
+
+	// IRCAdminHosts are the IRC users allowed to use admin commands like "!announce",
+	// as nick!user@host masks, e.g "alice!*@staff.example.org".
+	// They are case insensitive, and can use * and ? as wildcards.
+	// Discord members with one of the AdminRoleIDs can use them too.
+	IRCAdminHosts []string
+
+	// IgnoredDiscordIDs contains the IDs of Discord users (usually bots)
+	// whose messages should not be bridged to IRC.
+	IgnoredDiscordIDs []string
+
+	// MinDiscordAccountAge and MinDiscordMemberAge stop messages being bridged
+	// to IRC from Discord accounts created, or members that joined the guild,
+	// less than this long ago. Zero (the default) means any age.
+	MinDiscordAccountAge time.Duration
+	MinDiscordMemberAge  time.Duration
+
+	// IgnoredIRCNicks contains the nicks of IRC users (like spam bots or services)
+	// whose messages, joins and parts should not be bridged to Discord.
+	// They are case insensitive, and can use * and ? as wildcards, e.g "*Serv".
+	IgnoredIRCNicks []string
+
+	// ContentReplacements rewrite Discord messages before they are sent to IRC.
+	ContentReplacements []ContentReplacement
+
+	// ChannelOverrides change how IRC messages look in particular Discord channels.
+	ChannelOverrides []ChannelOverride
+
+	// OnDiscordMessage, if set, is called for each Discord message just before it is
+	// sent to IRC, after the built-in filters (ignored users, flood limits, echoes,
+	// commands, ContentReplacements and each channel's Filters) have been applied.
+	// It may change the message, or return false to drop it.
+	//
+	// It is called from the bridge's main loop, so it must not block for long.
+	OnDiscordMessage func(*DiscordMessage) bool
+
+	// OnIRCMessage, if set, is called for each IRC message just before it is queued
+	// to be sent to Discord, after the built-in filters (ignored nicks, flood limits,
+	// echoes and each channel's Filters) have been applied. It may change the message, or return false to drop it.
+	//
+	// Like OnDiscordMessage, it is called from the main loop and must not block for
+	// long. Both are taken from the new Config on Reload, so keep them set there.
+	OnIRCMessage func(*IRCMessage) bool
+
 	Debug bool
 }
 
+// ChannelOverride replaces some of the Config for messages sent to one Discord channel.
+// Empty fields use the value from the Config.
+type ChannelOverride struct {
+	DiscordChannel string
+
+	// DiscordUsernameFormat replaces Config.DiscordUsernameFormat
+	DiscordUsernameFormat string
+
+	// DefaultAvatarURL replaces Config.DefaultAvatarURL, even if Config.AvatarSource is
+	// AvatarSourceLocal, so that some channels can use a different avatar service.
+	DefaultAvatarURL string
+
+	// Direction limits which way messages are bridged for the channel's mapping,
+	// along with topics and notices like joins, reactions and pins.
+	// One of MappingDirectionBoth (default), MappingDirectionToIRC or MappingDirectionToDiscord.
+	Direction string
+
+	// Filters drop the channel's messages that match them. They are applied after
+	// IgnoredDiscordIDs, IgnoredIRCNicks and commands, but before OnDiscordMessage
+	// and OnIRCMessage.
+	Filters []MessageFilter
+}
+
+// MessageFilter drops messages matching the regular expression Pattern, e.g `^[.?]\w+`
+// for another bot's commands. It is matched against the message as it would be
+// sent, without formatting.
+type MessageFilter struct {
+	Pattern string
+
+	// Direction is which messages are filtered. One of MappingDirectionBoth (default),
+	// MappingDirectionToIRC or MappingDirectionToDiscord.
+	Direction string
+}
+
+type channelOverride struct {
+	usernameFormat *template.Template
+	avatars        AvatarProvider
+	direction      string
+	filters        []messageFilter
+}
+
+type messageFilter struct {
+	pattern   *regexp.Regexp
+	direction string
+}
+
+// ContentReplacement replaces all matches of the regular expression Pattern
+// with Replacement, which can refer to submatches using $1 etc.
+type ContentReplacement struct {
+	Pattern     string
+	Replacement string
+}
+
+type contentReplacement struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// GuildConfig contains the channel mappings for a single Discord guild.
+type GuildConfig struct {
+	GuildID string
+
+	// Map from IRC to Discord
+	ChannelMappings map[string]string
+}
+
 // A Bridge represents a bridging between an IRC server and channels in a Discord server
 type Bridge struct {
 	Config *Config
@@ -57,66 +650,666 @@ type Bridge struct {
 	ircListener *ircListener
 	ircManager  *IRCManager
 
+	// ircRootCAs are loaded from IRCCAFile, or nil to use the system roots
+	ircRootCAs *x509.CertPool
+
+	// ircClientCerts contains the certificate from IRCClientCertFile, if any
+	ircClientCerts []tls.Certificate
+
+	// queue holds the IRC messages that haven't been delivered to Discord yet
+	queue *messageQueue
+
+	// deliveries sends messages to each Discord channel in order
+	deliveries *orderedDelivery
+
+	// deliveryFailures counts the messages that couldn't be sent to each Discord channel
+	deliveryFailures *deliveryFailures
+
+	// mutes are the people whose messages aren't bridged for now, see the mute command
+	mutes *muteList
+
+	// ignores are the changes made to IgnoredDiscordIDs with /bridge ignore and unignore
+	ignores ignoreOverrides
+
+	// links are the IRC accounts linked to Discord users, see Config.LinksPath
+	links *accountLinks
+
+	// nickPrefix and nickSuffix are what Config.NickFormat adds to each nick
+	nickPrefix string
+	nickSuffix string
+
+	// ircEchoes and discordEchoes remember what we've sent to each side,
+	// so that other bridges can't echo it back
+	ircEchoes     *echoFilter
+	discordEchoes *echoFilter
+
 	mappings []*Mapping
 
+	// bridgedMessages contains the IDs of Discord messages recently sent to IRC
+	bridgedMessages *messageCache
+
+	contentReplacements []contentReplacement
+	channelOverrides    map[string]channelOverride
+	ignoredIRCNicks     []*regexp.Regexp
+	echoNicks           []*regexp.Regexp
+	ircNoticeNicks      []*regexp.Regexp
+	ircAdminHosts       []*regexp.Regexp
+	ircMessageFormat    *template.Template
+	webIRCHostname      *template.Template
+	ircActionFormat     *template.Template
+
+	discordUsernameFormat *template.Template
+	stickerFormat         *template.Template
+
+	// floods limit messages sent by each user, in each direction
+	discordFlood *floodGuard
+	ircFlood     *floodGuard
+
+	// avatars are used for IRC users without a Discord avatar
+	avatars AvatarProvider
+
+	// reload is called by the /bridge reload command, see SetReloadFunc
+	reload func() error
+
+	// paste uploads long messages, if PasteServiceURL is set
+	paste *PasteUploader
+
+	stats bridgeStats
+	http  *http.Server
+
 	done chan bool
 
 	discordMessagesChan      chan IRCMessage
 	discordMessageEventsChan chan *DiscordMessage
 	updateUserChan           chan DiscordUser
+
+	// reloadChan runs Reload, and anything else that needs the mappings, on the loop
+	reloadChan chan func()
 }
 
-// Close the Bridge
+// Close the Bridge, waiting for as long as it takes.
 func (b *Bridge) Close() {
-	b.done <- true
-	<-b.done
+	if err := b.CloseContext(context.Background()); err != nil {
+		log.WithField("error", err).Errorln("could not cleanly close the bridge")
+	}
+}
+
+// CloseContext closes the Bridge, giving up once ctx is done.
+//
+// The Discord session (and its webhooks), the IRC listener and the
+// IRC connections are closed at the same time. The returned error
+// names each one that failed, or had not finished by the deadline.
+func (b *Bridge) CloseContext(ctx context.Context) error {
+	// Stop the loop first, as the IRC manager must only be used from one goroutine
+	select {
+	case b.done <- true:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "bridge loop did not stop")
+	}
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "bridge loop did not stop")
+	}
+
+	components := map[string]func() error{
+		"discord": b.discord.Close,
+		"irc listener": func() error {
+			b.ircListener.Quit()
+			return nil
+		},
+		"irc manager": func() error {
+			b.ircManager.Close()
+			return nil
+		},
+		"message queue": b.queue.Close,
+	}
+
+	if b.http != nil {
+		components["http server"] = func() error {
+			return b.http.Shutdown(ctx)
+		}
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	results := make(chan result, len(components))
+	for name, closeFn := range components {
+		go func(name string, closeFn func() error) {
+			results <- result{name, closeFn()}
+		}(name, closeFn)
+	}
+
+	var errs error
+	for remaining := len(components); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			delete(components, r.name)
+			if r.err != nil {
+				errs = multierror.Append(errs, errors.Wrapf(r.err, "could not close %s", r.name))
+			}
+		case <-ctx.Done():
+			for name := range components {
+				errs = multierror.Append(errs, errors.Errorf("%s did not stop in time", name))
+			}
+			return errs
+		}
+	}
+
+	return errs
 }
 
-// TODO: Use errors package
-func (b *Bridge) load(opts *Config) error {
-	if opts.IRCServer == "" {
-		return errors.New("missing server name")
+// load checks the config, returning every problem found, and fills in defaults.
+//
+// Nothing is changed until apply is called, which switches the bridge over to
+// the config all at once, and must be called from the loop once it is running.
+func (b *Bridge) load(opts *Config) (apply func(), err error) {
+	if err := Validate(opts); err != nil {
+		return nil, err
+	}
+
+	if opts.IRCFormatting == "" {
+		opts.IRCFormatting = IRCFormattingTranslate
+	}
+
+	if opts.AttachmentMode == "" {
+		opts.AttachmentMode = AttachmentModeURL
+	}
+
+	if opts.SpoilerMode == "" {
+		opts.SpoilerMode = SpoilerModeRedact
+	}
+
+	if opts.MultilineMode == "" {
+		opts.MultilineMode = MultilineModeSplit
+	}
+
+	if opts.MultilineMaxLines <= 0 {
+		opts.MultilineMaxLines = 10
+	}
+
+	if opts.PasteMaxLength <= 0 {
+		opts.PasteMaxLength = 1000
+	}
+
+	if opts.ReactionSummaryWindow <= 0 {
+		opts.ReactionSummaryWindow = time.Second * 30
+	}
+
+	if opts.WebhookWorkers <= 0 {
+		opts.WebhookWorkers = 10
+	}
+
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 1000
+	}
+
+	var paste *PasteUploader
+	if opts.PasteServiceURL != "" {
+		paste = NewPasteUploader(opts.PasteServiceURL)
+	}
+
+	if opts.BotMentions == "" {
+		opts.BotMentions = BotMentionsIgnore
+	}
+
+	if opts.IRCNotices == "" {
+		opts.IRCNotices = IRCNoticesPrefix
+	}
+
+	if opts.IRCMentions == "" {
+		opts.IRCMentions = IRCMentionsNicks
+	}
+
+	if opts.NickFormat == "" {
+		opts.NickFormat = DefaultNickFormat
+	}
+	nickPrefix, nickSuffix, err := nickAffixes(opts.NickFormat, opts.Suffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nick format")
+	}
+
+	if opts.IRCUser == "" {
+		opts.IRCUser = "discord"
+	}
+
+	if opts.IRCSendBurst <= 0 {
+		opts.IRCSendBurst = 5
+	}
+
+	if opts.IRCReconnectBaseDelay <= 0 {
+		opts.IRCReconnectBaseDelay = time.Second * 5
+	}
+
+	if opts.DiscordStatus == "" {
+		opts.DiscordStatus = string(discordgo.StatusOnline)
+	}
+
+	if opts.DiscordActivityType == "" {
+		opts.DiscordActivityType = "watching"
+	}
+
+	if opts.DiscordResumeTimeout <= 0 {
+		opts.DiscordResumeTimeout = time.Minute * 2
+	}
+
+	if opts.FloodInterval <= 0 {
+		opts.FloodInterval = time.Second * 10
+	}
+	discordFlood := newFloodGuard(opts.FloodLimit, opts.FloodInterval)
+	ircFlood := newFloodGuard(opts.FloodLimit, opts.FloodInterval)
+
+	if opts.PresenceDebounce <= 0 {
+		opts.PresenceDebounce = time.Second * 30
+	}
+
+	if opts.ReplyQuoteLength == 0 {
+		opts.ReplyQuoteLength = 80
+	}
+
+	if opts.CTCPVersion == "" {
+		opts.CTCPVersion = DefaultCTCPVersion
+	}
+
+	if opts.CommandPrefix == "" {
+		opts.CommandPrefix = "!"
+	}
+
+	if opts.WebIRCGateway == "" {
+		opts.WebIRCGateway = DefaultWebIRCGateway
+	}
+
+	if opts.WebIRCHostnameFormat == "" {
+		opts.WebIRCHostnameFormat = DefaultWebIRCHostnameFormat
+	}
+
+	webIRCHostname, err := template.New("webirc_hostname_format").Parse(opts.WebIRCHostnameFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webirc hostname format")
+	}
+
+	if opts.IRCMessageFormat == "" {
+		opts.IRCMessageFormat = DefaultIRCMessageFormat
 	}
 
-	if opts.WebhookPrefix == "" {
-		return errors.New("missing webhook prefix")
+	ircMessageFormat, err := template.New("irc_message_format").Parse(opts.IRCMessageFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid irc message format")
+	}
+
+	if opts.IRCActionFormat == "" {
+		opts.IRCActionFormat = DefaultIRCActionFormat
+	}
+
+	ircActionFormat, err := template.New("irc_action_format").Parse(opts.IRCActionFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid irc action format")
+	}
+
+	if opts.DiscordUsernameFormat == "" {
+		opts.DiscordUsernameFormat = DefaultDiscordUsernameFormat
+	}
+
+	discordUsernameFormat, err := template.New("discord_username_format").Parse(opts.DiscordUsernameFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid discord username format")
+	}
+
+	if opts.StickerFormat == "" {
+		opts.StickerFormat = DefaultStickerFormat
+	}
+
+	stickerFormat, err := template.New("sticker_format").Parse(opts.StickerFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sticker format")
+	}
+
+	if opts.DefaultAvatarURL == "" {
+		opts.DefaultAvatarURL = DefaultAvatarURL
+	}
+
+	if opts.AvatarSource == "" {
+		opts.AvatarSource = AvatarSourceURL
+	}
+
+	var avatars AvatarProvider
+	if opts.AvatarSource == AvatarSourceLocal {
+		local, err := newLocalAvatars(opts.PublicURL, opts.AvatarPalette)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid avatar palette")
+		}
+		avatars = local
+	} else {
+		defaultAvatarURL, err := template.New("default_avatar_url").Parse(opts.DefaultAvatarURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid default avatar url")
+		}
+		avatars = &templateAvatars{defaultAvatarURL}
+	}
+
+	var contentReplacements []contentReplacement
+	for _, r := range opts.ContentReplacements {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid content replacement pattern %q", r.Pattern)
+		}
+		contentReplacements = append(contentReplacements, contentReplacement{pattern, r.Replacement})
+	}
+
+	channelOverrides := make(map[string]channelOverride)
+	for _, o := range opts.ChannelOverrides {
+		override := channelOverride{direction: o.Direction}
+		if o.DiscordUsernameFormat != "" {
+			override.usernameFormat, err = template.New("discord_username_format").Parse(o.DiscordUsernameFormat)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid discord username format for %s", o.DiscordChannel)
+			}
+		}
+
+		if o.DefaultAvatarURL != "" {
+			format, err := template.New("default_avatar_url").Parse(o.DefaultAvatarURL)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid default avatar url for %s", o.DiscordChannel)
+			}
+			override.avatars = &templateAvatars{format}
+		}
+
+		for _, f := range o.Filters {
+			pattern, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid filter pattern %q for %s", f.Pattern, o.DiscordChannel)
+			}
+			override.filters = append(override.filters, messageFilter{pattern, f.Direction})
+		}
+
+		channelOverrides[o.DiscordChannel] = override
+	}
+
+	var ignoredIRCNicks []*regexp.Regexp
+	for _, nick := range opts.IgnoredIRCNicks {
+		ignoredIRCNicks = append(ignoredIRCNicks, nickGlob(nick))
+	}
+
+	var echoNicks []*regexp.Regexp
+	for _, nick := range opts.EchoNicks {
+		echoNicks = append(echoNicks, nickGlob(nick))
 	}
 
-	if err := b.SetChannelMappings(opts.ChannelMappings); err != nil {
-		return errors.Wrap(err, "channel mappings could not be set")
+	var ircNoticeNicks []*regexp.Regexp
+	for _, nick := range opts.IRCNoticeNicks {
+		ircNoticeNicks = append(ircNoticeNicks, nickGlob(nick))
+	}
+
+	var ircAdminHosts []*regexp.Regexp
+	for _, mask := range opts.IRCAdminHosts {
+		ircAdminHosts = append(ircAdminHosts, nickGlob(mask))
+	}
+
+	mappings := mappingsFromMap(opts.GuildID, opts.ChannelMappings)
+	for _, guild := range opts.Guilds {
+		mappings = append(mappings, mappingsFromMap(guild.GuildID, guild.ChannelMappings)...)
+	}
+
+	if err := checkDuplicateMappings(mappings); err != nil {
+		return nil, errors.Wrap(err, "channel mappings could not be set")
+	}
+
+	for _, mapping := range mappings {
+		if direction := channelOverrides[mapping.DiscordChannel].direction; direction != "" {
+			mapping.Direction = direction
+		}
 	}
 
 	// This should not be used anymore!
 	opts.ChannelMappings = nil
 
-	return nil
+	return func() {
+		b.Config = opts
+		b.ignores.Reset()
+		b.paste = paste
+		b.nickPrefix, b.nickSuffix = nickPrefix, nickSuffix
+		b.discordFlood, b.ircFlood = discordFlood, ircFlood
+		b.webIRCHostname = webIRCHostname
+		b.ircMessageFormat = ircMessageFormat
+		b.ircActionFormat = ircActionFormat
+		b.discordUsernameFormat = discordUsernameFormat
+		b.stickerFormat = stickerFormat
+		b.avatars = avatars
+		b.contentReplacements = contentReplacements
+		b.channelOverrides = channelOverrides
+		b.ignoredIRCNicks = ignoredIRCNicks
+		b.echoNicks = echoNicks
+		b.ircNoticeNicks = ircNoticeNicks
+		b.ircAdminHosts = ircAdminHosts
+		b.replaceMappings(mappings)
+	}, nil
+}
+
+// isIgnoredDiscordUser returns true if messages from the Discord user should not be bridged.
+func (b *Bridge) isIgnoredDiscordUser(id string) bool {
+	if ignored, ok := b.ignores.Get(id); ok {
+		return ignored
+	}
+
+	for _, ignored := range b.Config.IgnoredDiscordIDs {
+		if ignored == id {
+			return true
+		}
+	}
+	return false
+}
+
+// nickGlob returns a case insensitive regular expression for a nick with * and ? wildcards.
+//
+// path.Match isn't used because nicks often contain [ and ], which it treats as a character class.
+func nickGlob(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	return regexp.MustCompile("(?i)^" + pattern + "$")
+}
+
+// isIgnoredIRCNick returns true if messages from the IRC user should not be bridged.
+func (b *Bridge) isIgnoredIRCNick(nick string) bool {
+	for _, ignored := range b.ignoredIRCNicks {
+		if ignored.MatchString(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEchoNick returns true if the IRC user is another bridge, whose messages may be echoes.
+func (b *Bridge) isEchoNick(nick string) bool {
+	for _, bridge := range b.echoNicks {
+		if bridge.MatchString(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// bridgesNotice returns true if a notice from the nick should be sent to Discord, see Config.IRCNotices.
+func (b *Bridge) bridgesNotice(nick string) bool {
+	for _, allowed := range b.ircNoticeNicks {
+		if allowed.MatchString(nick) {
+			return b.Config.IRCNotices != IRCNoticesDrop
+		}
+	}
+
+	if b.Config.IRCNotices != IRCNoticesPrefix {
+		return false
+	}
+
+	// Servers send notices without a nick, or as their name, e.g "irc.example.com"
+	if nick == "" || strings.Contains(nick, ".") {
+		return false
+	}
+
+	for _, service := range ircServiceNicks {
+		if strings.EqualFold(nick, service) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIRCAdmin returns true if the IRC user, given as nick!user@host, matches one of the IRCAdminHosts.
+func (b *Bridge) isIRCAdmin(source string) bool {
+	for _, admin := range b.ircAdminHosts {
+		if admin.MatchString(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceContent applies ContentReplacements to a Discord message.
+func (b *Bridge) replaceContent(content string) string {
+	for _, r := range b.contentReplacements {
+		content = r.pattern.ReplaceAllString(content, r.replacement)
+	}
+	return content
+}
+
+// isFiltered returns true if the message, going in the direction, matches one of
+// the Filters for the mapping's Discord channel.
+func (b *Bridge) isFiltered(mapping *Mapping, direction, content string) bool {
+	content = ircf.Strip(content)
+	for _, f := range b.channelOverrides[mapping.DiscordChannel].filters {
+		if f.direction != "" && f.direction != MappingDirectionBoth && f.direction != direction {
+			continue
+		}
+
+		if f.pattern.MatchString(content) {
+			log.WithFields(log.Fields{
+				"channel":   mapping.DiscordChannel,
+				"pattern":   f.pattern.String(),
+				"direction": direction,
+			}).Debugln("Dropping filtered message")
+			return true
+		}
+	}
+	return false
+}
+
+// isFilteredToDiscord returns true if none of the Discord channels the IRC message's
+// channel is mapped to would accept it, because of their Direction or Filters.
+func (b *Bridge) isFilteredToDiscord(msg IRCMessage) bool {
+	for _, mapping := range b.GetMappingsByIRC(msg.IRCChannel) {
+		if mapping.ToDiscord() && !b.isFiltered(mapping, MappingDirectionToDiscord, msg.Message) {
+			return false
+		}
+	}
+	return true
+}
+
+// discordUsername returns the webhook username for a message from IRC, using DiscordUsernameFormat,
+// or the format from the Discord channel's ChannelOverride.
+// linkedName is the Discord name of the account they've linked, if any.
+func (b *Bridge) discordUsername(mapping *Mapping, msg IRCMessage, linkedName string) string {
+	format := b.discordUsernameFormat
+	if override := b.channelOverrides[mapping.DiscordChannel].usernameFormat; override != nil {
+		format = override
+	}
+
+	buf := &strings.Builder{}
+	err := format.Execute(buf, discordUsernameFields{
+		Username: msg.Username,
+		Channel:  msg.IRCChannel,
+		Linked:   linkedName,
+	})
+	if err != nil {
+		log.WithField("error", err).Errorln("could not format discord username")
+		return msg.Username
+	}
+
+	username := buf.String()
+	if utf8.RuneCountInString(username) > discordUsernameLimit {
+		username = string([]rune(username)[:discordUsernameLimit])
+	}
+	return username
+}
+
+// GuildIDs returns the IDs of every guild being bridged.
+func (b *Bridge) GuildIDs() []string {
+	return configGuildIDs(b.Config)
+}
+
+func configGuildIDs(conf *Config) []string {
+	ids := []string{conf.GuildID}
+	for _, guild := range conf.Guilds {
+		ids = append(ids, guild.GuildID)
+	}
+	return ids
+}
+
+func mappingsFromMap(guildID string, inMappings map[string]string) []*Mapping {
+	mappings := []*Mapping{}
+	for irc, discord := range inMappings {
+		// Channels needing a key are written as "#channel key"
+		channel, key := irc, ""
+		if i := strings.Index(irc, " "); i >= 0 {
+			channel, key = irc[:i], strings.TrimSpace(irc[i+1:])
+		}
+
+		// Mirroring to several Discord channels is written as "123,456"
+		for _, discord := range strings.Split(discord, ",") {
+			mappings = append(mappings, &Mapping{
+				GuildID:        guildID,
+				DiscordChannel: strings.TrimSpace(discord),
+				IRCChannel:     channel,
+				IRCChannelKey:  key,
+			})
+		}
+	}
+	return mappings
 }
 
 // SetChannelMappings allows you to set (or update) the
-// hashmap containing irc to discord mappings.
+// hashmap containing irc to discord mappings for the primary guild.
 //
 // Calling this function whilst the bot is running will
 // add or remove IRC bots accordingly.
 func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
-	mappings := []*Mapping{}
-	for irc, discord := range inMappings {
-		mappings = append(mappings, &Mapping{
-			DiscordChannel: discord,
-			IRCChannel:     irc,
-		})
+	return b.SetGuildChannelMappings(b.Config.GuildID, inMappings)
+}
+
+// SetGuildChannelMappings is like SetChannelMappings, but for any bridged guild.
+// Mappings belonging to other guilds are left untouched.
+func (b *Bridge) SetGuildChannelMappings(guildID string, inMappings map[string]string) error {
+	mappings := mappingsFromMap(guildID, inMappings)
+	for _, mapping := range b.mappings {
+		if mapping.GuildID != guildID {
+			mappings = append(mappings, mapping)
+		}
 	}
 
-	// Check for duplicate channels
-	for i, mapping := range mappings {
-		for j, check := range mappings {
-			if (mapping.DiscordChannel == check.DiscordChannel) || (mapping.IRCChannel == check.IRCChannel) {
-				if i != j {
-					return errors.New("channel_mappings contains duplicate entries")
-				}
-			}
+	return b.setMappings(mappings)
+}
+
+func (b *Bridge) setMappings(mappings []*Mapping) error {
+	if err := checkDuplicateMappings(mappings); err != nil {
+		return err
+	}
+
+	for _, mapping := range mappings {
+		if direction := b.channelOverrides[mapping.DiscordChannel].direction; direction != "" {
+			mapping.Direction = direction
 		}
 	}
 
+	b.replaceMappings(mappings)
+	return nil
+}
+
+// replaceMappings switches over to the new mappings, which have already been checked,
+// parting the IRC channels that are no longer bridged and joining the new ones.
+func (b *Bridge) replaceMappings(mappings []*Mapping) {
 	oldMappings := b.mappings
 	b.mappings = mappings
 
@@ -161,36 +1354,44 @@ func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
 		rmChannels := []string{}
 		for _, mapping := range removedMappings {
 			// Looking for the irc channel to remove
-			// inside our list of newly added channels.
+			// inside our new list of mappings.
 			//
-			// This will prevent swaps from joinquitting the bots.
+			// This will prevent swaps from joinquitting the bots,
+			// and keeps channels that are still mirrored elsewhere.
 			found := false
-			for _, curr := range newMappings {
+			for _, curr := range mappings {
 				if curr.IRCChannel == mapping.IRCChannel {
 					found = true
 				}
 			}
 
+			for _, curr := range rmChannels {
+				if curr == mapping.IRCChannel {
+					found = true
+				}
+			}
+
 			// If we've not found this channel to remove in the new channels
-			// actually part the channel
+			// (and aren't already parting it) actually part the channel
 			if !found {
 				rmChannels = append(rmChannels, mapping.IRCChannel)
 			}
 		}
 
-		b.ircListener.SendRaw("PART " + strings.Join(rmChannels, ","))
-		for _, conn := range b.ircManager.ircConnections {
-			conn.innerCon.SendRaw("PART " + strings.Join(rmChannels, ","))
+		connections := b.ircManager.connections()
+		if len(rmChannels) > 0 {
+			b.ircListener.SendRaw("PART " + strings.Join(rmChannels, ","))
+			for _, conn := range connections {
+				conn.SendRaw("PART " + strings.Join(rmChannels, ","))
+			}
 		}
 
 		// The bots needs to join the new mappings
 		b.ircListener.JoinChannels()
-		for _, conn := range b.ircManager.ircConnections {
+		for _, conn := range connections {
 			conn.JoinChannels()
 		}
 	}
-
-	return nil
 }
 
 // New Bridge
@@ -199,24 +1400,67 @@ func New(conf *Config) (*Bridge, error) {
 		Config: conf,
 		done:   make(chan bool),
 
+		bridgedMessages: newMessageCache(bridgedMessagesCacheSize),
+
 		discordMessagesChan:      make(chan IRCMessage),
 		discordMessageEventsChan: make(chan *DiscordMessage),
 		updateUserChan:           make(chan DiscordUser),
+		reloadChan:               make(chan func()),
 	}
 
-	if err := dib.load(conf); err != nil {
+	if err := ResolveSecrets(conf); err != nil {
+		return nil, err
+	}
+
+	apply, err := dib.load(conf)
+	if err != nil {
 		return nil, errors.Wrap(err, "configuration invalid")
 	}
+	apply()
 
-	var err error
+	if conf.IRCCAFile != "" {
+		dib.ircRootCAs, err = loadCAFile(conf.IRCCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load irc ca file")
+		}
+	}
 
-	dib.discord, err = newDiscord(dib, conf.DiscordBotToken, conf.GuildID)
+	if conf.IRCClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.IRCClientCertFile, conf.IRCClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load irc client certificate")
+		}
+		dib.ircClientCerts = []tls.Certificate{cert}
+	}
+
+	dib.discord, err = newDiscord(dib, conf.DiscordBotToken)
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not create discord bot")
 	}
 
+	nicks, err := loadNickStore(conf.StatePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load state")
+	}
+
+	dib.links, err = loadAccountLinks(conf.LinksPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load account links")
+	}
+
+	dib.queue, err = loadMessageQueue(conf.QueuePath, conf.QueueSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load message queue")
+	}
+
+	dib.deliveries = newOrderedDelivery(conf.WebhookWorkers)
+	dib.ircEchoes = newEchoFilter(conf.EchoWindow)
+	dib.discordEchoes = newEchoFilter(conf.EchoWindow)
+	dib.deliveryFailures = newDeliveryFailures()
+	dib.mutes = newMuteList()
+
 	dib.ircListener = newIRCListener(dib, conf.WebIRCPass)
-	dib.ircManager = newIRCManager(dib)
+	dib.ircManager = newIRCManager(dib, nicks)
 
 	go dib.loop()
 
@@ -229,12 +1473,18 @@ func (b *Bridge) SetIRCListenerName(name string) {
 	b.ircListener.Nick(name)
 }
 
+// SetReloadFunc sets the function called by the "/bridge reload" slash command,
+// which should read the config again and pass it to Reload.
+func (b *Bridge) SetReloadFunc(reload func() error) {
+	b.reload = reload
+}
+
 // SetDebugMode allows you to control debug logging.
 func (b *Bridge) SetDebugMode(debug bool) {
 	b.Config.Debug = debug
 	b.ircListener.SetDebugMode(debug)
 
-	for _, conn := range b.ircManager.ircConnections {
+	for _, conn := range b.ircManager.connections() {
 		conn.innerCon.Debug = debug
 	}
 }
@@ -248,80 +1498,225 @@ func (b *Bridge) Open() (err error) {
 		return errors.Wrap(err, "can't open discord")
 	}
 
+	// Send whatever we didn't get to before the last restart,
+	// before any new messages can arrive from IRC
+	if pending := b.queue.Pending(); len(pending) > 0 {
+		log.WithField("count", len(pending)).Infoln("Sending messages queued before restarting")
+		for _, r := range pending {
+			b.relayToDiscord(*r.Message, r.ID)
+		}
+	}
+
 	err = b.ircListener.Connect(b.Config.IRCServer)
 	if err != nil {
+		if b.Config.IRCSASLLogin != "" {
+			return errors.Wrap(err, "can't open irc connection (is SASL configured correctly?)")
+		}
 		return errors.Wrap(err, "can't open irc connection")
 	}
 
 	// run listener loop
 	go b.ircListener.Loop()
 
+	if b.Config.HTTPAddr != "" {
+		b.http = b.newHTTPServer()
+		go func() {
+			if err := b.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithField("error", err).Errorln("http server failed")
+			}
+		}()
+	}
+
 	return
 }
 
-func rejoinIRC(con *irc.Connection, event *irc.Event) {
-	if event.Arguments[1] == con.GetNick() {
-		con.Join(event.Arguments[0])
+// kickRejoinDelay is how long to wait before rejoining a channel we were kicked from
+var kickRejoinDelay = time.Second * 10
+
+func (b *Bridge) rejoinIRC(con *irc.Connection, event *irc.Event) {
+	if event.Arguments[1] != con.GetNick() {
+		return
 	}
+
+	channel := event.Arguments[0]
+	time.AfterFunc(kickRejoinDelay, func() {
+		key, ok := b.GetIRCChannels()[channel]
+		if !ok || !con.Connected() {
+			return
+		}
+
+		if key != "" {
+			con.Join(channel + " " + key)
+		} else {
+			con.Join(channel)
+		}
+	})
 }
 
 // SetupIRCConnection sets up an IRC connection with config settings like
-// UseTLS, InsecureSkipVerify, and WebIRCPass.
-func (b *Bridge) SetupIRCConnection(con *irc.Connection, hostname, ip string) {
+// UseTLS, InsecureSkipVerify, IRCCAFile, the listener's client certificate and WebIRCPass.
+//
+// user is the Discord user the connection is for, or nil for the listener,
+// and decides the hostname and IP sent with WEBIRC, see webIRCHost.
+func (b *Bridge) SetupIRCConnection(con *irc.Connection, user *DiscordUser) {
 	if !b.Config.NoTLS {
 		con.UseTLS = true
 		con.TLSConfig = &tls.Config{
 			InsecureSkipVerify: b.Config.InsecureSkipVerify,
+			RootCAs:            b.ircRootCAs,
+		}
+
+		// Puppets belong to their Discord users, not the bridge's account
+		if user == nil {
+			con.TLSConfig.Certificates = b.ircClientCerts
 		}
 	}
 	con.AddCallback("KICK", func(e *irc.Event) {
-		rejoinIRC(con, e)
+		b.rejoinIRC(con, e)
+	})
+	b.setupCTCP(con)
+
+	// ERR_BANNEDFROMCHAN
+	con.AddCallback("474", func(e *irc.Event) {
+		log.WithFields(log.Fields{
+			"nick":    con.GetNick(),
+			"channel": e.Arguments[1],
+		}).Warnln("Could not join IRC channel as we are banned")
 	})
 
+	// go-ircevent sends PASS before NICK and USER. Don't turn on con.Debug,
+	// which logs every line sent, including the password.
 	con.Password = b.Config.IRCServerPass
 
+	if b.Config.IRCSASLLogin != "" {
+		con.UseSASL = true
+		con.SASLMech = "PLAIN"
+		con.SASLLogin = b.Config.IRCSASLLogin
+		con.SASLPassword = b.Config.IRCSASLPassword
+
+		// Connect will also fail, but this tells us which connection it was
+		con.AddCallback("904", func(e *irc.Event) {
+			log.WithFields(log.Fields{
+				"nick":  con.GetNick(),
+				"error": e.Message(),
+			}).Errorln("SASL authentication failed")
+		})
+	}
+
 	if b.Config.WebIRCPass != "" {
-		con.WebIRC = fmt.Sprintf("%s discord %s %s", b.Config.WebIRCPass, hostname, ip)
+		hostname, ip := b.webIRCHost(user)
+		if net.ParseIP(ip) == nil {
+			log.WithField("ip", ip).Errorln("Not sending WEBIRC, as the IP is invalid")
+			return
+		}
+
+		if !webIRCHostnameRegex.MatchString(hostname) {
+			log.WithField("hostname", hostname).Warnln("WEBIRC hostname is invalid, sending the IP instead")
+			hostname = ip
+		}
+
+		con.WebIRC = fmt.Sprintf("%s %s %s %s", b.Config.WebIRCPass, b.Config.WebIRCGateway, hostname, ip)
+	}
+}
+
+// webIRCHostnameRegex matches hostnames that can be sent with WEBIRC
+var webIRCHostnameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// webIRCIPPrefix is the unique local IPv6 range that WEBIRC IPs are made in
+const webIRCIPPrefix = "fd75:f5f5:226f:"
+
+// webIRCHost returns the hostname and IP sent with WEBIRC for the user's connection.
+//
+// They only depend on the user's Discord ID, so are the same across restarts and
+// can be banned or cloaked on IRC. The IP is webIRCIPPrefix, then 1 for users or
+// 2 for bots, then the ID in hexadecimal, e.g "fd75:f5f5:226f:1:01b6:9b4b:a630:f34e"
+// for 123456789012345678.
+// The hostname is from Config.WebIRCHostnameFormat, or the IP if that fails.
+//
+// The listener (a nil user) is "discord." at "fd75:f5f5:226f::".
+func (b *Bridge) webIRCHost(user *DiscordUser) (hostname, ip string) {
+	if user == nil {
+		return "discord.", webIRCIPPrefix + ":"
+	}
+
+	if user.Bot {
+		ip = SnowflakeToIP(webIRCIPPrefix+"2", user.ID)
+	} else {
+		ip = SnowflakeToIP(webIRCIPPrefix+"1", user.ID)
+	}
+
+	hash := sha256.Sum256([]byte(user.ID))
+	buf := &strings.Builder{}
+	err := b.webIRCHostname.Execute(buf, webIRCHostnameFields{
+		ID:       user.ID,
+		Hash:     hex.EncodeToString(hash[:])[:webIRCHashLength],
+		Username: user.Username,
+		Bot:      user.Bot,
+	})
+	if err != nil {
+		log.WithField("error", err).Errorln("could not format webirc hostname")
+		return ip, ip
 	}
+	return buf.String(), ip
 }
 
+// webIRCHashLength is how many hex digits of the ID's hash are in .Hash
+const webIRCHashLength = 16
+
 func (b *Bridge) GetJoinCommand() string {
 	channels := b.GetIRCChannels() //i.manager.RequestChannels(i.discord.ID)
 
-	cs := []string{}
-	ps := []string{}
-	for c, p := range channels {
-		cs = append(cs, c)
-		ps = append(ps, p)
+	// Keys apply to channels in order, so channels with keys must come first
+	keyed := []string{}
+	unkeyed := []string{}
+	keys := []string{}
+	for c, k := range channels {
+		if k == "" {
+			unkeyed = append(unkeyed, c)
+		} else {
+			keyed = append(keyed, c)
+			keys = append(keys, k)
+		}
+	}
+
+	cmd := "JOIN " + strings.Join(append(keyed, unkeyed...), ",")
+	if len(keys) > 0 {
+		cmd += " " + strings.Join(keys, ",")
+	}
+	return cmd
+}
+
+// loopMappings returns the mappings, read on the loop, for goroutines that
+// would otherwise race with Reload replacing them.
+func (b *Bridge) loopMappings() []*Mapping {
+	mappings := make(chan []*Mapping)
+	b.reloadChan <- func() {
+		mappings <- b.mappings
 	}
-	return "JOIN " + strings.Join(cs, ",") + " " + strings.Join(ps, ",")
+	return <-mappings
 }
 
-// GetIRCChannels returns a list of irc channels in no particular order.
+// GetIRCChannels returns a map of irc channels to their keys (usually empty), in no particular order.
 func (b *Bridge) GetIRCChannels() map[string]string {
 	channels := make(map[string]string)
 	for _, mapping := range b.mappings {
-		pair := strings.Split(mapping.IRCChannel, " ")
-		c := pair[0]
-		p := ""
-		if len(pair) > 1 {
-			p = pair[1]
-		}
-		channels[c] = p
+		channels[mapping.IRCChannel] = mapping.IRCChannelKey
 	}
 
 	return channels
 }
 
-// GetMappingByIRC returns a Mapping for a given IRC channel.
-// Returns nil if a Mapping does not exist.
-func (b *Bridge) GetMappingByIRC(channel string) *Mapping {
+// GetMappingsByIRC returns the Mappings for a given IRC channel,
+// which may be mirrored to more than one Discord channel.
+// Returns an empty slice if no Mapping exists.
+func (b *Bridge) GetMappingsByIRC(channel string) []*Mapping {
+	mappings := []*Mapping{}
 	for _, mapping := range b.mappings {
-		if strings.Split(mapping.IRCChannel, " ")[0] == channel {
-			return mapping
+		if mapping.IRCChannel == channel {
+			mappings = append(mappings, mapping)
 		}
 	}
-	return nil
+	return mappings
 }
 
 // GetMappingByDiscord returns a Mapping for a given Discord channel.
@@ -335,60 +1730,177 @@ func (b *Bridge) GetMappingByDiscord(channel string) *Mapping {
 	return nil
 }
 
+// relayToDiscord sends the message to every Discord channel its IRC channel
+// is mapped to, removing it from the queue once it has been delivered to them all.
+// Messages that couldn't be delivered stay in the queue, to be sent again after a restart.
+func (b *Bridge) relayToDiscord(msg IRCMessage, queueID uint64) {
+	mappings := b.GetMappingsByIRC(msg.IRCChannel)
+
+	if len(mappings) == 0 {
+		log.Warnln("Ignoring message sent from an unhandled IRC channel.")
+		b.queue.Done(queueID)
+		return
+	}
+
+	// An IRC channel can be mirrored to several Discord channels
+	var wg sync.WaitGroup
+	var failed int32
+	wg.Add(len(mappings))
+	done := func(delivered bool) {
+		if !delivered {
+			atomic.StoreInt32(&failed, 1)
+		}
+		wg.Done()
+	}
+
+	for _, mapping := range mappings {
+		// Messages can only be sent to the posts of a forum, not the forum itself
+		if !mapping.ToDiscord() || b.discord.isForum(mapping.DiscordChannel) || b.isFiltered(mapping, MappingDirectionToDiscord, msg.Message) {
+			wg.Done()
+			continue
+		}
+
+		b.sendToDiscord(mapping, msg, done)
+	}
+
+	go func() {
+		wg.Wait()
+		if atomic.LoadInt32(&failed) == 0 {
+			b.queue.Done(queueID)
+		}
+	}()
+}
+
+// sendToDiscord transmits a message from IRC to the mapping's Discord channel in the background,
+// after any messages already waiting to be sent to the channel, calling done with whether it was delivered.
+func (b *Bridge) sendToDiscord(mapping *Mapping, msg IRCMessage, done func(delivered bool)) {
+	// IRC users who have linked their Discord account look like it
+	var avatar, linkedName string
+	if member := b.linkedMember(mapping.GuildID, msg.Username); member != nil {
+		avatar = discordgo.EndpointUserAvatar(member.User.ID, member.User.Avatar)
+		linkedName = GetMemberNick(member)
+	} else {
+		avatar = b.discord.GetAvatar(mapping.GuildID, msg.Username)
+	}
+
+	if avatar == "" {
+		// If we don't have a Discord avatar, generate one
+		avatars := b.avatars
+		if override := b.channelOverrides[mapping.DiscordChannel].avatars; override != nil {
+			avatars = override
+		}
+		avatar = avatars.Avatar(msg.Username, msg.IRCChannel)
+	}
+
+	username := b.discordUsername(mapping, msg, linkedName)
+	if len(username) == 1 {
+		// Append usernames with 1 character
+		// This is because Discord doesn't accept single character usernames
+		username += `.` // <- zero width space in here, ayylmao
+	}
+
+	content := msg.Message
+
+	mentions := &discordgo.MessageAllowedMentions{
+		Parse: []discordgo.AllowedMentionType{},
+	}
+
+	switch b.Config.IRCMentions {
+	case IRCMentionsNicks:
+		// Only the users the listener found by their nick, not <@id> typed on IRC
+		mentions.Users = msg.Mentions
+	case IRCMentionsAll:
+		mentions.Parse = append(mentions.Parse, discordgo.AllowedMentionTypeUsers, discordgo.AllowedMentionTypeRoles)
+	}
+
+	if b.Config.AllowEveryoneFromIRC {
+		mentions.Parse = append(mentions.Parse, discordgo.AllowedMentionTypeEveryone)
+	} else {
+		// Replace everyone and here - https://git.io/Je1yi
+		// allowed_mentions already stops them pinging, but they would still look like a ping
+		content = strings.ReplaceAll(content, "@everyone", "@\u200beveryone")
+		content = strings.ReplaceAll(content, "@here", "@\u200bhere")
+	}
+
+	send := func() {
+		// Long lines (or several joined together) can be too long for one message,
+		// so send them as several, which all look like they came from the same user
+		var sent *discordgo.Message
+		var err error
+		defer func() { done(err == nil) }()
+
+		for _, part := range splitDiscordMessage(content) {
+			sent, err = b.discord.transmitters[mapping.GuildID].Message(
+				mapping.DiscordChannel,
+				username,
+				avatar,
+				part,
+				mentions,
+			)
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			b.stats.messageToDiscord()
+			b.deliveryFailures.Delivered(mapping.DiscordChannel)
+			if sent != nil {
+				log.WithFields(log.Fields{
+					"msg.channel": mapping.DiscordChannel,
+					"msg.id":      sent.ID,
+				}).Debugln("delivered message to discord")
+			}
+		} else {
+			log.WithFields(log.Fields{
+				"error":        err,
+				"msg.channel":  mapping.DiscordChannel,
+				"msg.username": username,
+				"msg.avatar":   avatar,
+				"msg.content":  content,
+			}).Errorln("could not transmit message to discord")
+
+			if b.deliveryFailures.Failed(mapping.DiscordChannel, err) && b.Config.NotifyDeliveryFailures {
+				b.ircListener.Notice(mapping.IRCChannel, "Messages from this channel are not reaching Discord, please tell an admin of the bridge.")
+			}
+		}
+	}
+
+	b.discordEchoes.Sent(mapping.DiscordChannel, content)
+	b.deliveries.Send(mapping.DiscordChannel, delivery{send: send, drop: func() { done(false) }})
+}
+
 func (b *Bridge) loop() {
 	for {
 		select {
 
 		// Messages from IRC to Discord
 		case msg := <-b.discordMessagesChan:
-			mapping := b.GetMappingByIRC(msg.IRCChannel)
-
-			if mapping == nil {
-				log.Warnln("Ignoring message sent from an unhandled IRC channel.")
+			if b.mutes.IsMuted(ircMuteKey(msg.Username)) {
 				continue
 			}
 
-			avatar := b.discord.GetAvatar(b.Config.GuildID, msg.Username)
-			if avatar == "" {
-				// If we don't have a Discord avatar, generate an adorable avatar
-				avatar = "https://api.adorable.io/avatars/128/" + msg.Username
+			if b.isFilteredToDiscord(msg) {
+				continue
 			}
 
-			username := msg.Username
-			if len(username) == 1 {
-				// Append usernames with 1 character
-				// This is because Discord doesn't accept single character usernames
-				username += `.` // <- zero width space in here, ayylmao
+			if hook := b.Config.OnIRCMessage; hook != nil && !hook(&msg) {
+				continue
 			}
 
-			content := msg.Message
-
-			// Replace everyone and here - https://git.io/Je1yi
-			content = strings.ReplaceAll(content, "@everyone", "@\u200beveryone")
-			content = strings.ReplaceAll(content, "@here", "@\u200bhere")
-
-			go func() {
-				err := b.discord.transmitter.Message(
-					mapping.DiscordChannel,
-					username,
-					avatar,
-					content,
-				)
-
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error":        err,
-						"msg.channel":  mapping.DiscordChannel,
-						"msg.username": username,
-						"msg.avatar":   avatar,
-						"msg.content":  content,
-					}).Errorln("could not transmit message to discord")
-				}
-			}()
+			b.relayToDiscord(msg, b.queue.Push(msg))
 
 		// Messages from Discord to IRC
 		case msg := <-b.discordMessageEventsChan:
-			mapping := b.GetMappingByDiscord(msg.ChannelID)
+			channelID := msg.ChannelID
+			if msg.ParentChannelID != "" {
+				channelID = msg.ParentChannelID
+			}
+			mapping := b.GetMappingByDiscord(channelID)
+
+			if msg.Author != nil && b.mutes.IsMuted(discordMuteKey(msg.Author.ID)) {
+				continue
+			}
 
 			// Do not do anything if we do not have a mapping for the PUBLIC channel
 			if mapping == nil && msg.PmTarget == "" {
@@ -396,23 +1908,43 @@ func (b *Bridge) loop() {
 				continue
 			}
 
+			if mapping != nil && (!mapping.ToIRC() || b.isFiltered(mapping, MappingDirectionToIRC, msg.Content)) {
+				continue
+			}
+
+			// Only relay edits for messages that IRC has actually seen
+			if msg.IsEdit && !b.bridgedMessages.Contains(msg.ID) {
+				continue
+			}
+
+			if hook := b.Config.OnDiscordMessage; hook != nil && !hook(msg) {
+				continue
+			}
+
 			target := msg.PmTarget
 			if target == "" {
 				target = mapping.IRCChannel
 			}
 
 			b.ircManager.SendMessage(target, msg)
+			b.ircEchoes.Sent(target, msg.Content)
+			b.stats.messageToIRC()
+
+			if msg.ID != "" {
+				b.bridgedMessages.Add(msg.ID)
+			}
 
 		// Notification to potentially update, or create, a user
 		// We should not receive anything on this channel if we're in Simple Mode
 		case user := <-b.updateUserChan:
 			b.ircManager.HandleUser(user)
 
-		// Done!
+		// A new config, applied here so that nothing else in the loop sees half of it
+		case reload := <-b.reloadChan:
+			reload()
+
+		// Done! CloseContext takes care of closing everything
 		case <-b.done:
-			b.discord.Close()
-			b.ircListener.Quit()
-			b.ircManager.Close()
 			close(b.done)
 
 			return
@@ -420,3 +1952,17 @@ func (b *Bridge) loop() {
 
 	}
 }
+
+// loadCAFile reads the PEM encoded certificates in path into a new pool.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
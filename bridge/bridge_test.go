@@ -0,0 +1,247 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+func TestMappings(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.ChannelMappings = map[string]string{
+			"#irc":        testChannelID,
+			"#mirror":     "200000000000000002, 200000000000000003",
+			"#secret key": "200000000000000004",
+		}
+	})
+
+	if mapping := tb.GetMappingByDiscord(testChannelID); mapping == nil || mapping.IRCChannel != "#irc" || mapping.GuildID != testGuildID {
+		t.Errorf("GetMappingByDiscord(%q) = %+v, want #irc", testChannelID, mapping)
+	}
+
+	if mapping := tb.GetMappingByDiscord("200000000000000009"); mapping != nil {
+		t.Errorf("GetMappingByDiscord of an unmapped channel = %+v, want nil", mapping)
+	}
+
+	mirrors := tb.GetMappingsByIRC("#mirror")
+	if len(mirrors) != 2 {
+		t.Fatalf("GetMappingsByIRC(#mirror) returned %d mappings, want 2", len(mirrors))
+	}
+	for _, mapping := range mirrors {
+		if mapping.DiscordChannel != "200000000000000002" && mapping.DiscordChannel != "200000000000000003" {
+			t.Errorf("#mirror is mapped to %q", mapping.DiscordChannel)
+		}
+	}
+
+	secret := tb.GetMappingByDiscord("200000000000000004")
+	if secret == nil || secret.IRCChannel != "#secret" || secret.IRCChannelKey != "key" {
+		t.Errorf("GetMappingByDiscord of a channel with a key = %+v, want #secret with key", secret)
+	}
+
+	if mappings := tb.GetMappingsByIRC("#unmapped"); len(mappings) != 0 {
+		t.Errorf("GetMappingsByIRC(#unmapped) = %v, want none", mappings)
+	}
+}
+
+func TestRelayToDiscord(t *testing.T) {
+	tb := newTestBridge(t, nil)
+
+	tb.discordMessagesChan <- IRCMessage{
+		IRCChannel: "#irc",
+		Username:   "alice",
+		Message:    "hello @everyone",
+	}
+
+	msg := tb.webhooks.next(t)
+	if msg.channel != testChannelID {
+		t.Errorf("message was sent to %q, want %q", msg.channel, testChannelID)
+	}
+	if msg.params.Username != "alice" {
+		t.Errorf("message was sent as %q, want alice", msg.params.Username)
+	}
+	if want := "hello @​everyone"; msg.params.Content != want {
+		t.Errorf("message content = %q, want %q", msg.params.Content, want)
+	}
+}
+
+func TestRelayToIRC(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	author := tb.addUser("500000000000000001", "alice", "")
+
+	tb.discordMessageEventsChan <- &DiscordMessage{
+		Message: &discordgo.Message{
+			ID:        "600000000000000001",
+			ChannelID: testChannelID,
+			GuildID:   testGuildID,
+			Author:    author,
+		},
+		Content: "hello",
+	}
+
+	if got, want := tb.irc.next(t), "PRIVMSG #irc :<a​lice> hello"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+
+	tb.discordMessageEventsChan <- &DiscordMessage{
+		Message: &discordgo.Message{
+			ID:        "600000000000000002",
+			ChannelID: testChannelID,
+			GuildID:   testGuildID,
+			Author:    author,
+		},
+		Content:  "waves",
+		IsAction: true,
+	}
+
+	if got, want := tb.irc.next(t), "PRIVMSG #irc :* a​lice waves"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+}
+
+func TestUnmappedChannelsAreIgnored(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	author := tb.addUser("500000000000000001", "alice", "")
+
+	tb.discordMessageEventsChan <- &DiscordMessage{
+		Message: &discordgo.Message{
+			ChannelID: "200000000000000009",
+			GuildID:   testGuildID,
+			Author:    author,
+		},
+		Content: "hello",
+	}
+	tb.irc.none(t)
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#unmapped", Username: "bob", Message: "hello"}
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "still here"}
+
+	if msg := tb.webhooks.next(t); msg.params.Content != "still here" {
+		t.Errorf("message content = %q, want the message from the mapped channel", msg.params.Content)
+	}
+}
+
+func TestOneWayMappingNotices(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.ChannelMappings = map[string]string{
+			"#irc":  testChannelID,
+			"#both": "200000000000000002",
+			"#in":   "200000000000000003",
+		}
+		conf.ChannelOverrides = []ChannelOverride{
+			{DiscordChannel: testChannelID, Direction: MappingDirectionToIRC},
+			{DiscordChannel: "200000000000000003", Direction: MappingDirectionToDiscord},
+		}
+		conf.RelayTopicsToDiscord = true
+		conf.RelayTopicsToIRC = true
+		conf.SystemMessages = []string{SystemMessageJoins}
+	})
+	alice := tb.addUser("500000000000000001", "alice", "")
+	listener := tb.ircListener
+
+	// Each notice is sent for the one-way mapping first, so the first
+	// thing to arrive shows whether it was dropped
+	sent := func(want string) {
+		t.Helper()
+
+		select {
+		case got := <-tb.discord.sent:
+			if got != want {
+				t.Errorf("sent %q to discord, want %q", got, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("nothing was sent to discord, want %q", want)
+		}
+	}
+
+	listener.topics.OnTopic(&irc.Event{Code: "TOPIC", Nick: "bob", Arguments: []string{"#irc", "announcements only"}})
+	listener.topics.OnTopic(&irc.Event{Code: "TOPIC", Nick: "bob", Arguments: []string{"#both", "anything goes"}})
+	sent("bob changed the topic to: anything goes")
+
+	listener.joinParts.send("#irc", "bob has joined #irc")
+	listener.joinParts.send("#both", "bob has joined #both")
+	sent("bob has joined #both")
+
+	listener.topics.OnDiscordChannels([]*discordgo.Channel{{ID: "200000000000000003"}, {ID: testChannelID}})
+	listener.topics.OnDiscordChannelUpdate(&discordgo.Channel{ID: "200000000000000003", Topic: "from discord"})
+	listener.topics.OnDiscordChannelUpdate(&discordgo.Channel{ID: testChannelID, Topic: "news"})
+	if got, want := tb.irc.next(t), "TOPIC #irc :news"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+
+	for _, channelID := range []string{"200000000000000003", testChannelID} {
+		tb.Bridge.discord.publishSystemMessage(&discordgo.Message{
+			Type:      discordgo.MessageTypeGuildMemberJoin,
+			ChannelID: channelID,
+			GuildID:   testGuildID,
+			Author:    alice,
+		})
+	}
+	if got, want := tb.irc.next(t), "NOTICE #irc :alice joined the server"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+	tb.irc.none(t)
+}
+
+func TestClientCertificateOnlyForListener(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	tb.ircClientCerts = []tls.Certificate{{Certificate: [][]byte{[]byte("bridge")}}}
+
+	listener := irc.IRC("bridge", "bridge")
+	tb.SetupIRCConnection(listener, nil)
+	if len(listener.TLSConfig.Certificates) != 1 {
+		t.Errorf("the listener presents %d certificates, want 1", len(listener.TLSConfig.Certificates))
+	}
+
+	puppet := irc.IRC("alice", "discord")
+	tb.SetupIRCConnection(puppet, &DiscordUser{ID: "500000000000000001", Username: "alice"})
+	if len(puppet.TLSConfig.Certificates) != 0 {
+		t.Errorf("a puppet presents %d certificates, want none", len(puppet.TLSConfig.Certificates))
+	}
+}
+
+func TestFiltersApplyBeforeHooks(t *testing.T) {
+	hooked := make(chan string, 10)
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.ChannelOverrides = []ChannelOverride{{
+			DiscordChannel: testChannelID,
+			Filters:        []MessageFilter{{Pattern: `^\.\w+`}},
+		}}
+		conf.OnIRCMessage = func(msg *IRCMessage) bool {
+			hooked <- msg.Message
+			return true
+		}
+		conf.OnDiscordMessage = func(msg *DiscordMessage) bool {
+			hooked <- msg.Content
+			return true
+		}
+	})
+	author := tb.addUser("500000000000000001", "alice", "")
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: ".seen alice"}
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "hello"}
+	if msg := tb.webhooks.next(t); msg.params.Content != "hello" {
+		t.Errorf("message content = %q, want the unfiltered message", msg.params.Content)
+	}
+
+	for _, content := range []string{".weather", "hi"} {
+		tb.discordMessageEventsChan <- &DiscordMessage{
+			Message: &discordgo.Message{ChannelID: testChannelID, GuildID: testGuildID, Author: author},
+			Content: content,
+		}
+	}
+	if got, want := tb.irc.next(t), "PRIVMSG #irc :<a​lice> hi"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+
+	close(hooked)
+	got := []string{}
+	for content := range hooked {
+		got = append(got, content)
+	}
+	if len(got) != 2 || got[0] != "hello" || got[1] != "hi" {
+		t.Errorf("hooks were called with %q, want only the unfiltered messages", got)
+	}
+}
@@ -0,0 +1,231 @@
+package bridge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A command is answered by the bridge when sent in a bridged channel on
+// either side, as Config.CommandPrefix followed by its name, e.g "!who".
+type command struct {
+	name string
+	help string
+
+	// ircName is another name the command has on IRC, if any
+	ircName string
+
+	// adminOnly commands can only be used by admins, see commandRequest.admin
+	adminOnly bool
+
+	run func(b *Bridge, req commandRequest)
+}
+
+// commandRequest is a command someone sent in a bridged channel.
+type commandRequest struct {
+	onIRC bool
+
+	// The channels of the mapping it was sent in
+	discordChannel string
+	ircChannel     string
+
+	// admin is true if they have one of the AdminRoleIDs, or match one of the IRCAdminHosts
+	admin bool
+
+	args []string
+}
+
+// "help" is answered by runCommand itself, as it lists these
+var commands = []command{
+	{
+		name: "ping",
+		help: "replies Pong!",
+		run: func(b *Bridge, req commandRequest) {
+			b.replyToCommand(req, "Pong!")
+		},
+	},
+	{
+		name:    "who",
+		help:    "lists who is on the other side of the bridge",
+		ircName: "discord",
+		run: func(b *Bridge, req commandRequest) {
+			if req.onIRC {
+				b.ircListener.sendDiscordUsers(req.ircChannel)
+			} else {
+				b.discord.sendIRCUsers(req.discordChannel, req.ircChannel)
+			}
+		},
+	},
+	{
+		name: "link",
+		help: "explains how to link your IRC and Discord accounts",
+		run: func(b *Bridge, req commandRequest) {
+			if !b.links.Enabled() {
+				b.replyToCommand(req, "Linking accounts is not enabled on this bridge.")
+				return
+			}
+
+			how := fmt.Sprintf("Use /link on Discord to get a code, then send it privately on IRC with /msg %s link <code>.", b.ircListener.GetNick())
+			if !req.onIRC {
+				b.replyToCommand(req, how)
+				return
+			}
+
+			// Someone else could use a code sent in the channel to link their account in its place
+			if len(req.args) > 0 && b.links.CancelCode(req.args[0]) {
+				how += " That code was sent publicly, so it has been cancelled."
+			}
+			b.replyToCommand(req, how)
+		},
+	},
+	{
+		name:      "announce",
+		help:      "sends a message to every bridged channel",
+		adminOnly: true,
+		run: func(b *Bridge, req commandRequest) {
+			if len(req.args) == 0 {
+				b.replyToCommand(req, "Usage: "+b.Config.CommandPrefix+"announce <message>")
+				return
+			}
+			b.announce(strings.Join(req.args, " "))
+		},
+	},
+	{
+		name:      "mute",
+		help:      "stops bridging someone's messages for a while",
+		adminOnly: true,
+		run: func(b *Bridge, req commandRequest) {
+			usage := "Usage: " + b.Config.CommandPrefix + "mute <discord user, id or irc nick> <duration, e.g 10m>"
+			if len(req.args) != 2 {
+				b.replyToCommand(req, usage)
+				return
+			}
+
+			duration, err := time.ParseDuration(req.args[1])
+			if err != nil || duration <= 0 {
+				b.replyToCommand(req, usage)
+				return
+			}
+
+			b.mutes.Mute(b.muteKey(req.args[0]), duration)
+			b.replyToCommand(req, fmt.Sprintf("%s is muted for %s.", req.args[0], duration))
+		},
+	},
+	{
+		name:      "unmute",
+		help:      "bridges a muted person's messages again",
+		adminOnly: true,
+		run: func(b *Bridge, req commandRequest) {
+			if len(req.args) != 1 {
+				b.replyToCommand(req, "Usage: "+b.Config.CommandPrefix+"unmute <discord user, id or irc nick>")
+				return
+			}
+
+			if !b.mutes.Unmute(b.muteKey(req.args[0])) {
+				b.replyToCommand(req, req.args[0]+" is not muted.")
+				return
+			}
+			b.replyToCommand(req, req.args[0]+" is no longer muted.")
+		},
+	},
+}
+
+// commandName matches what might be a command name, so that "!!" or "! hi" aren't commands.
+var commandName = regexp.MustCompile(`^\w+$`)
+
+// runCommand answers the message if it is a command, returning false if it isn't.
+//
+// Messages that look like commands are never relayed, even if we don't know the command.
+func (b *Bridge) runCommand(req commandRequest, message string) bool {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, b.Config.CommandPrefix) {
+		return false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(message, b.Config.CommandPrefix))
+	if len(fields) == 0 || !commandName.MatchString(fields[0]) {
+		return false
+	}
+
+	name := strings.ToLower(fields[0])
+	req.args = fields[1:]
+
+	if name == "help" {
+		b.replyToCommand(req, b.commandHelp(req.admin))
+		return true
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name || (req.onIRC && cmd.ircName != "" && cmd.ircName == name) {
+			if cmd.adminOnly && !req.admin {
+				b.replyToCommand(req, "You are not allowed to use "+b.Config.CommandPrefix+cmd.name+".")
+				return true
+			}
+
+			cmd.run(b, req)
+			return true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"command": name,
+		"irc":     req.onIRC,
+	}).Debugln("Ignoring unknown command")
+	return true
+}
+
+// commandHelp lists the commands, e.g "Commands: !help, !ping (replies Pong!)".
+// Admin commands are only listed for admins.
+func (b *Bridge) commandHelp(admin bool) string {
+	parts := []string{b.Config.CommandPrefix + "help"}
+	for _, cmd := range commands {
+		if cmd.adminOnly && !admin {
+			continue
+		}
+		parts = append(parts, b.Config.CommandPrefix+cmd.name+" ("+cmd.help+")")
+	}
+	return "Commands: " + strings.Join(parts, ", ")
+}
+
+// replyToCommand answers in the channel the command was sent in.
+func (b *Bridge) replyToCommand(req commandRequest, message string) {
+	if req.onIRC {
+		b.ircListener.Notice(req.ircChannel, message)
+		return
+	}
+
+	if _, err := b.discord.ChannelMessageSend(req.discordChannel, message); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"channel": req.discordChannel,
+		}).Errorln("could not reply to command on discord")
+	}
+}
+
+// announce sends the message to every bridged channel on both sides,
+// from the Discord bot and the IRC listener rather than for anyone.
+func (b *Bridge) announce(message string) {
+	ircChannels := make(map[string]struct{})
+
+	for _, mapping := range b.loopMappings() {
+		if _, ok := ircChannels[mapping.IRCChannel]; !ok {
+			ircChannels[mapping.IRCChannel] = struct{}{}
+			b.ircListener.Notice(mapping.IRCChannel, "[Announcement] "+message)
+		}
+
+		// Forums can only contain posts
+		if b.discord.isForum(mapping.DiscordChannel) {
+			continue
+		}
+
+		if _, err := b.discord.ChannelMessageSend(mapping.DiscordChannel, "📢 **Announcement:** "+message); err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"channel": mapping.DiscordChannel,
+			}).Errorln("could not send announcement to discord")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// ConnectionInfo describes the IRC connection of a Discord user,
+// as returned by ListConnections.
+type ConnectionInfo struct {
+	DiscordID string `json:"discord_id"`
+	Nick      string `json:"nick"`
+	Connected bool   `json:"connected"`
+
+	// Channels are the IRC channels the connection has joined
+	Channels []string `json:"channels"`
+
+	// LastActivity is when the connection last sent a message, or nil if it hasn't
+	LastActivity *time.Time `json:"last_activity"`
+
+	MessagesSent int `json:"messages_sent"`
+	BytesSent    int `json:"bytes_sent"`
+
+	// Reconnects is how many times the connection has been reconnected after dropping
+	Reconnects int `json:"reconnects"`
+
+	// LastError is the last thing to go wrong, e.g "433: nick alice~d is unavailable",
+	// and LastErrorAt is when. They are kept after the connection recovers.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// connectionErrorCodes are the replies recorded as a connection's last error,
+// for when it can't join or speak in a channel, or has been banned.
+var connectionErrorCodes = []string{"ERROR", "404", "432", "465", "471", "473", "474", "475", "477"}
+
+// ListConnections returns a snapshot of the IRC connections the bridge has
+// made for Discord users, sorted by nick. It is empty in simple mode.
+//
+// It is safe to call from any goroutine.
+func (b *Bridge) ListConnections() []ConnectionInfo {
+	m := b.ircManager
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+
+	infos := make([]ConnectionInfo, 0, len(m.ircConnections))
+	for _, con := range m.ircConnections {
+		infos = append(infos, con.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Nick < infos[j].Nick
+	})
+	return infos
+}
+
+func (i *ircConnection) info() ConnectionInfo {
+	info := ConnectionInfo{
+		DiscordID: i.discord.ID,
+		Nick:      i.innerCon.GetNick(),
+		Connected: i.state.Connected(),
+	}
+
+	stats := &i.state.stats
+	stats.Lock()
+	info.MessagesSent = stats.messagesSent
+	info.BytesSent = stats.bytesSent
+	info.Reconnects = stats.reconnects
+	info.LastError = stats.lastError
+	if !stats.lastSent.IsZero() {
+		t := stats.lastSent.UTC()
+		info.LastActivity = &t
+	}
+	if !stats.lastErrorAt.IsZero() {
+		t := stats.lastErrorAt.UTC()
+		info.LastErrorAt = &t
+	}
+	stats.Unlock()
+
+	i.channelsMu.Lock()
+	info.Channels = make([]string, 0, len(i.channels))
+	for channel := range i.channels {
+		info.Channels = append(info.Channels, channel)
+	}
+	i.channelsMu.Unlock()
+	sort.Strings(info.Channels)
+
+	return info
+}
+
+// OnJoinPart keeps track of the channels the connection is in.
+func (i *ircConnection) OnJoinPart(e *irc.Event) {
+	if len(e.Arguments) == 0 {
+		return
+	}
+
+	channel := strings.ToLower(e.Arguments[0])
+	self := e.Nick == i.innerCon.GetNick()
+
+	i.channelsMu.Lock()
+	defer i.channelsMu.Unlock()
+
+	switch e.Code {
+	case "JOIN":
+		if self {
+			i.channels[channel] = struct{}{}
+		}
+	case "PART":
+		if self {
+			delete(i.channels, channel)
+		}
+	case "KICK":
+		if len(e.Arguments) > 1 && e.Arguments[1] == i.innerCon.GetNick() {
+			delete(i.channels, channel)
+		}
+	}
+}
+
+// OnError records replies like "474 alice~d #channel :Cannot join channel (+b)" as the last error.
+func (i *ircConnection) OnError(e *irc.Event) {
+	args := e.Arguments
+	// Numerics start with our nick
+	if e.Code != "ERROR" && len(args) > 0 {
+		args = args[1:]
+	}
+	i.state.stats.recordError(e.Code + ": " + strings.Join(args, " "))
+}
@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/qaisjp/go-discord-irc/transmitter"
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveryFailureNotifyAfter is how many messages in a row can fail to reach
+// a Discord channel, for reasons other than permissions, before IRC is told.
+const deliveryFailureNotifyAfter = 5
+
+// deliveryFailures counts the messages in a row that couldn't be sent to each
+// Discord channel, so that a channel the bot can't post in doesn't go unnoticed.
+type deliveryFailures struct {
+	sync.Mutex
+	channels map[string]*channelFailures
+}
+
+type channelFailures struct {
+	consecutive int
+	lastError   string
+	permission  bool
+
+	// notified is set once IRC has been told, so that it is only told once
+	notified bool
+}
+
+// ChannelDeliveryFailure is a Discord channel that the latest messages couldn't be sent to.
+type ChannelDeliveryFailure struct {
+	DiscordChannel string `json:"discord_channel"`
+	Consecutive    int    `json:"consecutive"`
+	LastError      string `json:"last_error"`
+	Permission     bool   `json:"missing_permission"`
+}
+
+func newDeliveryFailures() *deliveryFailures {
+	return &deliveryFailures{channels: make(map[string]*channelFailures)}
+}
+
+// Delivered forgets the channel's failures.
+func (f *deliveryFailures) Delivered(channel string) {
+	f.Lock()
+	defer f.Unlock()
+
+	if failures, ok := f.channels[channel]; ok {
+		log.WithFields(log.Fields{
+			"channel":  channel,
+			"failures": failures.consecutive,
+		}).Infoln("Messages are reaching the discord channel again")
+		delete(f.channels, channel)
+	}
+}
+
+// Failed records the failure, returning true if IRC should be told about it.
+func (f *deliveryFailures) Failed(channel string, err error) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	failures, ok := f.channels[channel]
+	if !ok {
+		failures = &channelFailures{}
+		f.channels[channel] = failures
+	}
+
+	failures.consecutive++
+	failures.lastError = err.Error()
+	failures.permission = transmitter.IsPermissionError(err)
+
+	if failures.permission {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"channel": channel,
+		}).Errorln("Missing permission to send messages to the discord channel, the bot needs 'Manage Webhooks' and access to it")
+	}
+
+	if failures.notified || (!failures.permission && failures.consecutive < deliveryFailureNotifyAfter) {
+		return false
+	}
+	failures.notified = true
+	return true
+}
+
+// List returns the channels that the latest messages couldn't be sent to.
+func (f *deliveryFailures) List() []ChannelDeliveryFailure {
+	f.Lock()
+	defer f.Unlock()
+
+	list := []ChannelDeliveryFailure{}
+	for channel, failures := range f.channels {
+		list = append(list, ChannelDeliveryFailure{
+			DiscordChannel: channel,
+			Consecutive:    failures.consecutive,
+			LastError:      failures.lastError,
+			Permission:     failures.permission,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DiscordChannel < list[j].DiscordChannel
+	})
+	return list
+}
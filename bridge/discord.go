@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-multierror"
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
 	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
 	"github.com/qaisjp/go-discord-irc/transmitter"
 
@@ -14,16 +18,79 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// discordSession is the part of *discordgo.Session the bot uses once connected,
+// so that tests can give it a fake one.
+type discordSession interface {
+	AddHandler(handler interface{}) func()
+	UpdateStatusComplex(usd discordgo.UpdateStatusData) error
+	RequestGuildMembers(guildID, query string, limit int, nonce string, presences bool) error
+
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelEdit(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+
+	ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) (*discordgo.ApplicationCommand, error)
+}
+
 type discordBot struct {
-	*discordgo.Session
+	discordSession
 	bridge *Bridge
 
-	guildID string
+	// session is the real session, which is only needed to connect and disconnect
+	session *discordgo.Session
+
+	// State is the session's state, which tests fill in themselves
+	State *discordgo.State
+
+	// transmitters contains a Transmitter for each bridged guild
+	transmitters map[string]*transmitter.Transmitter
+
+	// lastTyping contains when each user last had their typing relayed
+	lastTyping   map[string]time.Time
+	lastTypingMu sync.Mutex
+
+	// online contains who is online in each guild, for the IRC "!discord" command
+	online *onlineUsers
+
+	// avatars caches GetAvatar lookups
+	avatars *avatarCache
+
+	// offlineTimers contains the pending offline updates for each user, see updateUser
+	offlineTimers   map[string]*time.Timer
+	offlineTimersMu sync.Mutex
+
+	// voice relays voice channel changes to IRC, if enabled
+	voice *voiceRelay
+
+	// reactions summarises reactions to IRC, if enabled
+	reactions *reactionSummaries
+
+	// conn tracks whether we are connected to Discord
+	conn discordConnection
+
+	// roleColors caches role lookups for IRCRoleColors
+	roleColors *roleColors
+
+	// dms relays direct messages to the bot, if DMRelayIRCChannel is set
+	dms *dmRelay
+
+	// members tracks whether every guild member has arrived since connecting
+	members *memberRequests
 
-	transmitter *transmitter.Transmitter
+	// missingMembers contains "guild user" for the members Discord says don't exist, see member
+	missingMembers *messageCache
 }
 
-func newDiscord(bridge *Bridge, botToken, guildID string) (*discordBot, error) {
+// typingThrottle is the minimum time between relaying typing for the same user
+var typingThrottle = time.Second * 10
+
+func newDiscord(bridge *Bridge, botToken string) (*discordBot, error) {
 
 	// Create a new Discord session using the provided bot token.
 	session, err := discordgo.New("Bot " + botToken)
@@ -32,60 +99,148 @@ func newDiscord(bridge *Bridge, botToken, guildID string) (*discordBot, error) {
 	}
 	session.StateEnabled = true
 
+	// Members, presences and message content are privileged, and must also be enabled for the bot
+	session.Identify.Intents = discordgo.IntentsAllWithoutPrivileged |
+		discordgo.IntentsGuildMembers |
+		discordgo.IntentsGuildPresences |
+		discordgo.IntentMessageContent
+
 	discord := &discordBot{
-		Session: session,
-		bridge:  bridge,
+		discordSession: session,
+		session:        session,
+		State:          session.State,
+		bridge:         bridge,
+
+		transmitters: make(map[string]*transmitter.Transmitter),
+		lastTyping:   make(map[string]time.Time),
+		online:       newOnlineUsers(),
+		avatars:      newAvatarCache(),
 
-		guildID: guildID,
+		offlineTimers: make(map[string]*time.Timer),
 	}
+	discord.voice = newVoiceRelay(discord)
+	discord.reactions = newReactionSummaries(discord)
+	discord.roleColors = newRoleColors()
+	discord.dms = newDMRelay(discord)
+	discord.members = newMemberRequests()
+	discord.missingMembers = newMessageCache(1024)
 
 	// These events are all fired in separate goroutines
 	discord.AddHandler(discord.OnReady)
+	discord.AddHandler(discord.onConnect)
+	discord.AddHandler(discord.onResumed)
+	discord.AddHandler(discord.onDisconnect)
 	discord.AddHandler(discord.onMessageCreate)
 	discord.AddHandler(discord.onMessageUpdate)
+	discord.AddHandler(discord.onGuildCreate)
+	discord.AddHandler(discord.onChannelUpdate)
+	discord.AddHandler(discord.onThreadCreate)
+	discord.AddHandler(discord.onInteractionCreate)
+	discord.AddHandler(discord.voice.OnVoiceStateUpdate)
+	discord.AddHandler(discord.reactions.OnMessageReactionAdd)
+	discord.AddHandler(discord.reactions.OnMessageReactionRemove)
+	discord.AddHandler(discord.reactions.OnMessageReactionRemoveAll)
+	discord.AddHandler(discord.roleColors.OnGuildCreate)
+	discord.AddHandler(discord.roleColors.OnGuildRoleUpdate)
+	discord.AddHandler(discord.roleColors.OnGuildRoleDelete)
+
+	// Presences are always tracked for the "!discord" command,
+	// but only create IRC connections when not in simple mode.
+	discord.AddHandler(discord.onMemberListChunk)
+	discord.AddHandler(discord.onMemberUpdate)
+	discord.AddHandler(discord.onMemberAdd)
+	discord.AddHandler(discord.onMemberRemove)
+	discord.AddHandler(discord.OnPresencesReplace)
+	discord.AddHandler(discord.OnPresenceUpdate)
 
 	if !bridge.Config.SimpleMode {
-		discord.AddHandler(discord.onMemberListChunk)
-		discord.AddHandler(discord.onMemberUpdate)
-		discord.AddHandler(discord.OnPresencesReplace)
-		discord.AddHandler(discord.OnPresenceUpdate)
 		discord.AddHandler(discord.OnTypingStart)
 		discord.AddHandler(discord.OnMessageReactionAdd)
 	}
 
+	if bridge.Config.RelayTyping {
+		discord.AddHandler(discord.onTypingRelay)
+	}
+
 	return discord, nil
 }
 
 func (d *discordBot) Open() error {
-	err := d.Session.Open()
+	err := d.session.Open()
 	if err != nil {
 		return errors.Wrap(err, "discord, could not open session")
 	}
 
-	d.transmitter, err = transmitter.New(d.Session, d.guildID, d.bridge.Config.WebhookPrefix, d.bridge.Config.WebhookLimit)
-	if err != nil {
-		return errors.Wrap(err, "could not create transmitter")
+	for _, guildID := range d.bridge.GuildIDs() {
+		t, err := transmitter.New(d.session, guildID, d.bridge.Config.WebhookPrefix, d.bridge.Config.WebhookLimit, d.bridge.Config.WebhooksPerChannel, transmitter.RateLimit{
+			Messages: d.bridge.Config.WebhookRateLimit,
+			Interval: d.bridge.Config.WebhookRateInterval,
+		}, d.bridge.Config.WebhookWaitForDelivery)
+		if err != nil {
+			return errors.Wrapf(err, "could not create transmitter for guild %s", guildID)
+		}
+		d.transmitters[guildID] = t
 	}
 
 	return nil
 }
 
 func (d *discordBot) Close() error {
+	d.closeConnection()
+
+	var result error
+	for _, t := range d.transmitters {
+		result = multierror.Append(result, t.Close())
+	}
+
 	return multierror.Append(
-		d.transmitter.Close(),
-		d.Session.Close(),
+		result,
+		d.session.Close(),
 	).ErrorOrNil()
 }
 
+// isOwnWebhook returns true if the given ID belongs to one of our webhooks.
+func (d *discordBot) isOwnWebhook(id string) bool {
+	for _, t := range d.transmitters {
+		if t.HasWebhook(id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *discordBot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	// Pins are announced by a system message without any content
+	if m.Type == discordgo.MessageTypeChannelPinnedMessage {
+		if d.bridge.Config.RelayPins {
+			d.publishPin(s, m.Message)
+		}
+		return
+	}
+
+	// Other system messages have no content of their own to relay
+	if !isUserMessage(m.Type) {
+		d.publishSystemMessage(m.Message)
+		return
+	}
+
 	d.publishMessage(s, m.Message, false)
 }
 
 func (d *discordBot) onMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	if !isUserMessage(m.Type) {
+		return
+	}
+
 	d.publishMessage(s, m.Message, true)
 }
 
 func (d *discordBot) OnMessageReactionAdd(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
+	// Each reaction is part of a summary instead
+	if d.bridge.Config.RelayReactionSummaries {
+		return
+	}
+
 	d.publishReaction(s, m.MessageReaction)
 }
 
@@ -102,46 +257,86 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 	}
 
 	// Ignore messages sent from our webhooks
-	if d.transmitter.GetID() == m.Author.ID {
+	if d.isOwnWebhook(m.Author.ID) {
 		return
 	}
 
-	// If the message is "ping" reply with "Pong!"
-	if m.Content == "ping" {
-		_, err := s.ChannelMessageSend(m.ChannelID, "Pong!")
-		if err != nil {
-			log.Warningln("Could not respond to Discord ping message", err.Error())
-		}
+	if d.bridge.isIgnoredDiscordUser(m.Author.ID) {
+		return
 	}
 
-	content := d.ParseText(m)
+	// Brand new accounts are often spammers
+	if d.isTooNew(m) {
+		return
+	}
 
-	// Special Mee6 behaviour
-	if m.Author.ID == "159985870458322944" {
-		content = strings.Replace(
-			content,
-			`CompSoc is the University of Edinburgh's society for anyone interested in tech.`,
-			"",
-			-1,
-		)
+	// Another bridge in the channel, as a bot or webhook, may be repeating what we sent
+	if (m.Author.Bot || m.WebhookID != "") && d.bridge.discordEchoes.IsEcho(m.ChannelID, m.Content) {
+		return
 	}
 
-	// The content is an action if it matches "_(.+)_"
-	isAction := len(content) > 2 &&
-		m.Content[0] == '_' &&
-		m.Content[len(content)-1] == '_'
+	if !d.bridge.discordFlood.Allow(m.Author.ID+" "+m.ChannelID, d.floodSummary(m)) {
+		return
+	}
 
-	// If it is an action, remove the enclosing underscores
-	if isAction {
-		content = content[1 : len(m.Content)-1]
+	// Direct messages to the bot go to the DM relay channel, if there is one
+	if m.GuildID == "" && d.dms.enabled() {
+		if !wasEdit {
+			d.dms.Publish(m)
+		}
+		return
 	}
 
-	if wasEdit {
-		if isAction {
-			content = "/me " + content
+	if mapping := d.bridge.GetMappingByDiscord(m.ChannelID); mapping != nil && !wasEdit {
+		// Commands are answered here and not relayed to IRC
+		req := commandRequest{
+			discordChannel: m.ChannelID,
+			ircChannel:     mapping.IRCChannel,
+			admin:          d.isAdmin(m.Member),
+		}
+		if d.bridge.runCommand(req, m.Content) {
+			return
+		}
+
+		// If the message is "ping" reply with "Pong!"
+		if d.bridge.Config.PingReply && m.Content == "ping" {
+			_, err := s.ChannelMessageSend(m.ChannelID, "Pong!")
+			if err != nil {
+				log.Warningln("Could not respond to Discord ping message", err.Error())
+			}
 		}
 
-		content = "[edit]: " + content
+		if d.bridge.Config.BotMentions != BotMentionsIgnore && mentionsUser(m, s.State.User.ID) {
+			if d.bridge.Config.BotMentions == BotMentionsRespond {
+				d.bridge.replyToCommand(req, fmt.Sprintf("This channel is bridged to %s on IRC. %s", mapping.IRCChannel, d.bridge.commandHelp(req.admin)))
+			}
+
+			// Don't tell IRC about a message that was only for us
+			if isOnlyMention(m.Content, s.State.User.ID) {
+				return
+			}
+		}
+	}
+
+	content := d.bridge.replaceContent(d.ParseText(m))
+
+	// Only look at the parsed content, as replacing emoji and mentions changes its length
+	content, isAction := parseAction(content)
+	plain := content
+
+	// This must happen after checking for actions, as "_text_" would be translated
+	if d.bridge.Config.DiscordFormatting {
+		content = ircf.MarkdownToIRC(content)
+	}
+
+	// The quote of the message being replied to goes on the first line sent to IRC
+	quote := ""
+	if m.Type == discordgo.MessageTypeReply && m.MessageReference != nil {
+		quote = d.replyQuote(s, m.MessageReference)
+	}
+	quoted := func(line string) string {
+		line, quote = quote+line, ""
+		return line
 	}
 
 	pmTarget := ""
@@ -158,21 +353,217 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 		}
 	}
 
-	d.bridge.discordMessageEventsChan <- &DiscordMessage{
-		Message:  m,
-		Content:  content,
-		IsAction: isAction,
-		PmTarget: pmTarget,
+	content = d.bridge.multilineContent(content, plain)
+
+	// Thread messages go to the IRC channel of the thread's parent
+	parentID, threadName := d.threadParent(m.ChannelID)
+	threadPrefix := ""
+	if parentID != "" && d.bridge.Config.ThreadNamePrefix {
+		threadPrefix = "[" + threadName + "] "
+	}
+
+	// Forum posts are threads, which start with a message with the same ID
+	if parentID != "" && m.ID == m.ChannelID && d.isForum(parentID) {
+		threadPrefix = "[new post: " + threadName + "] "
+	}
+
+	// Messages can be just stickers or attachments, which IRC doesn't need an empty line for
+	if strings.TrimSpace(content) != "" {
+		d.bridge.discordMessageEventsChan <- &DiscordMessage{
+			Message:         m,
+			Content:         threadPrefix + quoted(content),
+			IsAction:        isAction,
+			IsEdit:          wasEdit,
+			PmTarget:        pmTarget,
+			ParentChannelID: parentID,
+		}
+	}
+
+	// Attachments, embeds and stickers are only sent once, not on edits
+	if wasEdit {
+		return
+	}
+
+	for _, line := range d.bridge.embedLines(m.Embeds) {
+		d.bridge.discordMessageEventsChan <- &DiscordMessage{
+			Message:         m,
+			Content:         threadPrefix + quoted(line),
+			PmTarget:        pmTarget,
+			ParentChannelID: parentID,
+		}
+	}
+
+	for _, line := range d.bridge.stickerLines(m.StickerItems) {
+		d.bridge.discordMessageEventsChan <- &DiscordMessage{
+			Message:         m,
+			Content:         threadPrefix + quoted(line),
+			IsAction:        true,
+			PmTarget:        pmTarget,
+			ParentChannelID: parentID,
+		}
+	}
+
+	for _, line := range attachmentLines(m.Attachments, d.bridge.Config.AttachmentMode) {
+		d.bridge.discordMessageEventsChan <- &DiscordMessage{
+			Message:         m,
+			Content:         threadPrefix + quoted(line),
+			IsAction:        isAction,
+			PmTarget:        pmTarget,
+			ParentChannelID: parentID,
+		}
+	}
+}
+
+// floodSummary returns a function telling IRC how many of the user's messages were dropped,
+// or nil if FloodSummary is disabled.
+func (d *discordBot) floodSummary(m *discordgo.Message) func(int) {
+	if !d.bridge.Config.FloodSummary {
+		return nil
 	}
 
-	for _, attachment := range m.Attachments {
+	return func(dropped int) {
+		parentID, _ := d.threadParent(m.ChannelID)
 		d.bridge.discordMessageEventsChan <- &DiscordMessage{
-			Message:  m,
-			Content:  attachment.URL,
-			IsAction: isAction,
-			PmTarget: pmTarget,
+			Message:         m,
+			Content:         fmt.Sprintf("sent %d more messages", dropped),
+			IsAction:        true,
+			ParentChannelID: parentID,
+		}
+	}
+}
+
+// threadParent returns the parent channel and name of a thread,
+// or empty strings if the channel is not a thread.
+func (d *discordBot) threadParent(channelID string) (parentID, name string) {
+	channel, err := d.channel(channelID)
+	if err != nil || !channel.IsThread() {
+		return "", ""
+	}
+
+	return channel.ParentID, channel.Name
+}
+
+// channel returns the channel from the state, or fetches it if it's not there,
+// e.g forum posts and threads that were archived when we connected.
+func (d *discordBot) channel(channelID string) (*discordgo.Channel, error) {
+	if channel, err := d.State.Channel(channelID); err == nil {
+		return channel, nil
+	}
+
+	channel, err := d.Channel(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only channels in our guilds can be cached
+	if channel.GuildID != "" {
+		if err := d.State.ChannelAdd(channel); err != nil {
+			log.WithField("error", err).Debugln("could not cache fetched channel")
+		}
+	}
+	return channel, nil
+}
+
+// isForum returns true if the channel is a forum, where every post is a thread.
+// Media channels work the same way.
+func (d *discordBot) isForum(channelID string) bool {
+	channel, err := d.State.Channel(channelID)
+	if err != nil {
+		return false
+	}
+
+	return channel.Type == discordgo.ChannelTypeGuildForum || channel.Type == discordgo.ChannelTypeGuildMedia
+}
+
+// markdownEscaper stops IRC nicks like "_foo_" being formatted by Discord
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "~", "\\~", "`", "\\`", "|", "\\|")
+
+// sendIRCUsers tells the Discord channel who is in the IRC channel.
+func (d *discordBot) sendIRCUsers(discordChannel, ircChannel string) {
+	nicks := d.bridge.ircListener.joinParts.Nicks(ircChannel)
+
+	msg := fmt.Sprintf("**%d** users in %s", len(nicks), ircChannel)
+	if len(nicks) > 0 {
+		msg += ": "
+	}
+
+	for i, nick := range nicks {
+		nick = markdownEscaper.Replace(nick)
+
+		// Discord messages can be at most 2000 characters
+		more := fmt.Sprintf(" and %d more", len(nicks)-i)
+		if len(msg)+len(nick)+2+len(more) > 2000 {
+			msg += more
+			break
+		}
+
+		if i > 0 {
+			msg += ", "
 		}
+		msg += nick
 	}
+
+	if _, err := d.ChannelMessageSend(discordChannel, msg); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"channel": discordChannel,
+		}).Errorln("could not send irc user list to discord")
+	}
+}
+
+// replyQuote returns a short quote of the message being replied to,
+// e.g "<@alice: original snippet> ".
+//
+// Returns empty string if the referenced message could not be fetched (i.e. deleted).
+func (d *discordBot) replyQuote(s *discordgo.Session, ref *discordgo.MessageReference) string {
+	original, err := s.ChannelMessage(ref.ChannelID, ref.MessageID)
+	if err != nil || original.Author == nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"message-id": ref.MessageID,
+		}).Debugln("could not fetch message referenced by reply")
+		return ""
+	}
+
+	// Messages fetched over REST don't include the guild
+	original.GuildID = ref.GuildID
+
+	snippet := strings.Join(strings.Fields(d.ParseText(original)), " ")
+	return fmt.Sprintf("<@%s: %s> ", original.Author.Username, TruncateString(d.bridge.Config.ReplyQuoteLength, snippet))
+}
+
+// publishPin tells IRC that a message was pinned, e.g "alice pinned a message: <bob> hello".
+func (d *discordBot) publishPin(s *discordgo.Session, m *discordgo.Message) {
+	if m.Author == nil || m.MessageReference == nil || d.bridge.isIgnoredDiscordUser(m.Author.ID) {
+		return
+	}
+
+	channelID := m.ChannelID
+	if parentID, _ := d.threadParent(channelID); parentID != "" {
+		channelID = parentID
+	}
+
+	mapping := d.bridge.GetMappingByDiscord(channelID)
+	if mapping == nil || !mapping.ToIRC() {
+		return
+	}
+
+	ref := m.MessageReference
+	original, err := s.ChannelMessage(ref.ChannelID, ref.MessageID)
+	if err != nil || original.Author == nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"message-id": ref.MessageID,
+		}).Debugln("could not fetch pinned message")
+		return
+	}
+
+	// Messages fetched over REST don't include the guild
+	original.GuildID = m.GuildID
+
+	snippet := strings.Join(strings.Fields(d.ParseText(original)), " ")
+	notice := fmt.Sprintf("%s pinned a message: <%s> %s", d.authorNick(m), original.Author.Username, TruncateString(d.bridge.Config.ReplyQuoteLength, snippet))
+	d.bridge.ircListener.Notice(mapping.IRCChannel, notice)
 }
 
 func (d *discordBot) publishReaction(s *discordgo.Session, r *discordgo.MessageReaction) {
@@ -219,6 +610,22 @@ func (d *discordBot) publishReaction(s *discordgo.Session, r *discordgo.MessageR
 	}
 }
 
+// mentionsUser returns true if the message mentions the user.
+func mentionsUser(m *discordgo.Message, userID string) bool {
+	for _, user := range m.Mentions {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// isOnlyMention returns true if the content is nothing but a mention of the user.
+func isOnlyMention(content, userID string) bool {
+	content = strings.TrimSpace(content)
+	return content == "<@"+userID+">" || content == "<@!"+userID+">"
+}
+
 // Up to date as of https://git.io/v5kJg
 var channelMention = regexp.MustCompile(`<#(\d+)>`)
 var roleMention = regexp.MustCompile(`<@&(\d+)>`)
@@ -226,12 +633,23 @@ var roleMention = regexp.MustCompile(`<@&(\d+)>`)
 var patternChannels = regexp.MustCompile("<#[^>]*>")
 var emoteRegex = regexp.MustCompile(`<a?(:\w+:)\d+>`)
 
+// spoilerRegex matches spoilers, e.g ||text||. Unpaired markers are left alone.
+var spoilerRegex = regexp.MustCompile(`(?s)\|\|(.+?)\|\|`)
+
 // Up to date as of https://git.io/v5kJg
 func (d *discordBot) ParseText(m *discordgo.Message) string {
 	// Replace @user mentions with name~d mentions
 	content := m.Content
 
 	for _, user := range m.Mentions {
+		if d.bridge.Config.BotMentions == BotMentionsStrip && d.State.User != nil && user.ID == d.State.User.ID {
+			content = strings.TrimSpace(strings.NewReplacer(
+				"<@"+user.ID+">", "",
+				"<@!"+user.ID+">", "",
+			).Replace(content))
+			continue
+		}
+
 		// Find the irc username with the discord ID in irc connections
 		username := ""
 		for _, u := range d.bridge.ircManager.ircConnections {
@@ -245,7 +663,7 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 			nick := user.Username
 
 			// If we can get their member + nick, set nick to the real nick
-			member, err := d.State.Member(d.guildID, user.ID)
+			member, err := d.member(m.GuildID, user.ID)
 			if err == nil && member.Nick != "" {
 				nick = member.Nick
 			}
@@ -279,18 +697,8 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 	}
 
 	// Copied from message.go ContentWithMoreMentionsReplaced(s)
-	for _, roleID := range m.MentionRoles {
-		role, err := d.State.Role(d.guildID, roleID)
-		if err != nil || !role.Mentionable {
-			continue
-		}
-
-		content = strings.Replace(content, "<&"+role.ID+">", "@"+role.Name, -1)
-	}
-
-	// Also copied from message.go ContentWithMoreMentionsReplaced(s)
 	content = patternChannels.ReplaceAllStringFunc(content, func(mention string) string {
-		channel, err := d.State.Channel(mention[2 : len(mention)-1])
+		channel, err := d.channel(mention[2 : len(mention)-1])
 		if err != nil || channel.Type == discordgo.ChannelTypeGuildVoice {
 			return mention
 		}
@@ -307,75 +715,133 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 		// Strip enclosing identifiers
 		channelID := str[2 : len(str)-1]
 
-		channel, err := d.State.Channel(channelID)
+		channel, err := d.channel(channelID)
 		if err == nil {
 			return "#" + channel.Name
-		} else if err == discordgo.ErrStateNotFound {
+		} else if isNotFound(err) {
 			return "#deleted-channel"
 		}
 
-		panic(errors.Wrap(err, "Channel mention failed for "+str))
+		// Leave the mention as it is, rather than taking down the bridge
+		log.WithField("error", errors.Wrap(err, "channel mention failed for "+str)).Errorln("could not convert channel mention")
+		return str
 	})
 
-	// Replace <@&xxxxx> role mentions
+	// Replace <@&xxxxx> role mentions, using the roles of the guild the message was sent in.
+	// The role may have been deleted, or belong to another guild.
 	content = roleMention.ReplaceAllStringFunc(content, func(str string) string {
 		// Strip enclosing identifiers
 		roleID := str[3 : len(str)-1]
 
-		role, err := d.State.Role(d.bridge.Config.GuildID, roleID)
+		role, err := d.State.Role(m.GuildID, roleID)
 		if err == nil {
 			return "@" + role.Name
-		} else if err == discordgo.ErrStateNotFound {
-			return "@deleted-role"
+		} else if err != discordgo.ErrStateNotFound {
+			log.WithField("error", errors.Wrap(err, "role mention failed for "+str)).Errorln("could not convert role mention")
 		}
-
-		panic(errors.Wrap(err, "Channel mention failed for "+str))
+		return "@unknown-role"
 	})
 
-	// Replace emotes
+	// Replace custom emoji, e.g <:name:123456> and <a:name:123456> (animated), with :name:
 	content = emoteRegex.ReplaceAllString(content, "$1")
 
+	if d.bridge.Config.SpoilerMode == SpoilerModeRedact {
+		content = spoilerRegex.ReplaceAllString(content, "[spoiler]")
+	}
+
 	return content
 }
 
 func (d *discordBot) onMemberListChunk(s *discordgo.Session, m *discordgo.GuildMembersChunk) {
-	for _, m := range m.Members {
-		d.handleMemberUpdate(m, false)
+	for _, member := range m.Members {
+		member.GuildID = m.GuildID
+		d.handleMemberUpdate(member, false)
+	}
+
+	if d.memberChunkReceived(m) {
+		log.WithFields(log.Fields{
+			"guild":  m.GuildID,
+			"chunks": m.ChunkCount,
+		}).Infoln("Loaded guild members")
 	}
 }
 
 func (d *discordBot) onMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	// Someone else may be the only one called their old name now
+	if m.BeforeUpdate != nil {
+		d.forgetAvatars(m.BeforeUpdate)
+	}
 	d.handleMemberUpdate(m.Member, false)
 }
 
+func (d *discordBot) onMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	d.forgetAvatars(m.Member)
+}
+
+func (d *discordBot) onGuildCreate(s *discordgo.Session, g *discordgo.GuildCreate) {
+	d.bridge.ircListener.topics.OnDiscordChannels(g.Channels)
+}
+
+func (d *discordBot) onChannelUpdate(s *discordgo.Session, c *discordgo.ChannelUpdate) {
+	d.bridge.ircListener.topics.OnDiscordChannelUpdate(c.Channel)
+}
+
+// onThreadCreate tells IRC that a thread was started, if Config.RelayThreadCreation is set.
+func (d *discordBot) onThreadCreate(s *discordgo.Session, t *discordgo.ThreadCreate) {
+	// We are also told about existing threads we've been added to
+	if !d.bridge.Config.RelayThreadCreation || !t.NewlyCreated || t.Type == discordgo.ChannelTypeGuildPrivateThread {
+		return
+	}
+
+	// Forum posts are announced by their first message instead
+	mapping := d.bridge.GetMappingByDiscord(t.ParentID)
+	if mapping == nil || !mapping.ToIRC() || d.isForum(t.ParentID) || d.bridge.isIgnoredDiscordUser(t.OwnerID) {
+		return
+	}
+
+	nick := t.OwnerID
+	if member, err := d.member(t.GuildID, t.OwnerID); err == nil && member.User != nil {
+		nick = GetMemberNick(member)
+	}
+
+	d.bridge.ircListener.Notice(mapping.IRCChannel, fmt.Sprintf("%s started a thread: %s", nick, t.Name))
+}
+
+func (d *discordBot) onMemberRemove(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	d.forgetAvatars(m.Member)
+	d.online.Remove(m.GuildID, m.User.ID)
+}
+
 // What does this do? Probably what it sounds like.
 func (d *discordBot) OnPresencesReplace(s *discordgo.Session, m *discordgo.PresencesReplace) {
+	// This event has no guild, so presumably it's for the primary guild.
 	for _, p := range *m {
-		d.handlePresenceUpdate(p.User.ID, p.Status, false)
+		d.handlePresenceUpdate(d.bridge.Config.GuildID, p.User.ID, p.Status, false)
 	}
 }
 
 // Handle when presence is updated
 func (d *discordBot) OnPresenceUpdate(s *discordgo.Session, m *discordgo.PresenceUpdate) {
-	d.handlePresenceUpdate(m.Presence.User.ID, m.Presence.Status, false)
+	d.handlePresenceUpdate(m.GuildID, m.Presence.User.ID, m.Presence.Status, false)
 }
 
-func (d *discordBot) handlePresenceUpdate(uid string, status discordgo.Status, forceOnline bool) {
+func (d *discordBot) handlePresenceUpdate(guildID, uid string, status discordgo.Status, forceOnline bool) {
 	// If they are offline, just deliver a mostly empty struct with the ID and online state
 	if !forceOnline && (status == discordgo.StatusOffline) {
 		log.WithField("id", uid).Debugln("PRESENCE offline")
-		d.bridge.updateUserChan <- DiscordUser{
+		d.online.Remove(guildID, uid)
+		d.updateUser(DiscordUser{
 			ID:     uid,
 			Online: false,
-		}
+		})
 		return
 	}
 	log.WithField("id", uid).Debugln("PRESENCE " + status)
 
 	// Otherwise get their GuildMember object...
-	user, err := d.State.Member(d.guildID, uid)
+	user, err := d.member(guildID, uid)
 	if err != nil {
-		log.Println(errors.Wrap(err, "get member from state in handlePresenceUpdate failed"))
+		log.Println(errors.Wrap(err, "get member in handlePresenceUpdate failed"))
 		return
 	}
 
@@ -384,9 +850,14 @@ func (d *discordBot) handlePresenceUpdate(uid string, status discordgo.Status, f
 }
 
 func (d *discordBot) OnTypingStart(s *discordgo.Session, m *discordgo.TypingStart) {
+	// Ignore typing in private channels
+	if m.GuildID == "" {
+		return
+	}
+
 	status := discordgo.StatusOffline
 
-	p, err := d.State.Presence(d.guildID, m.UserID)
+	p, err := d.State.Presence(m.GuildID, m.UserID)
 	if err != nil {
 		log.Println(errors.Wrap(err, "get presence from in OnTypingStart failed"))
 		// return
@@ -395,22 +866,64 @@ func (d *discordBot) OnTypingStart(s *discordgo.Session, m *discordgo.TypingStar
 	}
 
 	// .. and handle as per usual
-	d.handlePresenceUpdate(m.UserID, status, true)
+	d.handlePresenceUpdate(m.GuildID, m.UserID, status, true)
 }
 
-func (d *discordBot) OnReady(s *discordgo.Session, m *discordgo.Ready) {
-	err := d.RequestGuildMembers(d.guildID, "", 0)
+// onTypingRelay tells IRC that someone is typing, at most once every typingThrottle
+func (d *discordBot) onTypingRelay(s *discordgo.Session, m *discordgo.TypingStart) {
+	// Ignore typing in private channels, and our own typing
+	if m.GuildID == "" || s.State.User == nil || m.UserID == s.State.User.ID {
+		return
+	}
+
+	d.lastTypingMu.Lock()
+	if time.Since(d.lastTyping[m.UserID]) < typingThrottle {
+		d.lastTypingMu.Unlock()
+		return
+	}
+	d.lastTyping[m.UserID] = time.Now()
+	d.lastTypingMu.Unlock()
+
+	member, err := d.State.Member(m.GuildID, m.UserID)
 	if err != nil {
-		log.Warningln(errors.Wrap(err, "could not request guild members").Error())
+		log.Println(errors.Wrap(err, "get member from state in onTypingRelay failed"))
 		return
 	}
+
+	// Bridge needs these for mapping
+	msg := &discordgo.Message{
+		ChannelID: m.ChannelID,
+		Author:    member.User,
+		GuildID:   m.GuildID,
+	}
+
+	d.bridge.discordMessageEventsChan <- &DiscordMessage{
+		Message:  msg,
+		Content:  "is typing…",
+		IsAction: true,
+	}
+}
+
+func (d *discordBot) OnReady(s *discordgo.Session, m *discordgo.Ready) {
+	// The state has been replaced, so anything we found before may be stale
+	d.ClearAvatarCache()
+
+	for _, guildID := range d.bridge.GuildIDs() {
+		d.requestMembers(guildID)
+	}
+
+	d.registerCommands()
+	d.updatePresence()
 }
 
 func (d *discordBot) handleMemberUpdate(m *discordgo.Member, forceOnline bool) {
+	// Their nick or avatar may have changed
+	d.forgetAvatars(m)
+
 	status := discordgo.StatusOnline
 
 	if !forceOnline {
-		presence, err := d.State.Presence(d.guildID, m.User.ID)
+		presence, err := d.State.Presence(m.GuildID, m.User.ID)
 		if err != nil {
 			// This error is usually triggered on first run because it represents offline
 			if err != discordgo.ErrStateNotFound {
@@ -420,35 +933,107 @@ func (d *discordBot) handleMemberUpdate(m *discordgo.Member, forceOnline bool) {
 		}
 
 		if presence.Status == discordgo.StatusOffline {
+			d.online.Remove(m.GuildID, m.User.ID)
 			return
 		}
 
 		status = presence.Status
 	}
 
-	d.bridge.updateUserChan <- DiscordUser{
+	if d.State.User == nil || m.User.ID != d.State.User.ID {
+		d.online.Set(m.GuildID, m.User.ID, GetMemberNick(m))
+	}
+
+	d.updateUser(DiscordUser{
 		ID:            m.User.ID,
 		Username:      m.User.Username,
 		Discriminator: m.User.Discriminator,
 		Nick:          GetMemberNick(m),
 		Bot:           m.User.Bot,
 		Online:        status != discordgo.StatusOffline,
+	})
+}
+
+// updateUser tells the IRC manager about the user, unless in simple mode.
+//
+// Users going offline are only passed on after PresenceDebounce,
+// so that flickering presences don't spam IRC.
+func (d *discordBot) updateUser(user DiscordUser) {
+	if d.bridge.Config.SimpleMode {
+		return
+	}
+
+	d.offlineTimersMu.Lock()
+	timer, pending := d.offlineTimers[user.ID]
+	if pending {
+		timer.Stop()
+		delete(d.offlineTimers, user.ID)
+	}
+
+	if !user.Online {
+		d.offlineTimers[user.ID] = time.AfterFunc(d.bridge.Config.PresenceDebounce, func() {
+			d.offlineTimersMu.Lock()
+			delete(d.offlineTimers, user.ID)
+			d.offlineTimersMu.Unlock()
+
+			d.bridge.updateUserChan <- user
+		})
+	}
+	d.offlineTimersMu.Unlock()
+
+	if user.Online {
+		d.bridge.updateUserChan <- user
 	}
 }
 
+// GetAvatar returns the avatar URL of the guild member called username,
+// or an empty string if there isn't exactly one. Results are cached.
+func (d *discordBot) GetAvatar(guildID, username string) string {
+	if avatar, ok := d.avatars.Get(guildID, username); ok {
+		return avatar
+	}
+
+	avatar, ok := d.findAvatar(guildID, username)
+	if ok {
+		d.avatars.Set(guildID, username, avatar)
+	}
+	return avatar
+}
+
+// forgetAvatars forgets the avatars found by GetAvatar that the member could change.
+func (d *discordBot) forgetAvatars(m *discordgo.Member) {
+	if m.User == nil {
+		return
+	}
+	d.avatars.Forget(m.GuildID, m.User.ID, m.Nick, m.User.Username)
+}
+
+// ClearAvatarCache forgets every avatar found by GetAvatar.
+func (d *discordBot) ClearAvatarCache() {
+	d.avatars.ClearAll()
+}
+
+// findAvatar looks through the guild for the avatar of username.
+// ok is false if the guild could not be searched, or some of its members may be
+// missing, and the result should not be cached.
+//
 // See https://github.com/reactiflux/discord-irc/pull/230/files#diff-7202bb7fb017faefd425a2af32df2f9dR357
-func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
+func (d *discordBot) findAvatar(guildID, username string) (avatar string, ok bool) {
 	// First get all members
-	guild, err := d.State.Guild(guildID)
+	members, complete, err := d.membersNamed(guildID, username)
 	if err != nil {
-		panic(err)
+		log.WithFields(log.Fields{
+			"error":    err,
+			"guild-id": guildID,
+		}).Errorln("could not get guild members for avatar lookup")
+		return "", false
 	}
 
 	// Matching members
 	var foundMember *discordgo.Member
 
 	// First check an exact match, aborting on multiple
-	for _, member := range guild.Members {
+	for _, member := range members {
 		if (username != member.Nick) && (username != member.User.Username) {
 			continue
 		}
@@ -456,13 +1041,13 @@ func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
 		if foundMember == nil {
 			foundMember = member
 		} else {
-			return
+			return "", true
 		}
 	}
 
 	// If no member found, check case-insensitively
 	if foundMember == nil {
-		for _, member := range guild.Members {
+		for _, member := range members {
 			if !strings.EqualFold(username, member.Nick) && !strings.EqualFold(username, member.User.Username) {
 				continue
 			}
@@ -470,7 +1055,7 @@ func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
 			if foundMember == nil {
 				foundMember = member
 			} else {
-				return
+				return "", complete
 			}
 		}
 	}
@@ -479,19 +1064,60 @@ func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
 	// - no matching user OR
 	// - multiple matching users
 	if foundMember == nil {
-		return
+		return "", complete
 	}
 
-	return discordgo.EndpointUserAvatar(foundMember.User.ID, foundMember.User.Avatar)
+	return discordgo.EndpointUserAvatar(foundMember.User.ID, foundMember.User.Avatar), complete
 }
 
-// GetMemberNick returns the real display name for a Discord GuildMember
+// authorNick returns what the author of the message is called in its guild, see GetMemberNick.
+func (d *discordBot) authorNick(m *discordgo.Message) string {
+	if member, err := d.State.Member(m.GuildID, m.Author.ID); err == nil && member.User != nil {
+		return GetMemberNick(member)
+	}
+
+	// Messages include a partial member, without the user
+	if m.Member != nil {
+		member := *m.Member
+		member.User = m.Author
+		return GetMemberNick(&member)
+	}
+
+	return GetMemberNick(&discordgo.Member{User: m.Author})
+}
+
+// GetMemberNick returns the real display name for a Discord GuildMember:
+// their server nick, display name or username, whichever is set first.
 func GetMemberNick(m *discordgo.Member) string {
-	if m.Nick == "" {
-		return m.User.Username
+	if m.Nick != "" {
+		return m.Nick
+	}
+
+	if m.User.GlobalName != "" {
+		return m.User.GlobalName
+	}
+
+	return m.User.Username
+}
+
+// parseAction checks if the content is an action, i.e it matches "_(.+)_",
+// and returns the content without the enclosing underscores if so.
+//
+// "__text__" is underlined text, not an action.
+func parseAction(content string) (string, bool) {
+	if utf8.RuneCountInString(content) <= 2 {
+		return content, false
+	}
+
+	if !strings.HasPrefix(content, "_") || !strings.HasSuffix(content, "_") {
+		return content, false
+	}
+
+	if strings.HasPrefix(content, "__") && strings.HasSuffix(content, "__") {
+		return content, false
 	}
 
-	return m.Nick
+	return strings.TrimSuffix(strings.TrimPrefix(content, "_"), "_"), true
 }
 
 // pmTargetFromContent returns an irc nick given a message sent to an IRC user via Discord
@@ -0,0 +1,56 @@
+package bridge
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// isTooNew returns true if the message's author is newer than Config.MinDiscordAccountAge
+// allows, or joined its guild more recently than Config.MinDiscordMemberAge allows,
+// in which case their message shouldn't be bridged.
+func (d *discordBot) isTooNew(m *discordgo.Message) bool {
+	conf := d.bridge.Config
+
+	if conf.MinDiscordAccountAge > 0 {
+		created, err := discordgo.SnowflakeTimestamp(m.Author.ID)
+		if err == nil && time.Since(created) < conf.MinDiscordAccountAge {
+			d.logTooNew(m, "account", created)
+			return true
+		}
+	}
+
+	// Direct messages have no guild to have joined
+	if conf.MinDiscordMemberAge > 0 && m.GuildID != "" {
+		joined := time.Time{}
+		if m.Member != nil {
+			joined = m.Member.JoinedAt
+		}
+
+		// Messages usually include when they joined, but edits may not
+		if joined.IsZero() {
+			member, err := d.member(m.GuildID, m.Author.ID)
+			if err != nil {
+				log.WithField("error", err).Debugln("could not get member to check when they joined")
+				return false
+			}
+			joined = member.JoinedAt
+		}
+
+		if !joined.IsZero() && time.Since(joined) < conf.MinDiscordMemberAge {
+			d.logTooNew(m, "member", joined)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *discordBot) logTooNew(m *discordgo.Message, what string, since time.Time) {
+	log.WithFields(log.Fields{
+		"author":  m.Author.ID,
+		"channel": m.ChannelID,
+		"age":     time.Since(since).Round(time.Second),
+	}).Infof("Not bridging message from a Discord %s that is too new", what)
+}
@@ -0,0 +1,305 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// bridgeCommand is the slash command admins can use to manage the bridge
+var bridgeCommand = &discordgo.ApplicationCommand{
+	Name:        "bridge",
+	Description: "Manage the IRC bridge",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "status",
+			Description: "Show whether the bridge is connected",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "connections",
+			Description: "List the IRC connections made for Discord users",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "reload",
+			Description: "Reload the bridge's config file",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "announce",
+			Description: "Send a message to every bridged channel, on Discord and IRC",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "message",
+				Description: "The message to announce",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "ignore",
+			Description: "Stop bridging a user's messages to IRC",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "The user to ignore",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "unignore",
+			Description: "Start bridging an ignored user's messages to IRC again",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "The user to stop ignoring",
+				Required:    true,
+			}},
+		},
+	},
+}
+
+// linkCommand and unlinkCommand let anyone link their IRC account, see Config.LinksPath
+var linkCommand = &discordgo.ApplicationCommand{
+	Name:        "link",
+	Description: "Get a code to link your IRC account to your Discord account",
+}
+
+var unlinkCommand = &discordgo.ApplicationCommand{
+	Name:        "unlink",
+	Description: "Unlink your IRC account from your Discord account",
+}
+
+// registerCommands creates the slash commands in every bridged guild: /bridge if
+// there are admin roles to restrict it to, and /link and /unlink if linking is enabled.
+func (d *discordBot) registerCommands() {
+	commands := []*discordgo.ApplicationCommand{}
+	if len(d.bridge.Config.AdminRoleIDs) > 0 {
+		commands = append(commands, bridgeCommand)
+	}
+	if d.bridge.links.Enabled() {
+		commands = append(commands, linkCommand, unlinkCommand)
+	}
+
+	for _, guildID := range d.bridge.GuildIDs() {
+		for _, command := range commands {
+			if _, err := d.ApplicationCommandCreate(d.State.User.ID, guildID, command); err != nil {
+				log.Warningln(errors.Wrapf(err, "could not register slash commands for %s", guildID).Error())
+			}
+		}
+	}
+}
+
+// isAdmin returns true if the member has one of the admin roles.
+func (d *discordBot) isAdmin(member *discordgo.Member) bool {
+	if member == nil {
+		return false
+	}
+
+	for _, role := range member.Roles {
+		for _, admin := range d.bridge.Config.AdminRoleIDs {
+			if role == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *discordBot) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	// Members are only given for commands used in a guild
+	var reply string
+	data := i.ApplicationCommandData()
+	switch {
+	case data.Name == bridgeCommand.Name && len(data.Options) > 0:
+		if !d.isAdmin(i.Member) {
+			reply = "You are not allowed to manage the bridge."
+		} else {
+			reply = d.runBridgeCommand(data.Options[0])
+		}
+
+	case data.Name == linkCommand.Name && i.Member != nil && i.Member.User != nil:
+		reply = d.runLinkCommand(i.Member.User.ID)
+
+	case data.Name == unlinkCommand.Name && i.Member != nil && i.Member.User != nil:
+		if d.bridge.links.UnlinkDiscord(i.Member.User.ID) {
+			reply = "Your IRC account is no longer linked."
+		} else {
+			reply = "You don't have a linked IRC account."
+		}
+
+	default:
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: reply,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.WithField("error", err).Errorln("could not respond to slash command")
+	}
+}
+
+// runBridgeCommand runs a /bridge subcommand and returns the reply.
+func (d *discordBot) runBridgeCommand(sub *discordgo.ApplicationCommandInteractionDataOption) string {
+	switch sub.Name {
+	case "status":
+		return formatStatus(d.bridge.status())
+
+	case "connections":
+		return formatConnections(d.bridge.ListConnections())
+
+	case "reload":
+		if d.bridge.reload == nil {
+			return "This bridge can't be reloaded."
+		}
+
+		if err := d.bridge.reload(); err != nil {
+			return "The config was not reloaded: " + err.Error()
+		}
+		return "The config has been reloaded."
+
+	case "announce":
+		d.bridge.announce(sub.Options[0].StringValue())
+		return "The announcement has been sent."
+
+	case "ignore":
+		user := sub.Options[0].UserValue(nil)
+		if d.bridge.isIgnoredDiscordUser(user.ID) {
+			return fmt.Sprintf("<@%s> is already ignored.", user.ID)
+		}
+
+		d.bridge.ignores.Set(user.ID, true)
+		return fmt.Sprintf("<@%s> is now ignored, until the config is reloaded.", user.ID)
+
+	case "unignore":
+		user := sub.Options[0].UserValue(nil)
+		if !d.bridge.isIgnoredDiscordUser(user.ID) {
+			return fmt.Sprintf("<@%s> is not ignored.", user.ID)
+		}
+
+		d.bridge.ignores.Set(user.ID, false)
+		return fmt.Sprintf("<@%s> is no longer ignored, until the config is reloaded.", user.ID)
+	}
+
+	return "Unknown command."
+}
+
+// runLinkCommand gives the user a code to link their IRC account with, and returns the reply.
+func (d *discordBot) runLinkCommand(userID string) string {
+	if !d.bridge.links.Enabled() {
+		return "Linking accounts is not enabled on this bridge."
+	}
+
+	code, err := d.bridge.links.NewCode(userID)
+	if err != nil {
+		log.WithField("error", err).Errorln("could not create link code")
+		return "Something went wrong, please try again."
+	}
+
+	return fmt.Sprintf("Whilst identified with NickServ, send `/msg %s link %s` on IRC within %d minutes. Don't send the code anywhere else, or someone else could link their account to yours.",
+		d.bridge.ircListener.GetNick(), code, int(linkCodeTTL.Minutes()))
+}
+
+// formatStatus describes the status of the bridge for Discord.
+func formatStatus(status bridgeStatus) string {
+	connected := func(ok bool) string {
+		if ok {
+			return "connected"
+		}
+		return "**disconnected**"
+	}
+
+	ago := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return time.Since(*t).Round(time.Second).String() + " ago"
+	}
+
+	discord := connected(status.DiscordConnected)
+	if status.DiscordDisconnectedAt != nil {
+		discord += " for " + time.Since(*status.DiscordDisconnectedAt).Round(time.Second).String()
+	}
+
+	connections := fmt.Sprintf("IRC connections: %d", status.IRCConnections)
+	if status.PuppetLimitHits > 0 {
+		connections += fmt.Sprintf(" (limit reached %d times)", status.PuppetLimitHits)
+	}
+
+	members := "loaded"
+	if !status.DiscordMembersLoaded {
+		members = fmt.Sprintf("**loading** (%d guilds)", len(status.DiscordMembersLoading))
+	}
+
+	lines := []string{
+		"Discord: " + discord,
+		"Discord members: " + members,
+		"IRC listener: " + connected(status.IRCListenerConnected),
+		connections,
+		"Last message to Discord: " + ago(status.LastMessageToDiscord),
+		"Last message to IRC: " + ago(status.LastMessageToIRC),
+	}
+
+	for _, f := range status.DeliveryFailures {
+		reason := ""
+		if f.Permission {
+			reason = ", missing permission"
+		}
+		lines = append(lines, fmt.Sprintf("**Not delivering to <#%s>**: %d failed in a row%s", f.DiscordChannel, f.Consecutive, reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatConnections lists the IRC connections for Discord, one per line.
+func formatConnections(connections []ConnectionInfo) string {
+	if len(connections) == 0 {
+		return "There are no IRC connections."
+	}
+
+	msg := fmt.Sprintf("%d IRC connections:", len(connections))
+	for i, con := range connections {
+		state := "connected"
+		if !con.Connected {
+			state = "**disconnected**"
+		}
+
+		active := "never active"
+		if con.LastActivity != nil {
+			active = "active " + time.Since(*con.LastActivity).Round(time.Second).String() + " ago"
+		}
+
+		channels := "no channels"
+		if len(con.Channels) > 0 {
+			channels = strings.Join(con.Channels, " ")
+		}
+
+		line := fmt.Sprintf("\n`%s` <@%s>: %s, %s, %d sent, %d reconnects, in %s", con.Nick, con.DiscordID, state, active, con.MessagesSent, con.Reconnects, channels)
+		if con.LastError != "" {
+			line += ", last error: " + con.LastError
+		}
+
+		// Discord messages can be at most 2000 characters
+		more := fmt.Sprintf("\n(%d more)", len(connections)-i)
+		if len(msg)+len(line)+len(more) > 2000 {
+			return msg + more
+		}
+		msg += line
+	}
+	return msg
+}
@@ -0,0 +1,78 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// bridgeUserCommand returns the /bridge subcommand with the given name, given a user.
+func bridgeUserCommand(name, userID string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{
+		Name: name,
+		Type: discordgo.ApplicationCommandOptionSubCommand,
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: "user", Type: discordgo.ApplicationCommandOptionUser, Value: userID},
+		},
+	}
+}
+
+func TestIgnoreCommands(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.IgnoredDiscordIDs = []string{"500000000000000002"}
+	})
+	d := tb.Bridge.discord
+
+	d.runBridgeCommand(bridgeUserCommand("ignore", "500000000000000001"))
+	d.runBridgeCommand(bridgeUserCommand("unignore", "500000000000000002"))
+
+	if !tb.isIgnoredDiscordUser("500000000000000001") {
+		t.Error("the user ignored with /bridge ignore is not ignored")
+	}
+	if tb.isIgnoredDiscordUser("500000000000000002") {
+		t.Error("the user unignored with /bridge unignore is still ignored")
+	}
+	if ids := tb.Config.IgnoredDiscordIDs; len(ids) != 1 || ids[0] != "500000000000000002" {
+		t.Errorf("IgnoredDiscordIDs = %q, want it left as it was", ids)
+	}
+
+	// Reloading goes back to the config
+	conf := reloadConfig(tb, testChannelID)
+	conf.IgnoredDiscordIDs = []string{"500000000000000002"}
+	if err := tb.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if tb.isIgnoredDiscordUser("500000000000000001") {
+		t.Error("the user ignored with /bridge ignore is still ignored after reloading")
+	}
+	if !tb.isIgnoredDiscordUser("500000000000000002") {
+		t.Error("the user in IgnoredDiscordIDs is not ignored after reloading")
+	}
+}
+
+func TestAnnounceCommand(t *testing.T) {
+	tb := newTestBridge(t, nil)
+
+	tb.Bridge.discord.runBridgeCommand(&discordgo.ApplicationCommandInteractionDataOption{
+		Name: "announce",
+		Type: discordgo.ApplicationCommandOptionSubCommand,
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: "message", Type: discordgo.ApplicationCommandOptionString, Value: "maintenance at 5"},
+		},
+	})
+
+	if got, want := tb.irc.next(t), "NOTICE #irc :[Announcement] maintenance at 5"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+
+	select {
+	case got := <-tb.discord.sent:
+		if want := "📢 **Announcement:** maintenance at 5"; got != want {
+			t.Errorf("sent %q to discord, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the announcement was not sent to discord")
+	}
+}
@@ -0,0 +1,78 @@
+package bridge
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveryQueueSize is how many messages each Discord channel can have waiting
+// to be sent. When full, the oldest is dropped.
+const deliveryQueueSize = 1000
+
+// orderedDelivery sends messages to Discord in the order they arrived from IRC.
+//
+// Each Discord channel has its own queue, sent one message at a time by its own
+// goroutine, so different channels are sent in parallel but a channel's messages
+// are never reordered. At most Config.WebhookWorkers messages are sent at once.
+type orderedDelivery struct {
+	sync.Mutex
+
+	// queues contains the messages waiting to be sent to each channel.
+	// A channel only has a queue whilst its goroutine is running.
+	queues map[string][]delivery
+
+	// slots is used as a semaphore to limit how many messages are sent at once
+	slots chan struct{}
+}
+
+// A delivery sends a single message. If it is dropped, drop is called instead.
+type delivery struct {
+	send func()
+	drop func()
+}
+
+func newOrderedDelivery(workers int) *orderedDelivery {
+	return &orderedDelivery{
+		queues: make(map[string][]delivery),
+		slots:  make(chan struct{}, workers),
+	}
+}
+
+// Send queues the message for the channel, after any already waiting. It never blocks.
+func (o *orderedDelivery) Send(channel string, d delivery) {
+	o.Lock()
+	defer o.Unlock()
+
+	queue, running := o.queues[channel]
+	if len(queue) >= deliveryQueueSize {
+		log.WithField("channel", channel).Warnln("Dropping the oldest message waiting to be sent to Discord, the channel is too far behind")
+		queue[0].drop()
+		queue = queue[1:]
+	}
+	o.queues[channel] = append(queue, d)
+
+	if !running {
+		go o.run(channel)
+	}
+}
+
+// run sends the channel's messages until its queue is empty.
+func (o *orderedDelivery) run(channel string) {
+	for {
+		o.Lock()
+		queue := o.queues[channel]
+		if len(queue) == 0 {
+			delete(o.queues, channel)
+			o.Unlock()
+			return
+		}
+		d := queue[0]
+		o.queues[channel] = queue[1:]
+		o.Unlock()
+
+		o.slots <- struct{}{}
+		d.send()
+		<-o.slots
+	}
+}
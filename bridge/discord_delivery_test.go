@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderedDelivery(t *testing.T) {
+	o := newOrderedDelivery(3)
+
+	channels := []string{"a", "b", "c", "d", "e"}
+	const perChannel = 50
+
+	var mu sync.Mutex
+	got := make(map[string][]int)
+
+	var wg sync.WaitGroup
+	wg.Add(len(channels) * perChannel)
+
+	// Interleave the channels' messages, which take different times to send
+	for i := 0; i < perChannel; i++ {
+		for _, channel := range channels {
+			channel, i := channel, i
+			o.Send(channel, delivery{
+				send: func() {
+					defer wg.Done()
+					time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+
+					mu.Lock()
+					got[channel] = append(got[channel], i)
+					mu.Unlock()
+				},
+				drop: func() {
+					defer wg.Done()
+					t.Errorf("message %d to %s was dropped", i, channel)
+				},
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, channel := range channels {
+		want := make([]int, perChannel)
+		for i := range want {
+			want[i] = i
+		}
+
+		if fmt.Sprint(got[channel]) != fmt.Sprint(want) {
+			t.Errorf("messages to %s were sent in the order %v", channel, got[channel])
+		}
+	}
+}
+
+func TestOrderedDeliveryWorkers(t *testing.T) {
+	const workers = 2
+	o := newOrderedDelivery(workers)
+
+	var mu sync.Mutex
+	sending, most := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		o.Send(fmt.Sprintf("channel%d", i), delivery{
+			send: func() {
+				defer wg.Done()
+
+				mu.Lock()
+				sending++
+				if sending > most {
+					most = sending
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				sending--
+				mu.Unlock()
+			},
+			drop: wg.Done,
+		})
+	}
+	wg.Wait()
+
+	if most > workers {
+		t.Errorf("%d messages were sent at once, want at most %d", most, workers)
+	}
+}
@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// dmRelay sends direct messages to the bot to Config.DMRelayIRCChannel,
+// where they can be answered with "!reply <id> <message>".
+type dmRelay struct {
+	sync.Mutex
+	discord *discordBot
+
+	// senders contains the IDs of everyone that has sent the bot a DM,
+	// as only they can be replied to
+	senders map[string]struct{}
+}
+
+func newDMRelay(discord *discordBot) *dmRelay {
+	return &dmRelay{
+		discord: discord,
+		senders: make(map[string]struct{}),
+	}
+}
+
+// enabled returns true if DMs should go to Config.DMRelayIRCChannel,
+// rather than being sent to IRC users with "name, message".
+func (r *dmRelay) enabled() bool {
+	return r.discord.bridge.Config.DMRelayIRCChannel != ""
+}
+
+// isRelayChannel returns true if the IRC channel is Config.DMRelayIRCChannel.
+func (r *dmRelay) isRelayChannel(channel string) bool {
+	return r.enabled() && strings.EqualFold(channel, r.discord.bridge.Config.DMRelayIRCChannel)
+}
+
+// Publish sends the DM to the relay channel, e.g "[DM] alice (123): hello".
+func (r *dmRelay) Publish(m *discordgo.Message) {
+	r.Lock()
+	r.senders[m.Author.ID] = struct{}{}
+	r.Unlock()
+
+	lines := []string{}
+	if content := strings.TrimSpace(r.discord.ParseText(m)); content != "" {
+		lines = append(lines, strings.Split(content, "\n")...)
+	}
+	lines = append(lines, attachmentLines(m.Attachments, r.discord.bridge.Config.AttachmentMode)...)
+
+	prefix := fmt.Sprintf("[DM] %s (%s): ", m.Author.Username, m.Author.ID)
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			r.discord.bridge.ircListener.Privmsg(r.discord.bridge.Config.DMRelayIRCChannel, prefix+line)
+		}
+	}
+}
+
+// Reply handles a message in the relay channel, sending it to the Discord user
+// if it is "!reply <id> <message>". Everything else is ignored.
+func (r *dmRelay) Reply(nick, message string) {
+	channel := r.discord.bridge.Config.DMRelayIRCChannel
+	command := r.discord.bridge.Config.CommandPrefix + "reply"
+
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != command {
+		return
+	}
+
+	if len(fields) < 3 {
+		r.discord.bridge.ircListener.Notice(channel, "Usage: "+command+" <discord id> <message>")
+		return
+	}
+
+	userID := fields[1]
+	r.Lock()
+	_, ok := r.senders[userID]
+	r.Unlock()
+	if !ok {
+		r.discord.bridge.ircListener.Notice(channel, "Only people who have sent the bot a DM can be replied to.")
+		return
+	}
+
+	dm, err := r.discord.UserChannelCreate(userID)
+	if err == nil {
+		content := strings.Join(fields[2:], " ")
+		_, err = r.discord.ChannelMessageSend(dm.ID, fmt.Sprintf("**%s** (IRC): %s", nick, content))
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"discord": userID,
+		}).Errorln("could not reply to discord dm")
+		r.discord.bridge.ircListener.Notice(channel, "Could not send the reply to Discord.")
+	}
+}
@@ -0,0 +1,174 @@
+package bridge
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// memberChunkTimeout is how long to wait for every chunk of a guild's members
+// before listing them page by page instead.
+var memberChunkTimeout = time.Minute
+
+// memberPageSize is the most members Discord returns per page when listing them.
+const memberPageSize = 1000
+
+// memberRequests tracks the members requested for each guild after connecting.
+//
+// Discord sends the members of large guilds in many chunks, and may not send
+// them all if it is rate limiting us, so until every chunk has arrived the
+// state (and so avatars and presences) is incomplete.
+type memberRequests struct {
+	sync.Mutex
+	guilds map[string]*memberRequest
+}
+
+type memberRequest struct {
+	// nonce is sent with the request and returned with each chunk,
+	// so that chunks from an earlier request aren't counted
+	nonce string
+
+	// received contains the index of each chunk that has arrived
+	received map[int]struct{}
+
+	// count is how many chunks there are, or zero until the first arrives
+	count int
+
+	// loaded is set once every member has arrived
+	loaded bool
+
+	// timeout lists the members page by page if the chunks don't all arrive
+	timeout *time.Timer
+}
+
+func newMemberRequests() *memberRequests {
+	return &memberRequests{guilds: make(map[string]*memberRequest)}
+}
+
+// requestMembers asks Discord for every member of the guild, replacing any earlier request.
+func (d *discordBot) requestMembers(guildID string) {
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	d.members.Lock()
+	if req, ok := d.members.guilds[guildID]; ok && req.timeout != nil {
+		req.timeout.Stop()
+	}
+	d.members.guilds[guildID] = &memberRequest{
+		nonce:    nonce,
+		received: make(map[int]struct{}),
+		timeout: time.AfterFunc(memberChunkTimeout, func() {
+			d.onMemberChunksTimeout(guildID, nonce)
+		}),
+	}
+	d.members.Unlock()
+
+	err := d.RequestGuildMembers(guildID, "", 0, nonce, true)
+	if err != nil {
+		log.Warningln(errors.Wrapf(err, "could not request guild members for %s", guildID).Error())
+	}
+}
+
+// memberChunkReceived records the chunk, returning true if it was the last one needed.
+func (d *discordBot) memberChunkReceived(m *discordgo.GuildMembersChunk) bool {
+	d.members.Lock()
+	defer d.members.Unlock()
+
+	req, ok := d.members.guilds[m.GuildID]
+	if !ok || req.loaded || m.Nonce != req.nonce {
+		return false
+	}
+
+	req.received[m.ChunkIndex] = struct{}{}
+	req.count = m.ChunkCount
+	if len(req.received) < req.count {
+		return false
+	}
+
+	req.loaded = true
+	req.timeout.Stop()
+	return true
+}
+
+// onMemberChunksTimeout lists the guild's members page by page, as not every chunk arrived.
+func (d *discordBot) onMemberChunksTimeout(guildID, nonce string) {
+	d.members.Lock()
+	req, ok := d.members.guilds[guildID]
+	if !ok || req.loaded || req.nonce != nonce {
+		d.members.Unlock()
+		return
+	}
+	received, count := len(req.received), req.count
+	d.members.Unlock()
+
+	log.WithFields(log.Fields{
+		"guild":    guildID,
+		"received": received,
+		"chunks":   count,
+	}).Warnln("Not every chunk of guild members arrived, listing them instead")
+
+	if err := d.listMembers(guildID); err != nil {
+		log.Errorln(errors.Wrapf(err, "could not list guild members for %s", guildID).Error())
+		return
+	}
+
+	d.members.Lock()
+	// Another request may have replaced this one whilst listing
+	if d.members.guilds[guildID] == req {
+		req.loaded = true
+	}
+	d.members.Unlock()
+	log.WithField("guild", guildID).Infoln("Loaded guild members")
+}
+
+// listMembers adds every member of the guild to the state, a page at a time.
+func (d *discordBot) listMembers(guildID string) error {
+	after := ""
+	for {
+		members, err := d.GuildMembers(guildID, after, memberPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			member.GuildID = guildID
+			if err := d.State.MemberAdd(member); err != nil {
+				return err
+			}
+			d.handleMemberUpdate(member, false)
+		}
+
+		if len(members) < memberPageSize {
+			return nil
+		}
+		after = members[len(members)-1].User.ID
+	}
+}
+
+// membersLoaded returns true once every member of the guild has arrived.
+func (d *discordBot) membersLoaded(guildID string) bool {
+	d.members.Lock()
+	defer d.members.Unlock()
+
+	req, ok := d.members.guilds[guildID]
+	return ok && req.loaded
+}
+
+// membersLoading returns the guilds whose members haven't all arrived yet.
+func (d *discordBot) membersLoading() []string {
+	guildIDs := d.bridge.GuildIDs()
+
+	d.members.Lock()
+	defer d.members.Unlock()
+
+	loading := []string{}
+	for _, guildID := range guildIDs {
+		if req, ok := d.members.guilds[guildID]; !ok || !req.loaded {
+			loading = append(loading, guildID)
+		}
+	}
+	return loading
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// onlineUsers tracks which Discord users are online in each guild,
+// so that IRC users can see who is around.
+type onlineUsers struct {
+	sync.Mutex
+
+	// users contains the display name of everyone online, keyed by guild and then user ID
+	users map[string]map[string]string
+}
+
+func newOnlineUsers() *onlineUsers {
+	return &onlineUsers{
+		users: make(map[string]map[string]string),
+	}
+}
+
+func (o *onlineUsers) Set(guildID, userID, name string) {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, ok := o.users[guildID]; !ok {
+		o.users[guildID] = make(map[string]string)
+	}
+	o.users[guildID][userID] = name
+}
+
+func (o *onlineUsers) Remove(guildID, userID string) {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.users[guildID], userID)
+}
+
+// Names returns the names of everyone online in any of the guilds, sorted.
+func (o *onlineUsers) Names(guildIDs ...string) []string {
+	o.Lock()
+	defer o.Unlock()
+
+	// People in several guilds are only listed once
+	users := make(map[string]string)
+	for _, guildID := range guildIDs {
+		for id, name := range o.users[guildID] {
+			users[id] = name
+		}
+	}
+
+	names := []string{}
+	for _, name := range users {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	return names
+}
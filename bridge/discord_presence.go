@@ -0,0 +1,47 @@
+package bridge
+
+import (
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// discordActivityTypes are the values for Config.DiscordActivityType
+var discordActivityTypes = map[string]discordgo.ActivityType{
+	"playing":   discordgo.ActivityTypeGame,
+	"listening": discordgo.ActivityTypeListening,
+	"watching":  discordgo.ActivityTypeWatching,
+	"competing": discordgo.ActivityTypeCompeting,
+	"custom":    discordgo.ActivityTypeCustom,
+}
+
+// updatePresence sets the bot's status and activity from the config.
+// It is called once connected to Discord, and whenever the listener
+// connects to or disconnects from IRC, in case Config.DiscordStatusIRCHealth is set.
+func (d *discordBot) updatePresence() {
+	conf := d.bridge.Config
+
+	status := conf.DiscordStatus
+	if listener := d.bridge.ircListener; conf.DiscordStatusIRCHealth && listener != nil && !listener.state.Connected() {
+		status = string(discordgo.StatusIdle)
+	}
+
+	data := discordgo.UpdateStatusData{Status: status}
+	if conf.DiscordActivity != "" {
+		activity := &discordgo.Activity{
+			Name: conf.DiscordActivity,
+			Type: discordActivityTypes[conf.DiscordActivityType],
+		}
+
+		// Discord shows the state of custom statuses, but still needs a name
+		if activity.Type == discordgo.ActivityTypeCustom {
+			activity.Name = "Custom Status"
+			activity.State = conf.DiscordActivity
+		}
+		data.Activities = []*discordgo.Activity{activity}
+	}
+
+	// This fails whilst disconnected from Discord, but is done again once we are ready
+	if err := d.UpdateStatusComplex(data); err != nil {
+		log.WithField("error", err).Debugln("could not update discord presence")
+	}
+}
@@ -0,0 +1,246 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// summarisedReactionsCacheSize is the number of messages whose reactions
+// we remember telling IRC about, so that their removal can be told too
+const summarisedReactionsCacheSize = 512
+
+// reactionSummaries tells IRC about reactions on Discord messages, sending
+// at most one line per message every Config.ReactionSummaryWindow,
+// e.g "3 people reacted 👍 to <alice> hello everyone".
+//
+// Reactions that are removed before they are summarised are never mentioned.
+// Otherwise their removal is summarised too, e.g "1 person removed 👍 from <alice> hello".
+type reactionSummaries struct {
+	sync.Mutex
+	discord *discordBot
+
+	// pending reactions, keyed by message ID
+	pending map[string]*messageReactions
+
+	// summarised contains the IDs of the messages IRC has been told about reactions to
+	summarised *messageCache
+}
+
+// messageReactions are the reactions changed on a message since its last summary.
+type messageReactions struct {
+	guildID   string
+	channelID string
+
+	// cleared is true if all the reactions IRC knew about were removed
+	cleared bool
+
+	// emojis in the order they were first used, and the IDs of
+	// the users that added or removed a reaction with each
+	emojis  []string
+	added   map[string]map[string]struct{}
+	removed map[string]map[string]struct{}
+}
+
+func newReactionSummaries(discord *discordBot) *reactionSummaries {
+	return &reactionSummaries{
+		discord:    discord,
+		pending:    make(map[string]*messageReactions),
+		summarised: newMessageCache(summarisedReactionsCacheSize),
+	}
+}
+
+// relays returns true if the reaction should be summarised.
+func (r *reactionSummaries) relays(s *discordgo.Session, userID string) bool {
+	if !r.discord.bridge.Config.RelayReactionSummaries || s.State.User == nil {
+		return false
+	}
+
+	return userID != s.State.User.ID && !r.discord.bridge.isIgnoredDiscordUser(userID)
+}
+
+func (r *reactionSummaries) OnMessageReactionAdd(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
+	if !r.relays(s, m.UserID) {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	reactions := r.pendingFor(m.MessageReaction)
+	emoji := reactions.emoji(m.Emoji)
+
+	// Adding back a reaction IRC hasn't been told was removed changes nothing
+	if _, ok := reactions.removed[emoji][m.UserID]; ok {
+		delete(reactions.removed[emoji], m.UserID)
+		return
+	}
+	reactions.added[emoji][m.UserID] = struct{}{}
+}
+
+func (r *reactionSummaries) OnMessageReactionRemove(s *discordgo.Session, m *discordgo.MessageReactionRemove) {
+	if !r.relays(s, m.UserID) {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if reactions, ok := r.pending[m.MessageID]; ok {
+		emoji := reactions.emoji(m.Emoji)
+		if _, ok := reactions.added[emoji][m.UserID]; ok {
+			delete(reactions.added[emoji], m.UserID)
+			return
+		}
+	}
+
+	// IRC only knows about the reactions it has been sent a summary for
+	if !r.summarised.Contains(m.MessageID) {
+		return
+	}
+
+	reactions := r.pendingFor(m.MessageReaction)
+	if !reactions.cleared {
+		reactions.removed[reactions.emoji(m.Emoji)][m.UserID] = struct{}{}
+	}
+}
+
+func (r *reactionSummaries) OnMessageReactionRemoveAll(s *discordgo.Session, m *discordgo.MessageReactionRemoveAll) {
+	if !r.discord.bridge.Config.RelayReactionSummaries {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.summarised.Contains(m.MessageID) {
+		if reactions, ok := r.pending[m.MessageID]; ok {
+			reactions.clear()
+		}
+		return
+	}
+
+	reactions := r.pendingFor(m.MessageReaction)
+	reactions.clear()
+	reactions.cleared = true
+}
+
+// pendingFor returns the reactions waiting to be summarised for the message,
+// scheduling a summary if there aren't any yet. It must be called with the lock held.
+func (r *reactionSummaries) pendingFor(m *discordgo.MessageReaction) *messageReactions {
+	if reactions, ok := r.pending[m.MessageID]; ok {
+		return reactions
+	}
+
+	reactions := &messageReactions{
+		guildID:   m.GuildID,
+		channelID: m.ChannelID,
+		added:     make(map[string]map[string]struct{}),
+		removed:   make(map[string]map[string]struct{}),
+	}
+	r.pending[m.MessageID] = reactions
+
+	messageID := m.MessageID
+	time.AfterFunc(r.discord.bridge.Config.ReactionSummaryWindow, func() {
+		r.Lock()
+		reactions := r.pending[messageID]
+		delete(r.pending, messageID)
+		r.Unlock()
+
+		r.send(messageID, reactions)
+	})
+
+	return reactions
+}
+
+// clear forgets the reactions added and removed since the last summary.
+func (reactions *messageReactions) clear() {
+	reactions.emojis = nil
+	reactions.added = make(map[string]map[string]struct{})
+	reactions.removed = make(map[string]map[string]struct{})
+}
+
+// emoji returns how the emoji is written on IRC, remembering it if it is new.
+func (reactions *messageReactions) emoji(e discordgo.Emoji) string {
+	emoji := e.Name
+	if e.ID != "" {
+		// Custom emoji
+		emoji = fmt.Sprint(":", emoji, ":")
+	}
+
+	if _, ok := reactions.added[emoji]; !ok {
+		reactions.emojis = append(reactions.emojis, emoji)
+		reactions.added[emoji] = make(map[string]struct{})
+		reactions.removed[emoji] = make(map[string]struct{})
+	}
+	return emoji
+}
+
+func (r *reactionSummaries) send(messageID string, reactions *messageReactions) {
+	channelID := reactions.channelID
+	if parentID, _ := r.discord.threadParent(channelID); parentID != "" {
+		channelID = parentID
+	}
+
+	mapping := r.discord.bridge.GetMappingByDiscord(channelID)
+	if mapping == nil || !mapping.ToIRC() {
+		return
+	}
+
+	var parts []string
+	if reactions.cleared {
+		parts = append(parts, "all reactions were removed")
+	}
+
+	added := false
+	for _, emoji := range reactions.emojis {
+		if n := len(reactions.added[emoji]); n > 0 {
+			parts = append(parts, fmt.Sprintf("%s reacted %s", people(n), emoji))
+			added = true
+		}
+	}
+	for _, emoji := range reactions.emojis {
+		if n := len(reactions.removed[emoji]); n > 0 {
+			parts = append(parts, fmt.Sprintf("%s removed %s", people(n), emoji))
+		}
+	}
+
+	// Everything was undone before the summary
+	if len(parts) == 0 {
+		return
+	}
+
+	// Say which message it was, so that IRC has some context
+	target := ""
+	original, err := r.discord.ChannelMessage(reactions.channelID, messageID)
+	if err == nil && original.Author != nil {
+		preposition := "from"
+		if added {
+			preposition = "to"
+		}
+
+		original.GuildID = reactions.guildID
+		snippet := strings.Join(strings.Fields(r.discord.ParseText(original)), " ")
+		target = fmt.Sprintf(" %s <%s> %s", preposition, original.Author.Username, TruncateString(r.discord.bridge.Config.ReplyQuoteLength, snippet))
+	} else {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"message-id": messageID,
+		}).Debugln("could not fetch message for reaction summary")
+	}
+
+	r.summarised.Add(messageID)
+	r.discord.bridge.ircListener.Notice(mapping.IRCChannel, strings.Join(parts, ", ")+target)
+}
+
+// people returns "1 person" or "n people".
+func people(n int) string {
+	if n == 1 {
+		return "1 person"
+	}
+	return fmt.Sprintf("%d people", n)
+}
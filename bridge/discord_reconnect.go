@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// discordReopenBaseDelay is the initial delay between attempts to open a new session.
+var discordReopenBaseDelay = time.Second * 5
+
+// discordConnection tracks the Discord websocket connection.
+//
+// discordgo reconnects and resumes by itself, but can get stuck doing so,
+// so if it hasn't reconnected after Config.DiscordResumeTimeout the session
+// is closed and a new one opened.
+type discordConnection struct {
+	sync.Mutex
+
+	// disconnectedAt is when the connection dropped, or zero whilst connected
+	disconnectedAt time.Time
+
+	// reconnects is how many times the connection has come back after dropping
+	reconnects int
+
+	// watchdog opens a new session when it fires, whilst disconnected
+	watchdog *time.Timer
+
+	// closing is set once the bridge is shutting down, so that we stay disconnected
+	closing bool
+}
+
+func (d *discordBot) onConnect(s *discordgo.Session, c *discordgo.Connect) {
+	d.conn.Lock()
+	defer d.conn.Unlock()
+
+	if d.conn.watchdog != nil {
+		d.conn.watchdog.Stop()
+		d.conn.watchdog = nil
+	}
+
+	if d.conn.disconnectedAt.IsZero() {
+		return
+	}
+
+	d.conn.reconnects++
+	log.WithFields(log.Fields{
+		"downtime":   time.Since(d.conn.disconnectedAt).Round(time.Second),
+		"reconnects": d.conn.reconnects,
+	}).Infoln("Reconnected to Discord")
+	d.conn.disconnectedAt = time.Time{}
+}
+
+func (d *discordBot) onResumed(s *discordgo.Session, r *discordgo.Resumed) {
+	log.Debugln("Resumed the Discord session")
+}
+
+func (d *discordBot) onDisconnect(s *discordgo.Session, e *discordgo.Disconnect) {
+	d.conn.Lock()
+	defer d.conn.Unlock()
+
+	if d.conn.closing {
+		return
+	}
+
+	if d.conn.disconnectedAt.IsZero() {
+		d.conn.disconnectedAt = time.Now()
+		log.Warnln("Disconnected from Discord, waiting for discordgo to reconnect")
+	}
+
+	if d.conn.watchdog == nil {
+		d.conn.watchdog = time.AfterFunc(d.bridge.Config.DiscordResumeTimeout, d.reopen)
+	}
+}
+
+// stillDisconnected returns true if we should keep trying to open a new session.
+func (d *discordBot) stillDisconnected() bool {
+	d.conn.Lock()
+	defer d.conn.Unlock()
+	return !d.conn.closing && !d.conn.disconnectedAt.IsZero()
+}
+
+// reopen closes the session and opens a new one, with backoff,
+// until it succeeds or discordgo manages to reconnect by itself.
+func (d *discordBot) reopen() {
+	for attempt := 0; d.stillDisconnected(); attempt++ {
+		log.WithField("attempt", attempt+1).Warnln("Discord has not reconnected by itself, opening a new session")
+
+		// Open refuses to replace a connection that it thinks is still open
+		err := d.session.Close()
+		if err == nil {
+			err = d.session.Open()
+		}
+
+		if err == nil {
+			return
+		}
+
+		log.WithError(err).Errorln("Could not open a new Discord session")
+		time.Sleep(backoffDelay(discordReopenBaseDelay, attempt))
+	}
+}
+
+// disconnectedSince returns when the connection to Discord dropped,
+// or nil whilst connected, along with how many times it has reconnected.
+func (d *discordBot) disconnectedSince() (*time.Time, int) {
+	d.conn.Lock()
+	defer d.conn.Unlock()
+
+	if d.conn.disconnectedAt.IsZero() {
+		return nil, d.conn.reconnects
+	}
+	t := d.conn.disconnectedAt.UTC()
+	return &t, d.conn.reconnects
+}
+
+// closeConnection stops the session from being reopened.
+func (d *discordBot) closeConnection() {
+	d.conn.Lock()
+	defer d.conn.Unlock()
+
+	d.conn.closing = true
+	if d.conn.watchdog != nil {
+		d.conn.watchdog.Stop()
+		d.conn.watchdog = nil
+	}
+}
@@ -0,0 +1,40 @@
+package bridge
+
+// discordMessageLength is the most characters a Discord message can have.
+const discordMessageLength = 2000
+
+// splitDiscordMessage splits content into messages of at most discordMessageLength
+// characters, preferring to break between lines, then between words.
+func splitDiscordMessage(content string) []string {
+	runes := []rune(content)
+
+	// breakAt returns where the last sep is in the first message, or -1.
+	// Only breaks that don't leave a tiny message count.
+	breakAt := func(sep rune) int {
+		for i := discordMessageLength; i >= discordMessageLength/2; i-- {
+			if runes[i] == sep {
+				return i
+			}
+		}
+		return -1
+	}
+
+	messages := []string{}
+	for len(runes) > discordMessageLength {
+		cut := breakAt('\n')
+		if cut == -1 {
+			cut = breakAt(' ')
+		}
+
+		if cut == -1 {
+			messages = append(messages, string(runes[:discordMessageLength]))
+			runes = runes[discordMessageLength:]
+		} else {
+			// The line break or space itself isn't needed
+			messages = append(messages, string(runes[:cut]))
+			runes = runes[cut+1:]
+		}
+	}
+
+	return append(messages, string(runes))
+}
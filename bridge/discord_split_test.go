@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitDiscordMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int // the length of each message, in characters
+	}{
+		{"short", "hello", []int{5}},
+		{"exactly the limit", strings.Repeat("a", 2000), []int{2000}},
+		{"just over", strings.Repeat("a", 2001), []int{2000, 1}},
+		{"just over in multibyte", strings.Repeat("é", 2001), []int{2000, 1}},
+		{"well over", strings.Repeat("a", 5500), []int{2000, 2000, 1500}},
+
+		// The line break or space it is split at is dropped
+		{"lines", strings.Repeat("a", 1500) + "\n" + strings.Repeat("b", 1000), []int{1500, 1000}},
+		{"words", strings.Repeat("a", 1200) + " " + strings.Repeat("b", 1200), []int{1200, 1200}},
+
+		// Breaking this early would leave a tiny message, so it is cut at the limit
+		{"early space", "a " + strings.Repeat("b", 2500), []int{2000, 502}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := splitDiscordMessage(tt.content)
+
+			lengths := []int{}
+			for _, msg := range messages {
+				lengths = append(lengths, utf8.RuneCountInString(msg))
+			}
+
+			if len(lengths) != len(tt.want) {
+				t.Fatalf("split into messages of %v characters, want %v", lengths, tt.want)
+			}
+			for i := range lengths {
+				if lengths[i] != tt.want[i] {
+					t.Fatalf("split into messages of %v characters, want %v", lengths, tt.want)
+				}
+			}
+
+			if joined := strings.Join(messages, ""); len(tt.want) == 1 && joined != tt.content {
+				t.Errorf("message was changed to %q", joined)
+			}
+		})
+	}
+}
+
+func TestSplitDiscordMessageKeepsEverything(t *testing.T) {
+	content := strings.Repeat("some words here\n", 400)
+	messages := splitDiscordMessage(content)
+
+	if len(messages) < 2 {
+		t.Fatalf("content of %d characters was not split", len(content))
+	}
+	for i, msg := range messages {
+		if n := utf8.RuneCountInString(msg); n > discordMessageLength {
+			t.Errorf("message %d has %d characters", i, n)
+		}
+	}
+
+	if joined := strings.Join(messages, "\n"); joined != content {
+		t.Error("the messages joined by the lines they were split at don't make up the content")
+	}
+}
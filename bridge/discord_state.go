@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// memberSearchLimit is the most members fetched when searching for an avatar
+const memberSearchLimit = 100
+
+// isNotFound returns true if the error is Discord saying that something doesn't exist.
+func isNotFound(err error) bool {
+	if errors.Cause(err) == discordgo.ErrStateNotFound {
+		return true
+	}
+
+	restErr, ok := errors.Cause(err).(*discordgo.RESTError)
+	return ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// member returns the guild member from the state, or fetches it if it's not there,
+// e.g because the guild's members are still loading. Members that Discord says
+// don't exist are remembered, so that they aren't fetched again.
+func (d *discordBot) member(guildID, userID string) (*discordgo.Member, error) {
+	if member, err := d.State.Member(guildID, userID); err == nil {
+		return member, nil
+	}
+
+	// Direct messages have no guild
+	if guildID == "" || d.missingMembers.Contains(guildID+" "+userID) {
+		return nil, discordgo.ErrStateNotFound
+	}
+
+	member, err := d.GuildMember(guildID, userID)
+	if err != nil {
+		if isNotFound(err) {
+			d.missingMembers.Add(guildID + " " + userID)
+		}
+		return nil, err
+	}
+
+	member.GuildID = guildID
+	if err := d.State.MemberAdd(member); err != nil {
+		log.WithField("error", err).Debugln("could not cache fetched member")
+	}
+	return member, nil
+}
+
+// membersNamed returns the guild members that might be called username.
+// complete is false if some members could be missing, so the result shouldn't be cached.
+//
+// Until every member has arrived, Discord is searched instead of the state.
+func (d *discordBot) membersNamed(guildID, username string) (members []*discordgo.Member, complete bool, err error) {
+	guild, stateErr := d.State.Guild(guildID)
+	if stateErr == nil && d.membersLoaded(guildID) {
+		return guild.Members, true, nil
+	}
+
+	members, err = d.GuildMembersSearch(guildID, username, memberSearchLimit)
+	if err != nil {
+		// Make do with the members we have
+		if stateErr == nil {
+			log.WithField("error", err).Warnln("could not search guild members, using those we have")
+			return guild.Members, false, nil
+		}
+		return nil, false, err
+	}
+
+	for _, member := range members {
+		member.GuildID = guildID
+		if err := d.State.MemberAdd(member); err != nil {
+			log.WithField("error", err).Debugln("could not cache fetched member")
+		}
+	}
+	return members, len(members) < memberSearchLimit, nil
+}
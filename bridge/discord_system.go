@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// isUserMessage returns true for messages sent by someone (or a command),
+// rather than system messages like "alice joined the server".
+func isUserMessage(t discordgo.MessageType) bool {
+	switch t {
+	case discordgo.MessageTypeDefault,
+		discordgo.MessageTypeReply,
+		discordgo.MessageTypeChatInputCommand,
+		discordgo.MessageTypeContextMenuCommand:
+		return true
+	}
+	return false
+}
+
+// systemMessageKind returns which of Config.SystemMessages the message is,
+// or an empty string if it is never relayed.
+func systemMessageKind(t discordgo.MessageType) string {
+	switch t {
+	case discordgo.MessageTypeGuildMemberJoin:
+		return SystemMessageJoins
+	case discordgo.MessageTypeUserPremiumGuildSubscription,
+		discordgo.MessageTypeUserPremiumGuildSubscriptionTierOne,
+		discordgo.MessageTypeUserPremiumGuildSubscriptionTierTwo,
+		discordgo.MessageTypeUserPremiumGuildSubscriptionTierThree:
+		return SystemMessageBoosts
+	case discordgo.MessageTypeThreadCreated:
+		return SystemMessageThreads
+	}
+	return ""
+}
+
+// publishSystemMessage sends a notice to IRC for the system messages enabled
+// in Config.SystemMessages, e.g "alice boosted the server". Others are dropped.
+func (d *discordBot) publishSystemMessage(m *discordgo.Message) {
+	kind := systemMessageKind(m.Type)
+	if kind == "" || !d.bridge.relaysSystemMessage(kind) {
+		return
+	}
+
+	// Threads are already announced when they are created
+	if kind == SystemMessageThreads && d.bridge.Config.RelayThreadCreation {
+		return
+	}
+
+	if m.Author == nil || d.bridge.isIgnoredDiscordUser(m.Author.ID) {
+		return
+	}
+
+	mapping := d.bridge.GetMappingByDiscord(m.ChannelID)
+	if mapping == nil || !mapping.ToIRC() {
+		return
+	}
+
+	nick := d.authorNick(m)
+
+	var notice string
+	switch m.Type {
+	case discordgo.MessageTypeGuildMemberJoin:
+		notice = nick + " joined the server"
+	case discordgo.MessageTypeUserPremiumGuildSubscription:
+		notice = nick + " boosted the server"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierOne:
+		notice = nick + " boosted the server to level 1"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierTwo:
+		notice = nick + " boosted the server to level 2"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierThree:
+		notice = nick + " boosted the server to level 3"
+	case discordgo.MessageTypeThreadCreated:
+		// The content is the name of the thread
+		notice = fmt.Sprintf("%s started a thread: %s", nick, m.Content)
+	}
+
+	d.bridge.ircListener.Notice(mapping.IRCChannel, notice)
+}
+
+func (b *Bridge) relaysSystemMessage(kind string) bool {
+	for _, k := range b.Config.SystemMessages {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseText(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	alice := tb.addUser("500000000000000001", "alice", "Ally")
+	bot := &discordgo.User{ID: testBotID, Username: "bridge", Bot: true}
+
+	tests := []struct {
+		name     string
+		content  string
+		mentions []*discordgo.User
+		want     string
+	}{
+		{"plain", "hello there", nil, "hello there"},
+		{"user mention", "hi <@500000000000000001>!", []*discordgo.User{alice}, "hi Ally!"},
+		{"nick mention", "hi <@!500000000000000001>", []*discordgo.User{alice}, "hi Ally"},
+		{"bot mention", "<@" + testBotID + "> hi", []*discordgo.User{bot}, "bridge hi"},
+		{"channel mention", "see <#" + testChannelID + ">", nil, "see #general"},
+		{"deleted channel", "see <#200000000000000009>", nil, "see #deleted-channel"},
+		{"emoji", "nice <:thumbsup:700000000000000001> <a:party:700000000000000002>", nil, "nice :thumbsup: :party:"},
+		{"crlf", "one\r\ntwo\rthree", nil, "one\ntwo\nthree"},
+		{"spoiler", "it was ||the butler||", nil, "it was [spoiler]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tb.Bridge.discord.ParseText(&discordgo.Message{
+				GuildID:   testGuildID,
+				ChannelID: testChannelID,
+				Content:   tt.content,
+				Mentions:  tt.mentions,
+			})
+			if got != tt.want {
+				t.Errorf("ParseText(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+		action  bool
+	}{
+		// ASCII
+		{"_waves_", "waves", true},
+		{"_waves at everyone_", "waves at everyone", true},
+		{"_a_", "a", true},
+		{"*waves*", "*waves*", false},
+		{"waves", "waves", false},
+		{"_waves", "_waves", false},
+		{"waves_", "waves_", false},
+		{"__bold__", "__bold__", false},
+
+		// Multibyte, which is counted in runes rather than bytes
+		{"_é_", "é", true},
+		{"_😀_", "😀", true},
+		{"_машет_", "машет", true},
+		{"é_", "é_", false},
+
+		// Single underscores, which are too short to be an action
+		{"_", "_", false},
+		{"__", "__", false},
+		{"___", "___", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, action := parseAction(tt.content)
+		if got != tt.want || action != tt.action {
+			t.Errorf("parseAction(%q) = %q, %v, want %q, %v", tt.content, got, action, tt.want, tt.action)
+		}
+	}
+}
+
+func TestParseTextRoleAndChannelMentions(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	state := tb.Bridge.discord.State
+
+	const otherGuildID = "100000000000000002"
+	state.GuildAdd(&discordgo.Guild{
+		ID:       otherGuildID,
+		Channels: []*discordgo.Channel{{ID: "200000000000000005", GuildID: otherGuildID, Name: "elsewhere", Type: discordgo.ChannelTypeGuildText}},
+	})
+	state.RoleAdd(testGuildID, &discordgo.Role{ID: "800000000000000001", Name: "mods"})
+	state.RoleAdd(otherGuildID, &discordgo.Role{ID: "800000000000000002", Name: "admins"})
+
+	// A channel we can only find by asking Discord, and a voice channel
+	tb.discord.addChannel(&discordgo.Channel{ID: "200000000000000006", Name: "fetched", Type: discordgo.ChannelTypeGuildText})
+	state.ChannelAdd(&discordgo.Channel{ID: "200000000000000007", GuildID: testGuildID, Name: "voice", Type: discordgo.ChannelTypeGuildVoice})
+
+	tests := []struct {
+		name    string
+		guildID string
+		content string
+		want    string
+	}{
+		{"role", testGuildID, "hi <@&800000000000000001>", "hi @mods"},
+		{"deleted role", testGuildID, "hi <@&800000000000000009>", "hi @unknown-role"},
+		{"role from another guild", testGuildID, "hi <@&800000000000000002>", "hi @unknown-role"},
+		{"role in another guild", otherGuildID, "hi <@&800000000000000002>", "hi @admins"},
+		{"role in a dm", "", "hi <@&800000000000000001>", "hi @unknown-role"},
+
+		{"channel", testGuildID, "see <#" + testChannelID + ">", "see #general"},
+		{"channel in another guild", testGuildID, "see <#200000000000000005>", "see #elsewhere"},
+		{"fetched channel", testGuildID, "see <#200000000000000006>", "see #fetched"},
+		{"deleted channel", testGuildID, "see <#200000000000000009>", "see #deleted-channel"},
+		{"voice channel", testGuildID, "join <#200000000000000007>", "join #voice"},
+
+		{"several", testGuildID, "<@&800000000000000001> <@&800000000000000009> <#" + testChannelID + ">", "@mods @unknown-role #general"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tb.Bridge.discord.ParseText(&discordgo.Message{
+				GuildID: tt.guildID,
+				Content: tt.content,
+			})
+			if got != tt.want {
+				t.Errorf("ParseText(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentOnlyMessage(t *testing.T) {
+	attachments := []*discordgo.MessageAttachment{
+		{URL: "https://cdn.discordapp.com/attachments/1/2/cat.png", Filename: "cat.png", Size: 1200, Width: 800, Height: 600},
+	}
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{AttachmentModeURL, []string{"PRIVMSG #irc :<a​lice> https://cdn.discordapp.com/attachments/1/2/cat.png"}},
+		{AttachmentModeURLWithMeta, []string{"PRIVMSG #irc :<a​lice> cat.png (1.2 kB, 800x600) https://cdn.discordapp.com/attachments/1/2/cat.png"}},
+		{AttachmentModeSuppress, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			tb := newTestBridge(t, func(conf *Config) {
+				conf.AttachmentMode = tt.mode
+			})
+			author := tb.addUser("500000000000000001", "alice", "")
+
+			d := tb.Bridge.discord
+			d.publishMessage(d.session, &discordgo.Message{
+				ID:          "600000000000000001",
+				ChannelID:   testChannelID,
+				GuildID:     testGuildID,
+				Author:      author,
+				Attachments: attachments,
+			}, false)
+
+			for _, want := range tt.want {
+				if got := tb.irc.next(t); got != want {
+					t.Errorf("sent %q to irc, want %q", got, want)
+				}
+			}
+			tb.irc.none(t)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// voiceDebounce is how long to wait before relaying a voice channel change.
+// If the user goes back to where they were within this window, nothing is relayed.
+var voiceDebounce = time.Second * 10
+
+// voiceRelay tells IRC when Discord users join, leave or move between voice channels.
+//
+// Mutes and deafens don't change the channel, so they are never relayed.
+type voiceRelay struct {
+	sync.Mutex
+	discord *discordBot
+
+	// pending changes, keyed by user ID
+	pending map[string]*voiceChange
+}
+
+// voiceChange is where a user was before their first change
+// within voiceDebounce, and where they are now.
+type voiceChange struct {
+	guildID string
+	from    string
+	to      string
+	member  *discordgo.Member
+}
+
+func newVoiceRelay(discord *discordBot) *voiceRelay {
+	return &voiceRelay{
+		discord: discord,
+		pending: make(map[string]*voiceChange),
+	}
+}
+
+func (r *voiceRelay) OnVoiceStateUpdate(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	if !r.discord.bridge.Config.RelayVoiceStates || r.discord.bridge.isIgnoredDiscordUser(v.UserID) {
+		return
+	}
+
+	from := ""
+	if v.BeforeUpdate != nil {
+		from = v.BeforeUpdate.ChannelID
+	}
+
+	if from == v.ChannelID {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if change, ok := r.pending[v.UserID]; ok {
+		change.to = v.ChannelID
+		return
+	}
+
+	r.pending[v.UserID] = &voiceChange{
+		guildID: v.GuildID,
+		from:    from,
+		to:      v.ChannelID,
+		member:  v.Member,
+	}
+
+	userID := v.UserID
+	time.AfterFunc(voiceDebounce, func() {
+		r.Lock()
+		change := r.pending[userID]
+		delete(r.pending, userID)
+		r.Unlock()
+
+		r.send(userID, change)
+	})
+}
+
+func (r *voiceRelay) send(userID string, change *voiceChange) {
+	if change.from == change.to {
+		return
+	}
+
+	member := change.member
+	if member == nil || member.User == nil {
+		var err error
+		member, err = r.discord.State.Member(change.guildID, userID)
+		if err != nil {
+			log.WithField("error", err).Debugln("could not find member for voice state update")
+			return
+		}
+	}
+
+	// Moves are announced in the IRC channel for where they went
+	var notice, voiceChannel string
+	switch {
+	case change.from == "":
+		voiceChannel = change.to
+		notice = "%s joined voice: %s"
+	case change.to == "":
+		voiceChannel = change.from
+		notice = "%s left voice: %s"
+	default:
+		voiceChannel = change.to
+		notice = "%s moved to voice: %s"
+	}
+
+	channel, err := r.discord.State.Channel(voiceChannel)
+	if err != nil {
+		log.WithField("error", err).Debugln("could not find voice channel")
+		return
+	}
+
+	ircChannel := r.ircChannel(channel)
+	if ircChannel == "" {
+		return
+	}
+
+	r.discord.bridge.ircListener.Notice(ircChannel, fmt.Sprintf(notice, GetMemberNick(member), channel.Name))
+}
+
+// ircChannel returns the IRC channel voice changes for the voice channel are sent to:
+// Config.VoiceIRCChannel, or the IRC channel of the first text channel bridged to IRC in the same category.
+func (r *voiceRelay) ircChannel(voice *discordgo.Channel) string {
+	if r.discord.bridge.Config.VoiceIRCChannel != "" {
+		return r.discord.bridge.Config.VoiceIRCChannel
+	}
+
+	if voice.ParentID == "" {
+		return ""
+	}
+
+	for _, mapping := range r.discord.bridge.mappings {
+		channel, err := r.discord.State.Channel(mapping.DiscordChannel)
+		if err == nil && channel.ParentID == voice.ParentID && mapping.ToIRC() {
+			return mapping.IRCChannel
+		}
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
+)
+
+// echoFilterSize is the most recently sent messages remembered for each channel
+const echoFilterSize = 50
+
+// echoFilter remembers the messages recently sent to each channel, so that
+// another bridge in the same channel can't echo them back to us.
+//
+// A message from another bridge is an echo if it is something we sent, ignoring
+// formatting and case, either as it was or after a relay prefix like "<alice> ".
+// Messages from ordinary users are never checked, as they could say the same thing.
+type echoFilter struct {
+	sync.Mutex
+
+	// window is how long messages are remembered for. Zero disables the filter.
+	window time.Duration
+
+	sent map[string][]sentMessage
+}
+
+type sentMessage struct {
+	content string
+	at      time.Time
+}
+
+func newEchoFilter(window time.Duration) *echoFilter {
+	return &echoFilter{
+		window: window,
+		sent:   make(map[string][]sentMessage),
+	}
+}
+
+// Sent remembers each line of content as sent to the channel.
+func (f *echoFilter) Sent(channel, content string) {
+	if f.window <= 0 {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	recent := f.recent(channel, now)
+	for _, line := range strings.Split(content, "\n") {
+		if line = normaliseEcho(line); line != "" {
+			recent = append(recent, sentMessage{content: line, at: now})
+		}
+	}
+
+	if len(recent) > echoFilterSize {
+		recent = recent[len(recent)-echoFilterSize:]
+	}
+	f.sent[channel] = recent
+}
+
+// IsEcho returns true if the content, sent by another bridge, is a message recently
+// sent to the channel.
+func (f *echoFilter) IsEcho(channel, content string) bool {
+	if f.window <= 0 {
+		return false
+	}
+
+	content = normaliseEcho(content)
+	if content == "" {
+		return false
+	}
+	relayed, hasPrefix := stripRelayPrefix(content)
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, msg := range f.recent(channel, time.Now()) {
+		if content == msg.content || (hasPrefix && relayed == msg.content) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripRelayPrefix removes the name a bridge puts before each message it relays,
+// e.g "<alice> hello" or "[alice] hello", returning false if there isn't one.
+func stripRelayPrefix(content string) (string, bool) {
+	if content == "" {
+		return "", false
+	}
+
+	end := map[byte]string{'<': "> ", '[': "] "}[content[0]]
+	if end == "" {
+		return "", false
+	}
+
+	i := strings.Index(content, end)
+	if i < 2 || strings.Contains(content[1:i], " ") {
+		return "", false
+	}
+	return content[i+len(end):], true
+}
+
+// recent forgets the messages sent to the channel before the window,
+// and returns the rest. It must be called with the lock held.
+func (f *echoFilter) recent(channel string, now time.Time) []sentMessage {
+	recent := f.sent[channel]
+	for len(recent) > 0 && now.Sub(recent[0].at) > f.window {
+		recent = recent[1:]
+	}
+
+	if len(recent) == 0 {
+		delete(f.sent, channel)
+		return nil
+	}
+	f.sent[channel] = recent
+	return recent
+}
+
+// normaliseEcho removes the formatting, zero width spaces and case
+// that a message might gain or lose as it passes through a bridge.
+func normaliseEcho(content string) string {
+	content = ircf.Strip(content)
+	content = strings.ReplaceAll(content, "\u200b", "")
+	return strings.ToLower(strings.Join(strings.Fields(content), " "))
+}
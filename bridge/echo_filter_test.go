@@ -0,0 +1,71 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEchoFilter(t *testing.T) {
+	f := newEchoFilter(time.Minute)
+	f.Sent("#irc", "ok")
+	f.Sent("#irc", "Hello \x02there\x02\nsecond line")
+
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"ok", true},
+		{"OK", true},
+		{"<alice> ok", true},
+		{"[alice] ok", true},
+		{"hello there", true},
+		{"<alice> second line", true},
+
+		// Ordinary messages that happen to end with something we sent
+		{"not ok", false},
+		{"book", false},
+		{"<alice> not ok", false},
+		{"alice: ok", false},
+		{"<two words> ok", false},
+		{"ok then", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := f.IsEcho("#irc", tt.content); got != tt.want {
+			t.Errorf("IsEcho(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+
+	if f.IsEcho("#other", "ok") {
+		t.Error("message sent to another channel was an echo")
+	}
+}
+
+func TestEchoFilterWindow(t *testing.T) {
+	if newEchoFilter(0).IsEcho("#irc", "ok") {
+		t.Error("disabled filter found an echo")
+	}
+
+	f := newEchoFilter(time.Millisecond * 10)
+	f.Sent("#irc", "ok")
+	time.Sleep(time.Millisecond * 20)
+
+	if f.IsEcho("#irc", "ok") {
+		t.Error("message sent before the window was an echo")
+	}
+}
+
+func TestEchoNicks(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.EchoWindow = time.Minute
+		conf.EchoNicks = []string{"*[m]"}
+	})
+
+	if !tb.isEchoNick("alice[m]") || !tb.isEchoNick("BOB[M]") {
+		t.Error("echo nicks were not matched")
+	}
+	if tb.isEchoNick("alice") {
+		t.Error("ordinary nick was an echo nick")
+	}
+}
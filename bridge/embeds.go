@@ -0,0 +1,50 @@
+package bridge
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
+)
+
+// embedDescriptionLength is the most of an embed's description sent to IRC
+const embedDescriptionLength = 300
+
+// embedLines flattens the embeds of a Discord message into lines for IRC:
+// the title and URL, then the description on one line, shortened if necessary.
+//
+// Only rich embeds (e.g from feed bots) are included. Other embeds are previews
+// of links in the message, which IRC clients can open themselves.
+func (b *Bridge) embedLines(embeds []*discordgo.MessageEmbed) []string {
+	lines := []string{}
+	for _, embed := range embeds {
+		if embed.Type != "" && embed.Type != discordgo.EmbedTypeRich {
+			continue
+		}
+
+		heading := strings.Join(strings.Fields(embed.Title), " ")
+		if embed.URL != "" {
+			if heading != "" {
+				heading += " - "
+			}
+			heading += embed.URL
+		}
+		if heading != "" {
+			lines = append(lines, heading)
+		}
+
+		description := strings.Join(strings.Fields(embed.Description), " ")
+		if utf8.RuneCountInString(description) > embedDescriptionLength {
+			description = string([]rune(description)[:embedDescriptionLength-1]) + "…"
+		}
+
+		if description != "" {
+			if b.Config.DiscordFormatting {
+				description = ircf.MarkdownToIRC(description)
+			}
+			lines = append(lines, description)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,375 @@
+package bridge
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/transmitter"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+const (
+	testGuildID   = "100000000000000001"
+	testChannelID = "200000000000000001"
+	testBotID     = "300000000000000001"
+)
+
+// testTimeout is how long tests wait for the bridge to do something
+var testTimeout = time.Second * 5
+
+// errNotFound is what Discord says about things that don't exist
+var errNotFound = &discordgo.RESTError{
+	Response: &http.Response{StatusCode: http.StatusNotFound},
+}
+
+// fakeDiscord is a discordSession that knows about the members and channels
+// it is given, and says everything else doesn't exist.
+type fakeDiscord struct {
+	sync.Mutex
+	members  map[string]*discordgo.Member // keyed by guild and user ID
+	channels map[string]*discordgo.Channel
+
+	// sent contains the messages sent with ChannelMessageSend
+	sent chan string
+}
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		members:  make(map[string]*discordgo.Member),
+		channels: make(map[string]*discordgo.Channel),
+		sent:     make(chan string, 100),
+	}
+}
+
+func (f *fakeDiscord) addMember(guildID string, member *discordgo.Member) {
+	f.Lock()
+	defer f.Unlock()
+	f.members[guildID+" "+member.User.ID] = member
+}
+
+func (f *fakeDiscord) addChannel(channel *discordgo.Channel) {
+	f.Lock()
+	defer f.Unlock()
+	f.channels[channel.ID] = channel
+}
+
+func (f *fakeDiscord) AddHandler(handler interface{}) func() { return func() {} }
+
+func (f *fakeDiscord) UpdateStatusComplex(usd discordgo.UpdateStatusData) error { return nil }
+
+func (f *fakeDiscord) RequestGuildMembers(guildID, query string, limit int, nonce string, presences bool) error {
+	return nil
+}
+
+func (f *fakeDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if channel, ok := f.channels[channelID]; ok {
+		copy := *channel
+		return &copy, nil
+	}
+	return nil, errNotFound
+}
+
+func (f *fakeDiscord) ChannelEdit(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return f.Channel(channelID)
+}
+
+func (f *fakeDiscord) ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return nil, errNotFound
+}
+
+func (f *fakeDiscord) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.sent <- content
+	return &discordgo.Message{ChannelID: channelID, Content: content}, nil
+}
+
+func (f *fakeDiscord) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: "dm-" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (f *fakeDiscord) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if member, ok := f.members[guildID+" "+userID]; ok {
+		copy := *member
+		return &copy, nil
+	}
+	return nil, errNotFound
+}
+
+func (f *fakeDiscord) GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	return nil, nil
+}
+
+func (f *fakeDiscord) GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	return nil, nil
+}
+
+func (f *fakeDiscord) ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) (*discordgo.ApplicationCommand, error) {
+	return cmd, nil
+}
+
+// webhookMessage is a message sent with a webhook
+type webhookMessage struct {
+	channel string
+	params  discordgo.WebhookParams
+}
+
+// fakeWebhooks is a transmitter.Session that creates webhooks and remembers what they sent.
+type fakeWebhooks struct {
+	sync.Mutex
+	hooks map[string]*discordgo.Webhook
+
+	// fail, if set, is returned by WebhookExecute
+	fail error
+
+	messages chan webhookMessage
+}
+
+func newFakeWebhooks() *fakeWebhooks {
+	return &fakeWebhooks{
+		hooks:    make(map[string]*discordgo.Webhook),
+		messages: make(chan webhookMessage, 100),
+	}
+}
+
+func (f *fakeWebhooks) GuildWebhooks(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error) {
+	return nil, nil
+}
+
+func (f *fakeWebhooks) WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	wh := &discordgo.Webhook{
+		ID:        fmt.Sprintf("40000000000000000%d", len(f.hooks)),
+		Token:     "token",
+		Name:      name,
+		ChannelID: channelID,
+	}
+	f.hooks[wh.ID] = wh
+
+	copy := *wh
+	return &copy, nil
+}
+
+func (f *fakeWebhooks) WebhookEdit(webhookID, name, avatar, channelID string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	wh, ok := f.hooks[webhookID]
+	if !ok {
+		return nil, errNotFound
+	}
+	wh.ChannelID = channelID
+
+	copy := *wh
+	return &copy, nil
+}
+
+func (f *fakeWebhooks) WebhookDelete(webhookID string, options ...discordgo.RequestOption) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.hooks, webhookID)
+	return nil
+}
+
+func (f *fakeWebhooks) WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.Lock()
+	wh, ok := f.hooks[webhookID]
+	fail := f.fail
+	f.Unlock()
+
+	if !ok {
+		return nil, errNotFound
+	}
+	if fail != nil {
+		return nil, fail
+	}
+
+	f.messages <- webhookMessage{channel: wh.ChannelID, params: *data}
+	return &discordgo.Message{ChannelID: wh.ChannelID, Content: data.Content}, nil
+}
+
+// next returns the next message sent with a webhook.
+func (f *fakeWebhooks) next(t *testing.T) webhookMessage {
+	t.Helper()
+
+	select {
+	case msg := <-f.messages:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no message was sent to discord")
+		return webhookMessage{}
+	}
+}
+
+// fakeIRC is an ircWriter that remembers what would have been sent, as raw IRC lines.
+type fakeIRC struct {
+	lines chan string
+}
+
+func newFakeIRC() *fakeIRC {
+	return &fakeIRC{lines: make(chan string, 100)}
+}
+
+func (f *fakeIRC) Privmsg(target, message string) {
+	f.lines <- "PRIVMSG " + target + " :" + message
+}
+
+func (f *fakeIRC) Notice(target, message string) {
+	f.lines <- "NOTICE " + target + " :" + message
+}
+
+func (f *fakeIRC) Action(target, message string) {
+	f.lines <- "PRIVMSG " + target + " :\x01ACTION " + message + "\x01"
+}
+
+func (f *fakeIRC) Join(channel string) {
+	f.lines <- "JOIN " + channel
+}
+
+func (f *fakeIRC) Nick(n string) {
+	f.lines <- "NICK " + n
+}
+
+func (f *fakeIRC) SendRaw(message string) {
+	f.lines <- message
+}
+
+// next returns the next line sent to IRC.
+func (f *fakeIRC) next(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case line := <-f.lines:
+		return line
+	case <-time.After(testTimeout):
+		t.Fatal("nothing was sent to irc")
+		return ""
+	}
+}
+
+// none checks nothing else is sent to IRC for a little while.
+func (f *fakeIRC) none(t *testing.T) {
+	t.Helper()
+
+	select {
+	case line := <-f.lines:
+		t.Fatalf("unexpected line sent to irc: %q", line)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// testBridge is a Bridge that uses fakes instead of connecting to Discord and IRC.
+type testBridge struct {
+	*Bridge
+	discord  *fakeDiscord
+	webhooks *fakeWebhooks
+	irc      *fakeIRC
+}
+
+// newTestBridge returns a bridge between #irc and testChannelID in testGuildID,
+// changing the config with configure first, if given.
+func newTestBridge(t *testing.T, configure func(*Config)) *testBridge {
+	t.Helper()
+
+	conf := &Config{
+		DiscordBotToken: "aaaa.bbbb.cccc",
+		GuildID:         testGuildID,
+		ChannelMappings: map[string]string{"#irc": testChannelID},
+		IRCServer:       "irc.example.org:6697",
+		IRCListenerName: "bridge",
+		WebhookPrefix:   "bridge",
+		SimpleMode:      true,
+	}
+	if configure != nil {
+		configure(conf)
+	}
+
+	b, err := New(conf)
+	if err != nil {
+		t.Fatalf("could not create bridge: %s", err)
+	}
+	t.Cleanup(func() {
+		b.done <- true
+		<-b.done
+	})
+
+	tb := &testBridge{
+		Bridge:   b,
+		discord:  newFakeDiscord(),
+		webhooks: newFakeWebhooks(),
+		irc:      newFakeIRC(),
+	}
+
+	b.discord.discordSession = tb.discord
+	b.discord.State.User = &discordgo.User{ID: testBotID, Username: "bridge", Bot: true}
+	b.discord.State.GuildAdd(&discordgo.Guild{
+		ID: testGuildID,
+		Channels: []*discordgo.Channel{
+			{ID: testChannelID, GuildID: testGuildID, Name: "general", Type: discordgo.ChannelTypeGuildText},
+		},
+	})
+
+	tm, err := transmitter.New(tb.webhooks, testGuildID, conf.WebhookPrefix, 10, 1, transmitter.RateLimit{Messages: 1000, Interval: time.Second}, true)
+	if err != nil {
+		t.Fatalf("could not create transmitter: %s", err)
+	}
+	b.discord.transmitters[testGuildID] = tm
+
+	b.ircListener.writer = tb.irc
+	b.ircListener.state.setConnected(true)
+
+	return tb
+}
+
+// addUser adds a member to the guild, as if Discord had told us about them.
+func (tb *testBridge) addUser(id, username, nick string) *discordgo.User {
+	user := &discordgo.User{ID: id, Username: username, Discriminator: "0"}
+	member := &discordgo.Member{GuildID: testGuildID, User: user, Nick: nick}
+	tb.Bridge.discord.State.MemberAdd(member)
+	tb.discord.addMember(testGuildID, member)
+	return user
+}
+
+// addPuppet gives the Discord user an IRC connection, as if they had connected with the nick.
+func (tb *testBridge) addPuppet(user DiscordUser, nick string, channels ...string) (*ircConnection, *fakeIRC) {
+	writer := newFakeIRC()
+	con := &ircConnection{
+		innerCon: irc.IRC(nick, "discord"),
+		writer:   writer,
+
+		discord:  user,
+		nick:     nick,
+		baseNick: nick,
+
+		messages:   make(chan IRCMessage),
+		lastActive: time.Now(),
+
+		manager: tb.ircManager,
+
+		pmNoticedSenders: make(map[string]struct{}),
+		channels:         make(map[string]struct{}),
+	}
+	con.state.throttle = tb.newIRCThrottle()
+	con.state.setConnected(true)
+
+	for _, channel := range channels {
+		con.channels[channel] = struct{}{}
+	}
+
+	tb.ircManager.connectionsMu.Lock()
+	tb.ircManager.ircConnections[user.ID] = con
+	tb.ircManager.connectionsMu.Unlock()
+	tb.ircManager.nicks.Set(user, nick)
+
+	return con, writer
+}
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// floodGuard limits how many messages each sender can have bridged every interval.
+type floodGuard struct {
+	sync.Mutex
+	limit    int
+	interval time.Duration
+
+	windows map[string]*floodWindow
+}
+
+// floodWindow counts the messages from a sender during the current interval
+type floodWindow struct {
+	count   int
+	dropped int
+}
+
+// newFloodGuard returns a guard allowing limit messages every interval.
+// If limit is zero or less, all messages are allowed.
+func newFloodGuard(limit int, interval time.Duration) *floodGuard {
+	return &floodGuard{
+		limit:    limit,
+		interval: interval,
+		windows:  make(map[string]*floodWindow),
+	}
+}
+
+// Allow returns false if the sender identified by key has sent too many messages.
+//
+// At the end of an interval in which messages were dropped, summary is called
+// (in a new goroutine) with the number dropped. Only the summary given with the
+// first message of each interval is used, and it may be nil.
+func (f *floodGuard) Allow(key string, summary func(dropped int)) bool {
+	if f.limit <= 0 {
+		return true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	w, ok := f.windows[key]
+	if !ok {
+		w = &floodWindow{}
+		f.windows[key] = w
+
+		time.AfterFunc(f.interval, func() {
+			f.Lock()
+			delete(f.windows, key)
+			dropped := w.dropped
+			f.Unlock()
+
+			if dropped > 0 && summary != nil {
+				summary(dropped)
+			}
+		})
+	}
+
+	w.count++
+	if w.count > f.limit {
+		w.dropped++
+		return false
+	}
+	return true
+}
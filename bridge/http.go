@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bridgeStats are updated as messages pass through the bridge, for the status endpoint
+type bridgeStats struct {
+	// Unix nanoseconds of the last message bridged in each direction, or zero
+	lastToDiscord int64
+	lastToIRC     int64
+}
+
+func (s *bridgeStats) messageToDiscord() {
+	atomic.StoreInt64(&s.lastToDiscord, time.Now().UnixNano())
+}
+
+func (s *bridgeStats) messageToIRC() {
+	atomic.StoreInt64(&s.lastToIRC, time.Now().UnixNano())
+}
+
+// bridgeStatus is the response of the /status endpoint
+type bridgeStatus struct {
+	DiscordConnected      bool       `json:"discord_connected"`
+	DiscordReconnects     int        `json:"discord_reconnects"`
+	DiscordDisconnectedAt *time.Time `json:"discord_disconnected_at,omitempty"`
+	DiscordMembersLoaded  bool       `json:"discord_members_loaded"`
+	IRCListenerConnected  bool       `json:"irc_listener_connected"`
+	IRCListenerReconnects int        `json:"irc_listener_reconnects"`
+	IRCListenerLastError  string     `json:"irc_listener_last_error,omitempty"`
+	IRCConnections        int        `json:"irc_connections"`
+	PuppetLimitHits       int64      `json:"puppet_limit_hits"`
+	LastMessageToDiscord  *time.Time `json:"last_message_to_discord"`
+	LastMessageToIRC      *time.Time `json:"last_message_to_irc"`
+
+	// DiscordMembersLoading are the guilds whose members haven't all arrived since connecting
+	DiscordMembersLoading []string `json:"discord_members_loading,omitempty"`
+
+	// DeliveryFailures are the Discord channels the latest messages couldn't be sent to
+	DeliveryFailures []ChannelDeliveryFailure `json:"delivery_failures"`
+}
+
+func (b *Bridge) status() bridgeStatus {
+	lastMessage := func(nanos *int64) *time.Time {
+		if n := atomic.LoadInt64(nanos); n != 0 {
+			t := time.Unix(0, n).UTC()
+			return &t
+		}
+		return nil
+	}
+
+	b.discord.session.RLock()
+	discordConnected := b.discord.session.DataReady
+	b.discord.session.RUnlock()
+	discordDisconnectedAt, discordReconnects := b.discord.disconnectedSince()
+	membersLoading := b.discord.membersLoading()
+
+	listener := &b.ircListener.state.stats
+	listener.Lock()
+	reconnects, lastError := listener.reconnects, listener.lastError
+	listener.Unlock()
+
+	return bridgeStatus{
+		DiscordConnected:      discordConnected,
+		DiscordReconnects:     discordReconnects,
+		DiscordDisconnectedAt: discordDisconnectedAt,
+		DiscordMembersLoaded:  len(membersLoading) == 0,
+		DiscordMembersLoading: membersLoading,
+		IRCListenerConnected:  b.ircListener.state.Connected(),
+		IRCListenerReconnects: reconnects,
+		IRCListenerLastError:  lastError,
+		IRCConnections:        b.ircManager.ConnectionCount(),
+		PuppetLimitHits:       b.ircManager.PuppetLimitHits(),
+		LastMessageToDiscord:  lastMessage(&b.stats.lastToDiscord),
+		LastMessageToIRC:      lastMessage(&b.stats.lastToIRC),
+		DeliveryFailures:      b.deliveryFailures.List(),
+	}
+}
+
+// newHTTPServer returns the server for the /healthz and /status endpoints.
+//
+// /healthz returns 200 only when connected to both Discord and IRC, or 503 otherwise.
+// /connections lists the IRC connections made for Discord users, see ListConnections.
+// /avatars/ serves identicons for AvatarSourceLocal.
+func (b *Bridge) newHTTPServer() *http.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := b.status()
+		if !status.DiscordConnected || !status.IRCListenerConnected {
+			http.Error(w, "not connected", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(b.status()); err != nil {
+			log.WithField("error", err).Errorln("could not write status")
+		}
+	})
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(b.ListConnections()); err != nil {
+			log.WithField("error", err).Errorln("could not write connections")
+		}
+	})
+
+	mux.HandleFunc("/avatars/", func(w http.ResponseWriter, r *http.Request) {
+		if avatars, ok := b.avatars.(*localAvatars); ok {
+			avatars.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	return &http.Server{
+		Addr:    b.Config.HTTPAddr,
+		Handler: mux,
+	}
+}
@@ -3,6 +3,7 @@ package bridge
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	irc "github.com/qaisjp/go-ircevent"
@@ -14,14 +15,33 @@ import (
 type ircConnection struct {
 	innerCon *irc.Connection
 
+	// writer is what messages are written to, which is innerCon except in tests
+	writer ircWriter
+
 	discord DiscordUser
-	nick    string
+	nick    string // the nick we currently have, or are trying to get
+
+	// baseNick is the nick assigned by the manager, before any collision handling
+	baseNick string
 
 	messages      chan IRCMessage
 	cooldownTimer *time.Timer
 
+	// lastActive is when we last sent a message for them, or were created, see connectWaiting
+	lastActive time.Time
+
 	manager *IRCManager
 
+	state         ircConnState
+	startMessages sync.Once
+
+	// channels are the IRC channels we have joined, for ListConnections
+	channels   map[string]struct{}
+	channelsMu sync.Mutex
+
+	// nickAttempts is the number of times our nick has been rejected as in use
+	nickAttempts int
+
 	// channel ID for their discord channel for PMs
 	pmDiscordChannel string
 
@@ -31,25 +51,74 @@ type ircConnection struct {
 }
 
 func (i *ircConnection) OnWelcome(e *irc.Event) {
+	i.state.setConnected(true)
+
+	// This is the nick the server actually gave us
+	i.nick = e.Arguments[0]
+	i.nickAttempts = 0
+
+	// We've reconnected, so we're in no channels until they are joined again
+	i.channelsMu.Lock()
+	i.channels = make(map[string]struct{})
+	i.channelsMu.Unlock()
+
 	i.JoinChannels()
-	i.innerCon.SendRawf("MODE %s +D", i.innerCon.GetNick())
+	i.writer.SendRaw(fmt.Sprintf("MODE %s +D", i.innerCon.GetNick()))
+
+	// We get welcomed again after reconnecting, but only want one sender
+	i.startMessages.Do(func() {
+		go i.sendMessages()
+	})
+}
 
-	go func(i *ircConnection) {
-		for m := range i.messages {
+// sendMessages sends messages to IRC until the connection is closed.
+// Messages are dropped whilst disconnected, rather than blocking.
+func (i *ircConnection) sendMessages() {
+	for m := range i.messages {
+		m := m
+		sent := i.state.send(func() {
 			if m.IsAction {
-				i.innerCon.Action(m.IRCChannel, m.Message)
+				i.writer.Action(m.IRCChannel, m.Message)
 			} else {
 				if !strings.HasPrefix(m.IRCChannel, "#") {
 					i.experimentalNotice(m.IRCChannel)
 				}
-				i.innerCon.Privmsg(m.IRCChannel, m.Message)
+				i.writer.Privmsg(m.IRCChannel, m.Message)
 			}
+		})
+
+		if sent {
+			i.state.stats.recordSent(m.Message)
+		} else {
+			log.WithField("nick", i.nick).Warnln("Dropped IRC message because the connection is down")
 		}
-	}(i)
+	}
+}
+
+// SendRaw sends a raw line, dropping it if disconnected.
+func (i *ircConnection) SendRaw(message string) {
+	i.state.send(func() { i.writer.SendRaw(message) })
+}
+
+// OnNickInUse tries the next numbered nick when ours is taken, e.g "alice~d" becomes "alice2~d".
+//
+// This replaces go-ircevent's handler, which adds underscores until it fits.
+func (i *ircConnection) OnNickInUse(e *irc.Event) {
+	i.nickAttempts++
+	i.state.stats.recordError(fmt.Sprintf("%s: nick %s is unavailable", e.Code, e.Arguments[1]))
+
+	nick := numberedNickname(i.baseNick, i.manager.bridge.nickPrefix, i.manager.bridge.nickSuffix, i.nickAttempts+1)
+	log.WithFields(log.Fields{
+		"rejected": e.Arguments[1],
+		"nick":     nick,
+	}).Infoln("IRC nick in use, trying another")
+
+	i.nick = nick
+	i.writer.Nick(nick)
 }
 
 func (i *ircConnection) JoinChannels() {
-	i.innerCon.SendRaw(i.manager.bridge.GetJoinCommand())
+	i.SendRaw(i.manager.bridge.GetJoinCommand())
 }
 
 func (i *ircConnection) UpdateDetails(discord DiscordUser) {
@@ -70,11 +139,43 @@ func (i *ircConnection) UpdateDetails(discord DiscordUser) {
 		return
 	}
 
+	oldName := i.discord.Nick
 	i.discord = discord
-	i.nick = i.manager.generateNickname(i.discord)
-	i.innerCon.RealName = discord.Username
+	i.innerCon.RealName = realName(discord)
+
+	// Their new name might still give them the same nick
+	baseNick := i.manager.assignNickname(i.discord)
+	if baseNick == i.baseNick {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"old": i.nick,
+		"new": baseNick,
+	}).Infoln("Renaming IRC connection after Discord nick change")
 
-	go i.innerCon.Nick(i.nick)
+	// Collisions are handled by OnNickInUse, which works from baseNick
+	i.baseNick = baseNick
+	i.nick = baseNick
+	i.nickAttempts = 0
+
+	go i.state.send(func() { i.writer.Nick(baseNick) })
+
+	// Some clients hide nick changes, so say who they are now in their channels
+	if i.manager.bridge.Config.IRCRenameNotices && oldName != discord.Nick {
+		notice := fmt.Sprintf("%s is now known as %s", oldName, discord.Nick)
+
+		i.channelsMu.Lock()
+		channels := make([]string, 0, len(i.channels))
+		for channel := range i.channels {
+			channels = append(channels, channel)
+		}
+		i.channelsMu.Unlock()
+
+		for _, channel := range channels {
+			i.manager.bridge.ircListener.Notice(channel, notice)
+		}
+	}
 }
 
 func (i *ircConnection) experimentalNotice(nick string) {
@@ -102,7 +203,7 @@ func (i *ircConnection) experimentalNotice(nick string) {
 	nick = strings.ToLower(nick)
 	if _, ok := i.pmNoticedSenders[nick]; !ok {
 		i.pmNoticedSenders[nick] = struct{}{}
-		i.innerCon.Privmsg(nick, "Private messaging is still in dev. Proceed with caution.")
+		i.writer.Privmsg(nick, "Private messaging is still in dev. Proceed with caution.")
 	}
 }
 
@@ -110,9 +211,9 @@ func (i *ircConnection) OnPrivateMessage(e *irc.Event) {
 	// Alert private messages
 	if string(e.Arguments[0][0]) != "#" {
 		if e.Message() == "help" {
-			i.innerCon.Privmsg(e.Nick, "Commands: help, who")
+			i.writer.Privmsg(e.Nick, "Commands: help, who")
 		} else if e.Message() == "who" {
-			i.innerCon.Privmsgf(e.Nick, "I am: %s#%s with ID %s", i.discord.Nick, i.discord.Discriminator, i.discord.ID)
+			i.writer.Privmsg(e.Nick, fmt.Sprintf("I am: %s#%s with ID %s", i.discord.Nick, i.discord.Discriminator, i.discord.ID))
 		} else {
 			// i.innerCon.Privmsg(e.Nick, "Private messaging Discord users is not supported, but I support commands! Type 'help'.")
 		}
@@ -135,5 +236,5 @@ func (i *ircConnection) OnPrivateMessage(e *irc.Event) {
 }
 
 func (i *ircConnection) SetAway(status string) {
-	i.innerCon.SendRawf("AWAY :%s", status)
+	i.SendRaw("AWAY :" + status)
 }
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// renameBridge returns a bridge where alice, called Ally, has a puppet in #irc.
+func renameBridge(t *testing.T) (*testBridge, *discordgo.Member, *fakeIRC) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.SimpleMode = false
+		conf.Suffix = "~d"
+		conf.IRCRenameNotices = true
+	})
+
+	user := tb.addUser("500000000000000001", "alice", "Ally")
+	tb.Bridge.discord.State.PresenceAdd(testGuildID, &discordgo.Presence{User: user, Status: discordgo.StatusOnline})
+
+	_, puppet := tb.addPuppet(DiscordUser{
+		ID:            user.ID,
+		Username:      user.Username,
+		Discriminator: "0",
+		Nick:          "Ally",
+		Online:        true,
+	}, "Ally~d", "#irc")
+
+	member, err := tb.Bridge.discord.State.Member(testGuildID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tb, member, puppet
+}
+
+func TestNickChangeRenamesPuppet(t *testing.T) {
+	tb, member, puppet := renameBridge(t)
+
+	before := *member
+	member.Nick = "Alicia"
+	tb.Bridge.discord.onMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: member, BeforeUpdate: &before})
+
+	if got := puppet.next(t); got != "NICK Alicia~d" {
+		t.Errorf("puppet sent %q, want NICK Alicia~d", got)
+	}
+	if got, want := tb.irc.next(t), "NOTICE #irc :Ally is now known as Alicia"; got != want {
+		t.Errorf("listener sent %q, want %q", got, want)
+	}
+}
+
+func TestNickChangeKeepingNick(t *testing.T) {
+	tb, member, puppet := renameBridge(t)
+
+	// A presence update for someone whose name hasn't changed
+	tb.Bridge.discord.onMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: member})
+
+	// Their nick sanitises to the same as before
+	before := *member
+	member.Nick = "Allÿ"
+	tb.Bridge.discord.onMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: member, BeforeUpdate: &before})
+
+	// Nothing is sent for either, so the next thing sent is for a real change
+	before = *member
+	member.Nick = "Alicia"
+	tb.Bridge.discord.onMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: member, BeforeUpdate: &before})
+
+	if got := puppet.next(t); got != "NICK Alicia~d" {
+		t.Errorf("puppet sent %q, want NICK Alicia~d", got)
+	}
+	if got, want := tb.irc.next(t), "NOTICE #irc :Allÿ is now known as Alicia"; got != want {
+		t.Errorf("listener sent %q, want %q", got, want)
+	}
+}
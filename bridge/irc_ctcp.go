@@ -0,0 +1,45 @@
+package bridge
+
+import (
+	"strings"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// setupCTCP replaces go-ircevent's CTCP replies with ones that use Config.CTCPVersion,
+// and only answer CTCPs sent directly to the connection.
+//
+// Otherwise a single CTCP sent to a channel would have every one of our
+// connections in it reply at once, which servers may see as flooding.
+func (b *Bridge) setupCTCP(con *irc.Connection) {
+	replies := map[string]func(e *irc.Event) string{
+		"CTCP_VERSION": func(e *irc.Event) string {
+			return "VERSION " + b.Config.CTCPVersion
+		},
+		"CTCP_PING": func(e *irc.Event) string {
+			// The message is the PING and its payload, which is echoed back
+			return e.Message()
+		},
+		"CTCP_TIME": func(e *irc.Event) string {
+			return "TIME " + time.Now().Format(time.RFC1123Z)
+		},
+		"CTCP_CLIENTINFO": func(e *irc.Event) string {
+			return "CLIENTINFO PING VERSION TIME CLIENTINFO"
+		},
+	}
+
+	// USERINFO would only say "discord"
+	con.ClearCallback("CTCP_USERINFO")
+
+	for code, reply := range replies {
+		reply := reply
+		con.ClearCallback(code)
+		con.AddCallback(code, func(e *irc.Event) {
+			if len(e.Arguments) == 0 || !strings.EqualFold(e.Arguments[0], con.GetNick()) {
+				return
+			}
+			con.SendRawf("NOTICE %s :\x01%s\x01", e.Nick, reply(e))
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// joinPartDebounce is how long to wait before relaying a join or part.
+// If the user does the opposite within this window, nothing is relayed.
+var joinPartDebounce = time.Second * 30
+
+// joinPartRelay tracks who is in each IRC channel, and relays joins and parts to Discord.
+//
+// Notices are debounced so that quick reconnects and netsplits don't spam Discord.
+type joinPartRelay struct {
+	sync.Mutex
+	listener *ircListener
+
+	// members contains each nick and the channels they are in, keyed by lowercase nick.
+	// We track this ourselves because go-ircevent's nick tracker runs
+	// concurrently with our callbacks, so it may have already forgotten a QUIT user.
+	members map[string]*ircMember
+
+	// pending notices, keyed by nick and channel
+	pending map[string]*time.Timer
+}
+
+// ircMember is someone in one of our IRC channels
+type ircMember struct {
+	Nick string
+
+	// Channels maps each lowercase channel name to its real name
+	Channels map[string]string
+}
+
+func newJoinPartRelay(listener *ircListener) *joinPartRelay {
+	r := &joinPartRelay{
+		listener: listener,
+		members:  make(map[string]*ircMember),
+		pending:  make(map[string]*time.Timer),
+	}
+
+	listener.AddCallback("353", r.OnNames)
+	listener.AddCallback("JOIN", r.OnJoin)
+	listener.AddCallback("PART", r.OnPart)
+	listener.AddCallback("KICK", r.OnKick)
+	listener.AddCallback("QUIT", r.OnQuit)
+	listener.AddCallback("NICK", r.OnNick)
+
+	return r
+}
+
+// shouldIgnore returns true for the listener, our own puppets and ignored nicks.
+func (r *joinPartRelay) shouldIgnore(nick string) bool {
+	if nick == r.listener.GetNick() || r.listener.bridge.isIgnoredIRCNick(nick) {
+		return true
+	}
+
+	return r.listener.bridge.isPuppetNick(nick)
+}
+
+func (r *joinPartRelay) OnNames(e *irc.Event) {
+	channel := e.Arguments[2]
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, nick := range strings.Fields(e.Message()) {
+		r.add(strings.TrimLeft(nick, "~&@%+"), channel)
+	}
+}
+
+func (r *joinPartRelay) OnJoin(e *irc.Event) {
+	if r.shouldIgnore(e.Nick) {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	channel := e.Arguments[0]
+	r.add(e.Nick, channel)
+	r.schedule(e.Nick, channel, fmt.Sprintf("%s has joined %s", e.Nick, channel))
+}
+
+func (r *joinPartRelay) OnPart(e *irc.Event) {
+	if r.shouldIgnore(e.Nick) {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	channel := e.Arguments[0]
+	r.remove(e.Nick, channel)
+	r.schedule(e.Nick, channel, fmt.Sprintf("%s has left %s", e.Nick, channel))
+}
+
+func (r *joinPartRelay) OnKick(e *irc.Event) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.remove(e.Arguments[1], e.Arguments[0])
+}
+
+func (r *joinPartRelay) OnQuit(e *irc.Event) {
+	if r.shouldIgnore(e.Nick) {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	key := strings.ToLower(e.Nick)
+	if member, ok := r.members[key]; ok {
+		for _, channel := range member.Channels {
+			r.schedule(e.Nick, channel, fmt.Sprintf("%s has quit (%s)", e.Nick, e.Message()))
+		}
+	}
+	delete(r.members, key)
+}
+
+func (r *joinPartRelay) OnNick(e *irc.Event) {
+	r.Lock()
+	defer r.Unlock()
+
+	oldKey := strings.ToLower(e.Nick)
+	if member, ok := r.members[oldKey]; ok {
+		delete(r.members, oldKey)
+		member.Nick = e.Message()
+		r.members[strings.ToLower(member.Nick)] = member
+	}
+}
+
+// Nicks returns the nicks of everyone in the channel, excluding the bridge itself, sorted.
+func (r *joinPartRelay) Nicks(channel string) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	channel = strings.ToLower(channel)
+	nicks := []string{}
+	for _, member := range r.members {
+		if _, ok := member.Channels[channel]; ok && !r.shouldIgnore(member.Nick) {
+			nicks = append(nicks, member.Nick)
+		}
+	}
+
+	sort.Slice(nicks, func(i, j int) bool {
+		return strings.ToLower(nicks[i]) < strings.ToLower(nicks[j])
+	})
+	return nicks
+}
+
+func (r *joinPartRelay) add(nick, channel string) {
+	key := strings.ToLower(nick)
+	if _, ok := r.members[key]; !ok {
+		r.members[key] = &ircMember{
+			Nick:     nick,
+			Channels: make(map[string]string),
+		}
+	}
+	r.members[key].Channels[strings.ToLower(channel)] = channel
+}
+
+func (r *joinPartRelay) remove(nick, channel string) {
+	key := strings.ToLower(nick)
+	if member, ok := r.members[key]; ok {
+		delete(member.Channels, strings.ToLower(channel))
+		if len(member.Channels) == 0 {
+			delete(r.members, key)
+		}
+	}
+}
+
+// schedule relays the notice after joinPartDebounce, unless a notice for the
+// same nick and channel is already pending, in which case they cancel out.
+//
+// Must be called with the lock held.
+func (r *joinPartRelay) schedule(nick, channel, notice string) {
+	if !r.listener.bridge.Config.RelayJoinsParts {
+		return
+	}
+
+	key := strings.ToLower(nick) + " " + strings.ToLower(channel)
+	if timer, ok := r.pending[key]; ok {
+		timer.Stop()
+		delete(r.pending, key)
+		return
+	}
+
+	r.pending[key] = time.AfterFunc(joinPartDebounce, func() {
+		r.Lock()
+		delete(r.pending, key)
+		r.Unlock()
+
+		r.send(channel, notice)
+	})
+}
+
+func (r *joinPartRelay) send(channel, notice string) {
+	for _, mapping := range r.listener.bridge.GetMappingsByIRC(channel) {
+		if !mapping.ToDiscord() {
+			continue
+		}
+
+		_, err := r.listener.bridge.discord.ChannelMessageSend(mapping.DiscordChannel, notice)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"channel": mapping.DiscordChannel,
+			}).Errorln("could not relay join/part to discord")
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// whoisTimeout is how long to wait for the server to answer a WHOIS.
+var whoisTimeout = time.Second * 30
+
+// ircLinks works out which IRC users have linked a Discord account, see accountLinks.
+//
+// Nicks aren't proof of who someone is, so we ask the server which account each
+// user is identified as with WHOIS, when they link and when they join our channels.
+type ircLinks struct {
+	sync.Mutex
+	listener *ircListener
+
+	// verified maps the lowercase nick of each user known to be identified
+	// as a linked account to that account
+	verified map[string]string
+
+	// channels contains the lowercase channels each user is in with us, keyed by
+	// lowercase nick. We can't see someone quit once they share no channels with us,
+	// so they are no longer verified, and anyone could take their nick.
+	channels map[string]map[string]struct{}
+
+	// lookups are the WHOIS replies we are waiting for, keyed by lowercase nick
+	lookups map[string]*accountLookup
+}
+
+type accountLookup struct {
+	// account is from RPL_WHOISACCOUNT, and stays empty if they aren't identified
+	account string
+
+	done    []func(account string)
+	timeout *time.Timer
+}
+
+func newIRCLinks(listener *ircListener) *ircLinks {
+	l := &ircLinks{
+		listener: listener,
+		verified: make(map[string]string),
+		channels: make(map[string]map[string]struct{}),
+		lookups:  make(map[string]*accountLookup),
+	}
+
+	if !listener.bridge.links.Enabled() {
+		return l
+	}
+
+	// We may have missed people leaving whilst disconnected
+	listener.AddCallback("001", func(e *irc.Event) {
+		l.Lock()
+		l.verified = make(map[string]string)
+		l.channels = make(map[string]map[string]struct{})
+		l.Unlock()
+	})
+
+	listener.AddCallback("330", l.OnWhoisAccount)
+	listener.AddCallback("318", l.OnEndOfWhois)
+	listener.AddCallback("353", l.OnNames)
+	listener.AddCallback("JOIN", l.OnJoin)
+	listener.AddCallback("PART", l.OnPart)
+	listener.AddCallback("KICK", l.OnKick)
+	listener.AddCallback("NICK", l.OnNick)
+	listener.AddCallback("QUIT", l.OnQuit)
+
+	return l
+}
+
+// Linked returns the Discord user the nick has linked, if we know they are identified.
+func (l *ircLinks) Linked(nick string) (discordID string, ok bool) {
+	l.Lock()
+	account, ok := l.verified[strings.ToLower(nick)]
+	l.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	return l.listener.bridge.links.Get(account)
+}
+
+// Link links the nick's account to the Discord user given the code, replying privately.
+func (l *ircLinks) Link(nick, code string) {
+	links := l.listener.bridge.links
+	if _, ok := links.CodeUser(code); !ok {
+		l.listener.Privmsg(nick, "That code is not valid, it may have expired. Use /link on Discord to get a new one.")
+		return
+	}
+
+	l.lookup(nick, func(account string) {
+		if account == "" {
+			l.listener.Privmsg(nick, "You need to be identified with NickServ to link your account.")
+			return
+		}
+
+		if _, ok := links.Link(code, account, nick); !ok {
+			l.listener.Privmsg(nick, "That code is not valid, it may have expired. Use /link on Discord to get a new one.")
+			return
+		}
+
+		l.Lock()
+		if key := strings.ToLower(nick); len(l.channels[key]) > 0 {
+			l.verified[key] = account
+		}
+		l.Unlock()
+		l.listener.Privmsg(nick, "Your IRC account "+account+" is now linked to your Discord account.")
+	})
+}
+
+// Unlink unlinks the nick's account, replying privately.
+func (l *ircLinks) Unlink(nick string) {
+	l.lookup(nick, func(account string) {
+		if account == "" {
+			l.listener.Privmsg(nick, "You need to be identified with NickServ to unlink your account.")
+			return
+		}
+
+		if !l.listener.bridge.links.UnlinkAccount(account) {
+			l.listener.Privmsg(nick, "Your IRC account "+account+" is not linked to a Discord account.")
+			return
+		}
+		l.listener.Privmsg(nick, "Your IRC account "+account+" is no longer linked to a Discord account.")
+	})
+}
+
+// lookup asks the server which account the nick is identified as, calling done with
+// the answer, which is empty if they aren't identified or the server didn't say.
+// done may be nil if we only want to know if they are linked.
+func (l *ircLinks) lookup(nick string, done func(account string)) {
+	key := strings.ToLower(nick)
+
+	l.Lock()
+	lookup, waiting := l.lookups[key]
+	if !waiting {
+		lookup = &accountLookup{
+			timeout: time.AfterFunc(whoisTimeout, func() { l.finish(key) }),
+		}
+		l.lookups[key] = lookup
+	}
+
+	if done != nil {
+		lookup.done = append(lookup.done, done)
+	}
+	l.Unlock()
+
+	if !waiting {
+		l.listener.SendRaw("WHOIS " + nick)
+	}
+}
+
+// finish remembers whether the nick is linked, and answers everyone waiting for their account.
+func (l *ircLinks) finish(key string) {
+	l.Lock()
+	lookup, ok := l.lookups[key]
+	if !ok {
+		l.Unlock()
+		return
+	}
+	delete(l.lookups, key)
+	lookup.timeout.Stop()
+
+	if _, linked := l.listener.bridge.links.Get(lookup.account); lookup.account != "" && linked && len(l.channels[key]) > 0 {
+		l.verified[key] = lookup.account
+	} else {
+		delete(l.verified, key)
+	}
+	l.Unlock()
+
+	for _, done := range lookup.done {
+		done(lookup.account)
+	}
+}
+
+// verify looks up the nick if an account was linked from it, and we don't know who they are.
+func (l *ircLinks) verify(nick string) {
+	if nick == l.listener.GetNick() || l.listener.bridge.isPuppetNick(nick) {
+		return
+	}
+
+	l.Lock()
+	_, ok := l.verified[strings.ToLower(nick)]
+	l.Unlock()
+
+	if !ok && l.listener.bridge.links.HasNick(nick) {
+		l.lookup(nick, nil)
+	}
+}
+
+// OnWhoisAccount handles RPL_WHOISACCOUNT, e.g ":server 330 listener alice alice_account :is logged in as"
+func (l *ircLinks) OnWhoisAccount(e *irc.Event) {
+	if len(e.Arguments) < 3 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if lookup, ok := l.lookups[strings.ToLower(e.Arguments[1])]; ok {
+		lookup.account = e.Arguments[2]
+	}
+}
+
+// OnEndOfWhois handles RPL_ENDOFWHOIS, which is also sent if the nick doesn't exist.
+func (l *ircLinks) OnEndOfWhois(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	l.finish(strings.ToLower(e.Arguments[1]))
+}
+
+func (l *ircLinks) OnNames(e *irc.Event) {
+	if len(e.Arguments) < 3 {
+		return
+	}
+
+	for _, name := range strings.Fields(e.Message()) {
+		nick := strings.TrimLeft(name, "~&@%+")
+		l.join(nick, e.Arguments[2])
+		l.verify(nick)
+	}
+}
+
+func (l *ircLinks) OnJoin(e *irc.Event) {
+	l.join(e.Nick, e.Arguments[0])
+	l.verify(e.Nick)
+}
+
+func (l *ircLinks) OnPart(e *irc.Event) {
+	l.leave(e.Nick, e.Arguments[0])
+}
+
+func (l *ircLinks) OnKick(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	l.leave(e.Arguments[1], e.Arguments[0])
+}
+
+// OnNick keeps track of verified users, who stay identified when changing nick.
+// Anyone else taking a nick we thought was verified has to be looked up again.
+func (l *ircLinks) OnNick(e *irc.Event) {
+	l.Lock()
+	old, nick := strings.ToLower(e.Nick), strings.ToLower(e.Message())
+	account, ok := l.verified[old]
+	delete(l.verified, old)
+	delete(l.verified, nick)
+	if ok {
+		l.verified[nick] = account
+	}
+
+	if channels, ok := l.channels[old]; ok {
+		delete(l.channels, old)
+		l.channels[nick] = channels
+	}
+	l.Unlock()
+
+	if !ok {
+		l.verify(e.Message())
+	}
+}
+
+func (l *ircLinks) OnQuit(e *irc.Event) {
+	l.Lock()
+	delete(l.verified, strings.ToLower(e.Nick))
+	delete(l.channels, strings.ToLower(e.Nick))
+	l.Unlock()
+}
+
+// join remembers that the nick is in the channel. Users we didn't share a channel
+// with before may not be who we thought they were, so are no longer verified.
+func (l *ircLinks) join(nick, channel string) {
+	l.Lock()
+	defer l.Unlock()
+
+	key := strings.ToLower(nick)
+	if _, ok := l.channels[key]; !ok {
+		l.channels[key] = make(map[string]struct{})
+		delete(l.verified, key)
+	}
+	l.channels[key][strings.ToLower(channel)] = struct{}{}
+}
+
+// leave forgets that the nick is in the channel, and who they are if they are in
+// none of our channels. If the nick is the listener, everyone leaves the channel.
+func (l *ircLinks) leave(nick, channel string) {
+	l.Lock()
+	defer l.Unlock()
+
+	channel = strings.ToLower(channel)
+	if nick != l.listener.GetNick() {
+		l.leaveLocked(strings.ToLower(nick), channel)
+		return
+	}
+
+	for key := range l.channels {
+		l.leaveLocked(key, channel)
+	}
+}
+
+// leaveLocked must be called with the lock held.
+func (l *ircLinks) leaveLocked(key, channel string) {
+	channels := l.channels[key]
+	delete(channels, channel)
+	if len(channels) == 0 {
+		delete(l.channels, key)
+		delete(l.verified, key)
+	}
+}
+
+// linkedMember returns the guild member the IRC nick has linked, if any.
+func (b *Bridge) linkedMember(guildID, nick string) *discordgo.Member {
+	discordID, ok := b.ircListener.links.Linked(nick)
+	if !ok {
+		return nil
+	}
+
+	member, err := b.discord.member(guildID, discordID)
+	if err != nil || member.User == nil {
+		return nil
+	}
+	return member
+}
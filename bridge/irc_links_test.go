@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"path/filepath"
+	"testing"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// linkAlice links the IRC account alice_account, used from the nick alice, to a Discord user.
+func linkAlice(t *testing.T, tb *testBridge) string {
+	t.Helper()
+
+	discordID := "500000000000000001"
+	code, err := tb.links.NewCode(discordID)
+	if err != nil {
+		t.Fatalf("could not create link code: %s", err)
+	}
+	if _, ok := tb.links.Link(code, "alice_account", "alice"); !ok {
+		t.Fatal("could not link alice_account")
+	}
+	return discordID
+}
+
+// whois answers the WHOIS the listener should have sent for nick, as if they were identified as account.
+func whois(t *testing.T, tb *testBridge, nick, account string) {
+	t.Helper()
+
+	if got, want := tb.irc.next(t), "WHOIS "+nick; got != want {
+		t.Fatalf("sent %q to irc, want %q", got, want)
+	}
+
+	links := tb.ircListener.links
+	if account != "" {
+		links.OnWhoisAccount(&irc.Event{Code: "330", Arguments: []string{"bridge", nick, account, "is logged in as"}})
+	}
+	links.OnEndOfWhois(&irc.Event{Code: "318", Arguments: []string{"bridge", nick, "End of /WHOIS list."}})
+}
+
+func TestLinkedNickIsForgottenWhenUnseen(t *testing.T) {
+	tests := []struct {
+		name  string
+		leave *irc.Event
+	}{
+		{"part", &irc.Event{Code: "PART", Nick: "alice", Arguments: []string{"#irc"}}},
+		{"kick", &irc.Event{Code: "KICK", Nick: "op", Arguments: []string{"#irc", "alice", "bye"}}},
+		{"listener part", &irc.Event{Code: "PART", Nick: "bridge", Arguments: []string{"#irc"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestBridge(t, func(conf *Config) {
+				conf.LinksPath = filepath.Join(t.TempDir(), "links.json")
+				conf.Suffix = "~d" // so that alice isn't taken for a puppet
+			})
+			discordID := linkAlice(t, tb)
+			links := tb.ircListener.links
+
+			links.OnJoin(&irc.Event{Code: "JOIN", Nick: "alice", Arguments: []string{"#irc"}})
+			whois(t, tb, "alice", "alice_account")
+			if got, ok := links.Linked("alice"); !ok || got != discordID {
+				t.Fatalf("Linked(alice) = %q, %t, want %q after identifying", got, ok, discordID)
+			}
+
+			links.OnJoin(&irc.Event{Code: "JOIN", Nick: "alice", Arguments: []string{"#other"}})
+			tb.irc.none(t)
+
+			switch tt.leave.Code {
+			case "PART":
+				links.OnPart(tt.leave)
+			case "KICK":
+				links.OnKick(tt.leave)
+			}
+			if _, ok := links.Linked("alice"); !ok {
+				t.Fatal("alice was forgotten whilst still sharing a channel")
+			}
+
+			// She leaves the last channel and quits where we can't see,
+			// then someone else takes her nick
+			links.OnPart(&irc.Event{Code: "PART", Nick: "alice", Arguments: []string{"#other"}})
+			if _, ok := links.Linked("alice"); ok {
+				t.Fatal("alice is still verified after leaving every channel")
+			}
+
+			links.OnJoin(&irc.Event{Code: "JOIN", Nick: "alice", Arguments: []string{"#irc"}})
+			if _, ok := links.Linked("alice"); ok {
+				t.Fatal("whoever took alice's nick was verified before being looked up")
+			}
+			whois(t, tb, "alice", "")
+			if _, ok := links.Linked("alice"); ok {
+				t.Fatal("whoever took alice's nick was verified without being identified")
+			}
+		})
+	}
+}
+
+func TestLinkedNickIsLookedUpWhenTaken(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.LinksPath = filepath.Join(t.TempDir(), "links.json")
+		conf.Suffix = "~d" // so that alice isn't taken for a puppet
+	})
+	discordID := linkAlice(t, tb)
+	links := tb.ircListener.links
+
+	links.OnJoin(&irc.Event{Code: "JOIN", Nick: "alice", Arguments: []string{"#irc"}})
+	whois(t, tb, "alice", "alice_account")
+
+	// Verified users keep their account when changing nick
+	links.OnNick(&irc.Event{Code: "NICK", Nick: "alice", Arguments: []string{"alice_away"}})
+	if got, ok := links.Linked("alice_away"); !ok || got != discordID {
+		t.Fatalf("Linked(alice_away) = %q, %t, want %q", got, ok, discordID)
+	}
+	tb.irc.none(t)
+
+	// Someone else in the channel taking the nick is looked up
+	links.OnJoin(&irc.Event{Code: "JOIN", Nick: "mallory", Arguments: []string{"#irc"}})
+	links.OnNick(&irc.Event{Code: "NICK", Nick: "mallory", Arguments: []string{"alice"}})
+	if _, ok := links.Linked("alice"); ok {
+		t.Fatal("mallory was verified as alice without being looked up")
+	}
+	whois(t, tb, "alice", "")
+	if _, ok := links.Linked("alice"); ok {
+		t.Fatal("mallory was verified as alice without being identified")
+	}
+}
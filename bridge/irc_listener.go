@@ -1,6 +1,7 @@
 package bridge
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -15,13 +16,33 @@ var colorRegex = regexp.MustCompile(`\x03\d{0,2}(,\d{0,2}|\x02\x02)?`)
 type ircListener struct {
 	*irc.Connection
 	bridge *Bridge
+
+	// writer is what messages are written to, which is the Connection except in tests
+	writer ircWriter
+
+	joinParts *joinPartRelay
+	nickServ  *nickServ
+	topics    *topicRelay
+	links     *ircLinks
+	state     ircConnState
+
+	// outgoing are the messages and notices waiting for the throttle, in order
+	outgoing chan func()
 }
 
+// ircListenerQueueSize is the most messages and notices that can wait for the throttle
+const ircListenerQueueSize = 1000
+
 func newIRCListener(dib *Bridge, webIRCPass string) *ircListener {
-	irccon := irc.IRC(dib.Config.IRCListenerName, "discord")
-	listener := &ircListener{irccon, dib}
+	irccon := irc.IRC(dib.Config.IRCListenerName, dib.Config.IRCUser)
+	irccon.RealName = dib.Config.IRCRealname
+	listener := &ircListener{Connection: irccon, writer: irccon, bridge: dib}
+	listener.state.throttle = dib.newIRCThrottle()
+	listener.state.changed = dib.discord.updatePresence
+	listener.outgoing = make(chan func(), ircListenerQueueSize)
+	go listener.sendOutgoing()
 
-	dib.SetupIRCConnection(irccon, "discord.", "fd75:f5f5:226f::")
+	dib.SetupIRCConnection(irccon, nil)
 	listener.SetDebugMode(dib.Config.Debug)
 
 	// Nick tracker for nick tracking
@@ -36,10 +57,20 @@ func newIRCListener(dib *Bridge, webIRCPass string) *ircListener {
 	irccon.AddCallback("NOTICE", listener.OnPrivateMessage)
 	irccon.AddCallback("CTCP_ACTION", listener.OnPrivateMessage)
 
-	irccon.AddCallback("900", func(e *irc.Event) {
-		// Try to rejoni channels after authenticated with NickServ
-		listener.JoinChannels()
-	})
+	// Relays joins and parts, if enabled
+	listener.joinParts = newJoinPartRelay(listener)
+
+	// Tells Discord when we are kicked
+	irccon.AddCallback("KICK", listener.OnKick)
+
+	// Relays topic changes in either direction, if enabled
+	listener.topics = newTopicRelay(listener)
+
+	// Identifies with NickServ, and rejoins channels once authenticated
+	listener.nickServ = newNickServ(listener)
+
+	// Works out who has linked their Discord account, if enabled
+	listener.links = newIRCLinks(listener)
 
 	return listener
 }
@@ -60,32 +91,118 @@ func (i *ircListener) SetDebugMode(debug bool) {
 	// i.Debug = debug
 }
 
-func (i *ircListener) OnWelcome(e *irc.Event) {
-	identify := i.bridge.Config.NickServIdentify
-	// identify as listener
-	if identify != "" {
-		i.Privmsgf("nickserv", "identify %s", identify)
+// Loop keeps the listener connected until Quit is called.
+func (i *ircListener) Loop() {
+	i.bridge.ircLoop(i.Connection, &i.state)
+}
+
+// Quit the server, without reconnecting after.
+func (i *ircListener) Quit() {
+	i.state.quit()
+	i.state.send(i.Connection.Quit)
+}
+
+// Privmsg sends a message, dropping it if the listener is disconnected.
+func (i *ircListener) Privmsg(target, message string) {
+	i.queue(target, func() {
+		if !i.state.send(func() { i.writer.Privmsg(target, message) }) {
+			log.WithField("target", target).Warnln("Dropped IRC message because the listener is disconnected")
+		}
+	})
+}
+
+// Notice sends a notice, dropping it if the listener is disconnected.
+func (i *ircListener) Notice(target, message string) {
+	i.queue(target, func() {
+		if !i.state.send(func() { i.writer.Notice(target, message) }) {
+			log.WithField("target", target).Warnln("Dropped IRC notice because the listener is disconnected")
+		}
+	})
+}
+
+// queue sends the message from sendOutgoing, so that callers don't wait for the throttle.
+func (i *ircListener) queue(target string, send func()) {
+	select {
+	case i.outgoing <- send:
+	default:
+		log.WithField("target", target).Warnln("Dropped IRC message because too many are waiting to be sent")
 	}
+}
 
-	// Join all channels
-	i.JoinChannels()
+// sendOutgoing sends the queued messages and notices, one at a time.
+func (i *ircListener) sendOutgoing() {
+	for send := range i.outgoing {
+		send()
+	}
+}
+
+// SendRaw sends a raw line, dropping it if the listener is disconnected.
+func (i *ircListener) SendRaw(message string) {
+	i.state.send(func() { i.writer.SendRaw(message) })
+}
+
+func (i *ircListener) OnWelcome(e *irc.Event) {
+	i.state.setConnected(true)
+
+	// Join all channels, unless we need to wait for NickServ to identify us first
+	if !i.nickServ.Identify() {
+		i.JoinChannels()
+	}
 }
 
 func (i *ircListener) JoinChannels() {
 	i.SendRaw(i.bridge.GetJoinCommand())
+
+	if channel := i.bridge.Config.DMRelayIRCChannel; channel != "" {
+		i.state.send(func() { i.writer.Join(channel) })
+	}
 }
 
 func (i *ircListener) OnJoinChannel(e *irc.Event) {
 	log.Infof("Listener has joined IRC channel %s.", e.Arguments[1])
 }
 
+// OnKick tells Discord when the listener, or one of our Discord users, is kicked from a channel.
+func (i *ircListener) OnKick(e *irc.Event) {
+	channel, nick := e.Arguments[0], e.Arguments[1]
+	if !i.joinParts.shouldIgnore(nick) {
+		return
+	}
+
+	notice := fmt.Sprintf("%s was kicked from %s by %s", nick, channel, e.Nick)
+	if reason := e.Message(); reason != "" && reason != nick {
+		notice += " (" + reason + ")"
+	}
+
+	if nick == i.GetNick() {
+		notice += ", rejoining shortly"
+	}
+
+	i.joinParts.send(channel, notice)
+}
+
 func (i *ircListener) OnPrivateMessage(e *irc.Event) {
 	// Ignore private messages
 	if string(e.Arguments[0][0]) != "#" {
-		if e.Message() == "help" {
+		// Never reply to notices, otherwise we could get stuck in a loop with services
+		if e.Code == "NOTICE" {
+			return
+		}
+
+		// The command prefix is optional here, as people may be used to it
+		fields := strings.Fields(strings.TrimPrefix(e.Message(), i.bridge.Config.CommandPrefix))
+		linking := i.bridge.links.Enabled() && len(fields) > 0
+
+		if e.Message() == "help" && i.bridge.links.Enabled() {
+			i.Privmsg(e.Nick, "Commands: help, who, link <code from /link on Discord>, unlink")
+		} else if e.Message() == "help" {
 			i.Privmsg(e.Nick, "Commands: help, who")
 		} else if e.Message() == "who" {
 			i.Privmsg(e.Nick, "I am the bot listener.")
+		} else if linking && fields[0] == "link" && len(fields) == 2 {
+			i.links.Link(e.Nick, fields[1])
+		} else if linking && fields[0] == "unlink" && len(fields) == 1 {
+			i.links.Unlink(e.Nick)
 		} else {
 			i.Privmsg(e.Nick, "Private messaging Discord users is not supported, but I support commands! Type 'help'.")
 		}
@@ -97,31 +214,144 @@ func (i *ircListener) OnPrivateMessage(e *irc.Event) {
 		return
 	}
 
+	if i.bridge.isIgnoredIRCNick(e.Nick) {
+		return
+	}
+
 	// Ignore messages from Discord bots
-	if strings.HasSuffix(strings.TrimRight(e.Nick, "_"), i.bridge.Config.Suffix) {
+	if i.bridge.isPuppetNick(e.Nick) {
+		return
+	}
+
+	// The DM relay channel is only for replying to DMs, and is not bridged
+	if i.bridge.discord.dms.isRelayChannel(e.Arguments[0]) {
+		if e.Code == "PRIVMSG" {
+			i.bridge.discord.dms.Reply(e.Nick, e.Message())
+		}
+		return
+	}
+
+	// Services and bots often send notices that aren't for Discord
+	if e.Code == "NOTICE" && !i.bridge.bridgesNotice(e.Nick) {
+		return
+	}
+
+	// Another bridge in the channel may be repeating what we sent
+	if i.bridge.isEchoNick(e.Nick) && i.bridge.ircEchoes.IsEcho(e.Arguments[0], e.Message()) {
+		return
+	}
+
+	if !i.bridge.ircFlood.Allow(e.Nick+" "+e.Arguments[0], i.floodSummary(e.Nick, e.Arguments[0])) {
+		return
+	}
+
+	// Commands are answered here and not relayed to Discord
+	req := commandRequest{
+		onIRC:      true,
+		ircChannel: e.Arguments[0],
+		admin:      i.bridge.isIRCAdmin(e.Source),
+	}
+	if e.Code == "PRIVMSG" && i.bridge.runCommand(req, e.Message()) {
 		return
 	}
 
 	replacements := []string{}
+	mentions := []string{}
 	for _, con := range i.bridge.ircManager.ircConnections {
 		replacements = append(replacements, con.nick, "<@!"+con.discord.ID+">")
+		if strings.Contains(e.Message(), con.nick) {
+			mentions = append(mentions, con.discord.ID)
+		}
 	}
 
 	msg := strings.NewReplacer(
 		replacements...,
 	).Replace(e.Message())
 
-	if e.Code == "CTCP_ACTION" {
+	isAction := e.Code == "CTCP_ACTION"
+	if isAction {
+		// Underscores in the action would end the italics early
+		msg = strings.ReplaceAll(strings.TrimSpace(msg), "_", `\_`)
+	}
+
+	msg = colorRegex.ReplaceAllString(msg, "")
+	if i.bridge.Config.IRCFormatting == IRCFormattingStrip {
+		msg = ircf.Strip(msg)
+	} else {
+		msg = ircf.IRCToMarkdown(msg)
+	}
+
+	// Show actions in italics, wrapping any markdown the formatting became
+	if isAction {
 		msg = "_" + msg + "_"
 	}
 
-	msg = ircf.IRCToMarkdown(colorRegex.ReplaceAllString(msg, ""))
+	if e.Code == "NOTICE" {
+		msg = "[notice] " + msg
+	}
 
 	go func(e *irc.Event) {
 		i.bridge.discordMessagesChan <- IRCMessage{
 			IRCChannel: e.Arguments[0],
 			Username:   e.Nick,
 			Message:    msg,
+			Mentions:   mentions,
 		}
 	}(e)
 }
+
+// floodSummary returns a function telling Discord how many of the user's messages were dropped,
+// or nil if FloodSummary is disabled.
+func (i *ircListener) floodSummary(nick, channel string) func(int) {
+	if !i.bridge.Config.FloodSummary {
+		return nil
+	}
+
+	return func(dropped int) {
+		i.bridge.discordMessagesChan <- IRCMessage{
+			IRCChannel: channel,
+			Username:   nick,
+			Message:    fmt.Sprintf("_sent %d more messages_", dropped),
+		}
+	}
+}
+
+// ircNoticeLength is how much of each notice we fill with names, leaving
+// room for the command, channel and sender prefix within 512 bytes.
+const ircNoticeLength = 400
+
+// sendDiscordUsers tells the IRC channel who is online on Discord.
+func (i *ircListener) sendDiscordUsers(channel string) {
+	mappings := i.bridge.GetMappingsByIRC(channel)
+	if len(mappings) == 0 {
+		return
+	}
+
+	// Mirrors may be in other guilds
+	guildIDs := []string{}
+	for _, mapping := range mappings {
+		guildIDs = append(guildIDs, mapping.GuildID)
+	}
+	names := i.bridge.discord.online.Names(guildIDs...)
+	line := fmt.Sprintf("%d users online on Discord:", len(names))
+	if len(names) == 0 {
+		line = "Nobody is online on Discord."
+	}
+
+	for j, name := range names {
+		// Discord names can contain spaces, so separate them with commas
+		sep := ", "
+		if j == 0 {
+			sep = " "
+		}
+
+		if len(line)+len(sep)+len(name) > ircNoticeLength {
+			i.Notice(channel, line)
+			line, sep = "", ""
+		}
+
+		line += sep + name
+	}
+
+	i.Notice(channel, line)
+}
@@ -3,9 +3,14 @@ package bridge
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/mozillazg/go-unidecode"
 	"github.com/pkg/errors"
 
@@ -20,17 +25,48 @@ var cooldownDuration = time.Hour * 24
 type IRCManager struct {
 	ircConnections map[string]*ircConnection
 
+	// connectionsMu is held whilst changing ircConnections, so that
+	// ListConnections and connections can read it from other goroutines
+	connectionsMu sync.RWMutex
+
+	// connectionCount is len(ircConnections), for use from other goroutines
+	connectionCount int32
+
+	// nicks persists the nicks assigned to each user across restarts
+	nicks *nickStore
+
+	// waiting contains the online users without a connection because of
+	// Config.MaxPuppets, see connectWaiting
+	waiting map[string]DiscordUser
+
+	// puppetLimitHits is how many times a connection wasn't made because of Config.MaxPuppets
+	puppetLimitHits int64
+
 	bridge *Bridge
 }
 
 // NewIRCManager creates a new IRCManager
-func newIRCManager(bridge *Bridge) *IRCManager {
+func newIRCManager(bridge *Bridge, nicks *nickStore) *IRCManager {
 	return &IRCManager{
 		ircConnections: make(map[string]*ircConnection),
+		waiting:        make(map[string]DiscordUser),
+		nicks:          nicks,
 		bridge:         bridge,
 	}
 }
 
+// connections returns the connections made for Discord users, in no particular order.
+func (m *IRCManager) connections() []*ircConnection {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+
+	connections := make([]*ircConnection, 0, len(m.ircConnections))
+	for _, con := range m.ircConnections {
+		connections = append(connections, con)
+	}
+	return connections
+}
+
 // CloseConnection shuts down a particular connection and its channels.
 func (m *IRCManager) CloseConnection(i *ircConnection) {
 	log.WithField("nick", i.nick).Println("Closing connection.")
@@ -40,11 +76,15 @@ func (m *IRCManager) CloseConnection(i *ircConnection) {
 		i.cooldownTimer = nil
 	}
 
+	m.connectionsMu.Lock()
 	delete(m.ircConnections, i.discord.ID)
+	m.connectionsMu.Unlock()
+	atomic.StoreInt32(&m.connectionCount, int32(len(m.ircConnections)))
 	close(i.messages)
 
+	i.state.quit()
 	if i.innerCon.Connected() {
-		i.innerCon.Quit()
+		i.state.send(i.innerCon.Quit)
 	}
 }
 
@@ -57,6 +97,11 @@ func (m *IRCManager) Close() {
 	}
 }
 
+// ConnectionCount returns the number of IRC connections, and is safe to call from any goroutine.
+func (m *IRCManager) ConnectionCount() int {
+	return int(atomic.LoadInt32(&m.connectionCount))
+}
+
 // SetConnectionCooldown renews/starts a timer for expiring a connection.
 func (m *IRCManager) SetConnectionCooldown(con *ircConnection) {
 	if con.cooldownTimer != nil {
@@ -125,51 +170,60 @@ func (m *IRCManager) HandleUser(user DiscordUser) {
 	// 	return
 	// }
 
-	nick := m.generateNickname(user)
+	if m.atPuppetLimit() {
+		m.puppetLimitReached(user)
+		return
+	}
+	delete(m.waiting, user.ID)
+
+	nick := m.assignNickname(user)
 
 	innerCon := irc.IRC(nick, "discord")
 	// innerCon.Debug = m.bridge.Config.Debug
-	innerCon.RealName = user.Username
+	innerCon.RealName = realName(user)
 	innerCon.QuitMessage = fmt.Sprintf("Offline for %s", cooldownDuration)
 
-	var ip string
-	{
-		baseip := "fd75:f5f5:226f:"
-		if user.Bot {
-			baseip += "2"
-		} else {
-			baseip += "1"
-		}
-		ip = SnowflakeToIP(baseip, user.ID)
-	}
-
-	hostname := user.ID
-	if user.Bot {
-		hostname += ".bot.discord"
-	} else {
-		hostname += ".user.discord"
-	}
-
-	m.bridge.SetupIRCConnection(innerCon, hostname, ip)
+	m.bridge.SetupIRCConnection(innerCon, &user)
 
 	con := &ircConnection{
 		innerCon: innerCon,
+		writer:   innerCon,
 
-		discord: user,
-		nick:    nick,
+		discord:  user,
+		nick:     nick,
+		baseNick: nick,
 
 		messages:      make(chan IRCMessage),
 		cooldownTimer: nil,
+		lastActive:    time.Now(),
 
 		manager: m,
 
 		pmNoticedSenders: make(map[string]struct{}),
+		channels:         make(map[string]struct{}),
 	}
 
+	con.state.throttle = m.bridge.newIRCThrottle()
+
 	con.innerCon.AddCallback("001", con.OnWelcome)
+
+	// Nick in use, or temporarily unavailable
+	con.innerCon.ClearCallback("433")
+	con.innerCon.ClearCallback("437")
+	con.innerCon.AddCallback("433", con.OnNickInUse)
+	con.innerCon.AddCallback("437", con.OnNickInUse)
 	con.innerCon.AddCallback("PRIVMSG", con.OnPrivateMessage)
+	con.innerCon.AddCallback("JOIN", con.OnJoinPart)
+	con.innerCon.AddCallback("PART", con.OnJoinPart)
+	con.innerCon.AddCallback("KICK", con.OnJoinPart)
+	for _, code := range connectionErrorCodes {
+		con.innerCon.AddCallback(code, con.OnError)
+	}
 
+	m.connectionsMu.Lock()
 	m.ircConnections[user.ID] = con
+	m.connectionsMu.Unlock()
+	atomic.StoreInt32(&m.connectionCount, int32(len(m.ircConnections)))
 
 	err := con.innerCon.Connect(m.bridge.Config.IRCServer)
 	if err != nil {
@@ -177,7 +231,26 @@ func (m *IRCManager) HandleUser(user DiscordUser) {
 		return
 	}
 
-	go innerCon.Loop()
+	go func() {
+		m.bridge.ircLoop(innerCon, &con.state)
+	}()
+}
+
+// realName returns the realname (shown in WHOIS) for a user's connection,
+// so IRC users can tell which Discord account is behind a nick.
+// For example "qaisjp#1234 (123456789) via Discord bridge".
+func realName(user DiscordUser) string {
+	name := user.Username
+	// Discord users without a discriminator have "0"
+	if user.Discriminator != "" && user.Discriminator != "0" {
+		name += "#" + user.Discriminator
+	}
+
+	if user.Bot {
+		name += " [bot]"
+	}
+
+	return fmt.Sprintf("%s (%s) via Discord bridge", name, user.ID)
 }
 
 // Converts a nickname to a sanitised form.
@@ -218,10 +291,41 @@ func sanitiseNickname(nick string) string {
 	return string(newNick)
 }
 
+// guildMembers returns the members of every bridged guild.
+// Members of multiple guilds will appear more than once.
+func (m *IRCManager) guildMembers() []*discordgo.Member {
+	members := []*discordgo.Member{}
+	for _, guildID := range m.bridge.GuildIDs() {
+		guild, err := m.bridge.discord.State.Guild(guildID)
+		if err != nil {
+			// log.Fatalln("nickgen: guild not found when generating nickname")
+			continue
+		}
+		members = append(members, guild.Members...)
+	}
+	return members
+}
+
+// assignNickname returns the nick to use for a user's connection.
+//
+// The nick they had before a restart is reused, unless someone else on IRC has taken it,
+// in which case we fall back to generating one (which handles collisions).
+func (m *IRCManager) assignNickname(user DiscordUser) string {
+	if nick, ok := m.nicks.Get(user); ok && !m.bridge.ircListener.DoesUserExist(nick) {
+		return nick
+	}
+
+	nick := m.generateNickname(user)
+	if nick != "" {
+		m.nicks.Set(user, nick)
+	}
+	return nick
+}
+
 func (m *IRCManager) generateNickname(discord DiscordUser) string {
 	nick := sanitiseNickname(discord.Nick)
-	suffix := m.bridge.Config.Suffix
-	newNick := nick + suffix
+	prefix, suffix := m.bridge.nickPrefix, m.bridge.nickSuffix
+	newNick := prefix + nick + suffix
 
 	useFallback := len(newNick) > ircnick.MAXLENGTH || m.bridge.ircListener.DoesUserExist(newNick)
 	// log.WithFields(log.Fields{
@@ -230,22 +334,12 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 	// }).Infoln("nickgen: fallback?")
 
 	if !useFallback {
-		guild, err := m.bridge.discord.State.Guild(m.bridge.Config.GuildID)
-		if err != nil {
-			// log.Fatalln("nickgen: guild not found when generating nickname")
-			return ""
-		}
-
-		for _, member := range guild.Members {
+		for _, member := range m.guildMembers() {
 			if member.User.ID == discord.ID {
 				continue
 			}
 
-			name := member.Nick
-			if member.Nick == "" {
-				name = member.User.Username
-			}
-
+			name := GetMemberNick(member)
 			if name == "" {
 				log.WithField("member", member).Errorln("blank username encountered")
 				continue
@@ -264,14 +358,17 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 		username := sanitiseNickname(discord.Username)
 		suffix = "~" + discriminator + suffix
 
-		// Maximum length of a username but without the suffix
-		length := ircnick.MAXLENGTH - len(suffix)
+		// Maximum length of a username but without the prefix and suffix
+		length := ircnick.MAXLENGTH - len(prefix) - len(suffix)
+		if length < 1 {
+			length = 1
+		}
 		if length >= len(username) {
 			length = len(username)
 			// log.Infoln("nickgen: maximum length limit not reached")
 		}
 
-		newNick = username[:length] + suffix
+		newNick = prefix + username[:length] + suffix
 		// log.WithFields(log.Fields{
 		// 	"nick":     discord.Nick,
 		// 	"username": discord.Username,
@@ -289,52 +386,129 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 	return newNick
 }
 
+// numberedNickname inserts n before the suffix of nick, e.g "alice~d" becomes "alice2~d",
+// truncating the nick so that it stays within ircnick.MAXLENGTH.
+//
+// The prefix and suffix are kept so that the listener still recognises the nick as a Discord user.
+func numberedNickname(nick, prefix, suffix string, n int) string {
+	base := strings.TrimSuffix(strings.TrimPrefix(nick, prefix), suffix)
+	number := strconv.Itoa(n)
+
+	if length := ircnick.MAXLENGTH - len(number) - len(prefix) - len(suffix); len(base) > length {
+		if length < 1 {
+			length = 1
+		}
+		base = base[:length]
+	}
+
+	return prefix + base + number + suffix
+}
+
 // SendMessage sends a broken down Discord Message to a particular IRC channel.
+//
+// If the author has their own IRC connection, it sends the message itself, so
+// IRC sees it come from their nick and actions are sent as actions.
+// Otherwise (in simple mode, or if they are appearing offline) the listener
+// relays it for them, prefixed with who they are, see sendAsListener.
 func (m *IRCManager) SendMessage(channel string, msg *DiscordMessage) {
 	con, ok := m.ircConnections[msg.Author.ID]
 
 	content := msg.Content
+	if msg.IsEdit {
+		content = "(edited) " + content
+	}
 
-	channel = strings.Split(channel, " ")[0]
-
-	// Person is appearing offline (or the bridge is running in Simple Mode)
 	if !ok {
-		length := len(msg.Author.Username)
-		for _, line := range strings.Split(content, "\n") {
-			m.bridge.ircListener.Privmsg(channel, fmt.Sprintf(
-				"<%s#%s> %s",
-				msg.Author.Username[:1]+"\u200B"+msg.Author.Username[1:length],
-				msg.Author.Discriminator,
-				line,
-			))
-		}
+		m.sendAsListener(channel, msg, content)
+		m.connectWaiting(msg.Author.ID)
 		return
 	}
+	con.lastActive = time.Now()
 
 	// If there is a cooldown, reset the cooldown
 	if con.cooldownTimer != nil {
 		m.SetConnectionCooldown(con)
 	}
 
+	overhead := 0
+	if msg.IsAction {
+		overhead = len("\x01ACTION \x01")
+	}
+	max := ircContentLength(con.nick, channel, overhead)
+
 	for _, line := range strings.Split(content, "\n") {
-		ircMessage := IRCMessage{
-			IRCChannel: channel,
-			Message:    line,
-			IsAction:   msg.IsAction,
+		for _, piece := range splitIRCLine(line, max) {
+			ircMessage := IRCMessage{
+				IRCChannel: channel,
+				Message:    piece,
+				IsAction:   msg.IsAction,
+			}
+
+			select {
+			// Try to send the message immediately
+			case con.messages <- ircMessage:
+			// If it can't after 5ms, do it in a separate goroutine
+			case <-time.After(time.Millisecond * 5):
+				go func() {
+					con.messages <- ircMessage
+				}()
+			}
 		}
+	}
+}
+
+// sendAsListener has the listener send the message for its author, like a relay bot,
+// e.g "<alice> hello", or "* alice waves" for actions.
+func (m *IRCManager) sendAsListener(channel string, msg *DiscordMessage, content string) {
+	// Break up their names so that it doesn't ping them on IRC
+	breakUp := func(name string) string {
+		_, size := utf8.DecodeRuneInString(name)
+		return name[:size] + "\u200B" + name[size:]
+	}
+
+	fields := ircMessageFields{
+		DisplayName:   m.bridge.discord.colorName(msg.Message, breakUp(m.bridge.discord.authorNick(msg.Message))),
+		Nick:          m.bridge.discord.colorName(msg.Message, breakUp(msg.Author.Username)),
+		Username:      msg.Author.Username,
+		Discriminator: msg.Author.Discriminator,
+		Channel:       channel,
+	}
+
+	// Work out how much room the format takes up on every line
+	empty, err := m.formatListenerMessage(fields, msg.IsAction)
+	if err != nil {
+		log.WithField("error", err).Errorln("could not format message for IRC")
+		return
+	}
+	max := ircContentLength(m.bridge.ircListener.GetNick(), channel, len(empty))
+
+	for _, line := range strings.Split(content, "\n") {
+		for _, piece := range splitIRCLine(line, max) {
+			fields.Content = piece
+			formatted, err := m.formatListenerMessage(fields, msg.IsAction)
+			if err != nil {
+				log.WithField("error", err).Errorln("could not format message for IRC")
+				return
+			}
 
-		select {
-		// Try to send the message immediately
-		case con.messages <- ircMessage:
-		// If it can't after 5ms, do it in a separate goroutine
-		case <-time.After(time.Millisecond * 5):
-			go func() {
-				con.messages <- ircMessage
-			}()
+			m.bridge.ircListener.Privmsg(channel, formatted)
 		}
 	}
 }
 
+// formatListenerMessage formats a message the listener sends for a Discord user,
+// using IRCMessageFormat, or IRCActionFormat for actions.
+func (m *IRCManager) formatListenerMessage(fields ircMessageFields, isAction bool) (string, error) {
+	format := m.bridge.ircMessageFormat
+	if isAction {
+		format = m.bridge.ircActionFormat
+	}
+
+	buf := &strings.Builder{}
+	err := format.Execute(buf, fields)
+	return buf.String(), err
+}
+
 // RequestChannels finds all the Discord channels this user belongs to,
 // and then find pairings in the global pairings list
 // Currently just returns all participating IRC channels
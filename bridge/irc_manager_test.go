@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"testing"
+
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+func TestSanitiseNickname(t *testing.T) {
+	tests := []struct {
+		nick string
+		want string
+	}{
+		{"alice", "alice"},
+		{"ab[c]{d}|e\\f`g^h", "ab[c]{d}|e\\f`g^h"},
+		{"a b  c", "a_b_c"},
+		{"1abc", "_1abc"},
+		{"-x", "_-x"},
+
+		// Unicode is transliterated where it can be
+		{"Zoë", "Zoe"},
+		{"Ünïcödé Nämé", "Unicode_Name"},
+		{"日本", "Ri_Ben_"},
+		{"🔴🔴", "_"},
+		{"", "_"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitiseNickname(tt.nick); got != tt.want {
+			t.Errorf("sanitiseNickname(%q) = %q, want %q", tt.nick, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateNickname(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.Suffix = "~d"
+	})
+	tb.addUser("500000000000000009", "someone", "Taken")
+
+	tests := []struct {
+		name string
+		user DiscordUser
+		want string
+	}{
+		{"nick", DiscordUser{ID: "500000000000000001", Username: "alice", Discriminator: "0", Nick: "Ally"}, "Ally~d"},
+		{"unicode", DiscordUser{ID: "500000000000000002", Username: "zoe", Discriminator: "0", Nick: "Zoë 日本"}, "Zoe_Ri_Ben_~d"},
+
+		// Nicks that are too long fall back to the username, cut short to fit
+		{
+			"too long",
+			DiscordUser{ID: "500000000000000003", Username: "averyveryverylongusernamethatgoesonandon", Discriminator: "1234", Nick: "anotherextremelylongdisplaynamewhichisover"},
+			"averyveryverylonguserna~1234~d",
+		},
+
+		// Someone else on Discord is already called this
+		{"taken", DiscordUser{ID: "500000000000000004", Username: "bob", Discriminator: "1234", Nick: "Taken"}, "bob~1234~d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tb.ircManager.generateNickname(tt.user)
+			if got != tt.want {
+				t.Errorf("generateNickname(%+v) = %q, want %q", tt.user, got, tt.want)
+			}
+			if len(got) > ircnick.MAXLENGTH {
+				t.Errorf("%q is longer than %d", got, ircnick.MAXLENGTH)
+			}
+		})
+	}
+}
+
+func TestAssignNickname(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.Suffix = "~d"
+	})
+	alice := DiscordUser{ID: "500000000000000001", Username: "alice", Discriminator: "1234", Nick: "Ally"}
+
+	if got := tb.ircManager.assignNickname(alice); got != "Ally~d" {
+		t.Fatalf("assignNickname = %q, want Ally~d", got)
+	}
+
+	// Their nick is remembered, even if the generated one would now be different
+	tb.ircManager.nicks.Set(alice, "Ally2~d")
+	if got := tb.ircManager.assignNickname(alice); got != "Ally2~d" {
+		t.Errorf("assignNickname = %q, want the remembered Ally2~d", got)
+	}
+
+	// Unless someone on IRC is using it
+	tb.ircListener.Channels["#irc"] = irc.Channel{Users: map[string]irc.User{"Ally2~d": {}}}
+	if got := tb.ircManager.assignNickname(alice); got != "Ally~d" {
+		t.Errorf("assignNickname = %q, want a new nick as Ally2~d is in use", got)
+	}
+}
@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// nickServWaitTimeout is how long to wait for NickServ before joining channels anyway.
+var nickServWaitTimeout = time.Second * 15
+
+// nickServ identifies the listener with NickServ, and when Config.NickServWait
+// is set, holds off joining channels until it has accepted (or rejected) us.
+type nickServ struct {
+	listener *ircListener
+
+	// waiting is 1 whilst we are waiting to join channels
+	waiting int32
+}
+
+func newNickServ(listener *ircListener) *nickServ {
+	n := &nickServ{listener: listener}
+
+	listener.AddCallback("NOTICE", n.OnNotice)
+
+	// RPL_LOGGEDIN, sent by most networks once identified (or after SASL)
+	listener.AddCallback("900", func(e *irc.Event) {
+		n.join()
+	})
+
+	return n
+}
+
+// Identify sends IDENTIFY if configured. Returns true if joining channels should wait.
+func (n *nickServ) Identify() bool {
+	identify := n.listener.bridge.Config.NickServIdentify
+	if identify == "" {
+		return false
+	}
+
+	n.listener.Privmsg("NickServ", "IDENTIFY "+identify)
+
+	if !n.listener.bridge.Config.NickServWait {
+		return false
+	}
+
+	atomic.StoreInt32(&n.waiting, 1)
+	time.AfterFunc(nickServWaitTimeout, func() {
+		if atomic.LoadInt32(&n.waiting) == 1 {
+			log.Warnln("NickServ did not confirm identification in time, joining channels anyway")
+			n.join()
+		}
+	})
+	return true
+}
+
+// join joins channels, and stops waiting for NickServ.
+func (n *nickServ) join() {
+	atomic.StoreInt32(&n.waiting, 0)
+	n.listener.JoinChannels()
+}
+
+func (n *nickServ) OnNotice(e *irc.Event) {
+	if !strings.EqualFold(e.Nick, "NickServ") {
+		return
+	}
+
+	msg := strings.ToLower(ircf.Strip(e.Message()))
+	switch {
+	case strings.Contains(msg, "you are now identified"), strings.Contains(msg, "password accepted"):
+		log.Infoln("Listener identified with NickServ")
+	case strings.Contains(msg, "isn't registered"), strings.Contains(msg, "is not registered"):
+		log.WithField("notice", e.Message()).Warnln("The listener's nick is not registered with NickServ, register it or group it with your account")
+	case strings.Contains(msg, "invalid password"), strings.Contains(msg, "password incorrect"):
+		log.WithField("notice", e.Message()).Errorln("NickServ rejected the listener's password")
+	default:
+		return
+	}
+
+	// Whatever the outcome, there's no point waiting any longer
+	if atomic.LoadInt32(&n.waiting) == 1 {
+		n.join()
+	}
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// puppetEvictIdle is how long a connection must have been inactive before it
+// can be closed to make room for someone else, so that connections aren't
+// swapped back and forth in a busy channel.
+var puppetEvictIdle = time.Minute * 10
+
+// atPuppetLimit returns true if no more connections can be made because of Config.MaxPuppets.
+func (m *IRCManager) atPuppetLimit() bool {
+	limit := m.bridge.Config.MaxPuppets
+	return limit > 0 && len(m.ircConnections) >= limit
+}
+
+// puppetLimitReached remembers the user, who couldn't be given a connection,
+// so that they get one if they send a message. Until then, the listener
+// relays for them.
+func (m *IRCManager) puppetLimitReached(user DiscordUser) {
+	if atomic.AddInt64(&m.puppetLimitHits, 1) == 1 {
+		log.WithField("max_puppets", m.bridge.Config.MaxPuppets).
+			Warnln("Reached the most IRC connections allowed, the listener will relay for everyone else")
+	}
+
+	if user.Online {
+		m.waiting[user.ID] = user
+	} else {
+		delete(m.waiting, user.ID)
+	}
+}
+
+// PuppetLimitHits returns how many times a connection wasn't made because of Config.MaxPuppets,
+// and is safe to call from any goroutine.
+func (m *IRCManager) PuppetLimitHits() int64 {
+	return atomic.LoadInt64(&m.puppetLimitHits)
+}
+
+// connectWaiting gives a user that is waiting for a connection one, now that
+// they've sent a message, closing the least recently active connection if needed.
+func (m *IRCManager) connectWaiting(userID string) {
+	user, ok := m.waiting[userID]
+	if !ok {
+		return
+	}
+
+	if m.atPuppetLimit() {
+		var oldest *ircConnection
+		for _, con := range m.ircConnections {
+			if oldest == nil || con.lastActive.Before(oldest.lastActive) {
+				oldest = con
+			}
+		}
+
+		if oldest == nil || time.Since(oldest.lastActive) < puppetEvictIdle {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"nick":     oldest.nick,
+			"inactive": time.Since(oldest.lastActive).Round(time.Second),
+		}).Infoln("Closing the least recently active IRC connection to make room for another")
+
+		// They can have a connection again once they are active, if they are still online
+		online := oldest.cooldownTimer == nil
+
+		oldest.innerCon.QuitMessage = "Making room for someone more active"
+		m.CloseConnection(oldest)
+		if online {
+			m.waiting[oldest.discord.ID] = oldest.discord
+		}
+	}
+
+	m.HandleUser(user)
+}
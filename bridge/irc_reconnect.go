@@ -0,0 +1,190 @@
+package bridge
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// ircReconnectMaxDelay caps the exponential backoff between reconnection attempts.
+var ircReconnectMaxDelay = time.Minute * 5
+
+// ircWriter is the part of *irc.Connection that messages are written with,
+// so that tests can see what would have been sent to IRC.
+type ircWriter interface {
+	Privmsg(target, message string)
+	Notice(target, message string)
+	Action(target, message string)
+	Join(channel string)
+	Nick(n string)
+	SendRaw(message string)
+}
+
+// ircConnState tracks whether an IRC connection can currently be written to.
+//
+// go-ircevent blocks (or panics) when writing to a connection that has dropped,
+// so all messages from Discord go through send, which drops them instead.
+type ircConnState struct {
+	connected int32
+	quitting  int32
+
+	// throttle paces what is sent, if Config.IRCSendRate is set
+	throttle *ircThrottle
+
+	// changed is called, if set, when the connection connects or disconnects
+	changed func()
+
+	stats connectionStats
+}
+
+// connectionStats are kept for each IRC connection, to help find out
+// why someone's messages aren't reaching IRC.
+type connectionStats struct {
+	sync.Mutex
+
+	reconnects   int
+	lastError    string
+	lastErrorAt  time.Time
+	messagesSent int
+	bytesSent    int
+	lastSent     time.Time
+}
+
+func (s *connectionStats) recordError(err string) {
+	s.Lock()
+	s.lastError = err
+	s.lastErrorAt = time.Now()
+	s.Unlock()
+}
+
+func (s *connectionStats) recordReconnect() {
+	s.Lock()
+	s.reconnects++
+	s.Unlock()
+}
+
+func (s *connectionStats) recordSent(message string) {
+	s.Lock()
+	s.messagesSent++
+	s.bytesSent += len(message)
+	s.lastSent = time.Now()
+	s.Unlock()
+}
+
+// Connected returns true once registered with the server, until the connection drops.
+func (s *ircConnState) Connected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+func (s *ircConnState) setConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.connected, v) != v && s.changed != nil {
+		s.changed()
+	}
+}
+
+// quit stops the connection from being reconnected.
+func (s *ircConnState) quit() {
+	atomic.StoreInt32(&s.quitting, 1)
+}
+
+func (s *ircConnState) isQuitting() bool {
+	return atomic.LoadInt32(&s.quitting) == 1
+}
+
+// send calls fn, which should write to the connection, only if it is connected.
+// Returns false if the message was dropped. It waits for the throttle first,
+// so may block.
+func (s *ircConnState) send(fn func()) (sent bool) {
+	if !s.Connected() {
+		return false
+	}
+	s.throttle.wait()
+
+	// The connection may have dropped after we checked, in which
+	// case go-ircevent panics as its write channel has been closed.
+	defer func() {
+		if r := recover(); r != nil {
+			sent = false
+		}
+	}()
+
+	fn()
+	return true
+}
+
+// ircReconnectDelay returns how long to wait before the given reconnection attempt.
+func (b *Bridge) ircReconnectDelay(attempt int) time.Duration {
+	return backoffDelay(b.Config.IRCReconnectBaseDelay, attempt)
+}
+
+// backoffDelay returns how long to wait before the given attempt,
+// using exponential backoff with full jitter, at most ircReconnectMaxDelay.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt)
+	if delay <= 0 || delay > ircReconnectMaxDelay {
+		delay = ircReconnectMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(delay))) + time.Second
+}
+
+// ircLoop replaces (*irc.Connection).Loop, reconnecting with backoff when the connection drops.
+//
+// Channels are rejoined by the "001" welcome callback of each connection.
+// Returns once the connection has quit, or has failed to reconnect IRCReconnectMaxRetries times.
+func (b *Bridge) ircLoop(con *irc.Connection, state *ircConnState) {
+	for !state.isQuitting() {
+		err := <-con.ErrorChan()
+		state.setConnected(false)
+
+		if state.isQuitting() {
+			return
+		}
+
+		if err != nil {
+			state.stats.recordError(err.Error())
+		}
+
+		log.WithFields(log.Fields{
+			"nick":  con.GetNick(),
+			"error": err,
+		}).Warnln("IRC connection lost, reconnecting...")
+
+		// Stop the old connection's goroutines before we dial again
+		con.Disconnect()
+
+		for attempt := 0; ; attempt++ {
+			if max := b.Config.IRCReconnectMaxRetries; max > 0 && attempt >= max {
+				log.WithField("nick", con.GetNick()).Errorf("Giving up on IRC connection after %d attempts", attempt)
+				return
+			}
+
+			time.Sleep(b.ircReconnectDelay(attempt))
+
+			if state.isQuitting() {
+				return
+			}
+
+			err := con.Reconnect()
+			if err == nil {
+				state.stats.recordReconnect()
+				break
+			}
+			state.stats.recordError(err.Error())
+
+			log.WithFields(log.Fields{
+				"nick":    con.GetNick(),
+				"error":   err,
+				"attempt": attempt + 1,
+			}).Warnln("could not reconnect to IRC")
+		}
+	}
+}
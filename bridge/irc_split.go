@@ -0,0 +1,49 @@
+package bridge
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// ircLineLength is the most an IRC line can be, excluding the trailing CRLF.
+const ircLineLength = 510
+
+// ircHostmaskReserve is room left for the ":nick!user@host " prefix the server
+// adds when relaying our messages, on top of the length of the nick itself.
+const ircHostmaskReserve = 1 + 1 + 10 + 1 + 63 + 1
+
+// ircContentLength returns how many bytes of text fit in a PRIVMSG from nick to target.
+// overhead is any other text on every line, like CTCP ACTION markers.
+func ircContentLength(nick, target string, overhead int) int {
+	prefix := len(nick) + ircHostmaskReserve + len("PRIVMSG ") + len(target) + len(" :")
+	return ircLineLength - prefix - overhead
+}
+
+// splitIRCLine splits a line into pieces of at most max bytes,
+// preferring to break between words and never breaking inside a character.
+func splitIRCLine(line string, max int) []string {
+	// Don't let a silly limit cause an endless loop
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+
+	lines := []string{}
+	for len(line) > max {
+		cut := strings.LastIndexByte(line[:max+1], ' ')
+
+		// Only break at a space if it doesn't leave a tiny line
+		if cut < max/2 {
+			cut = max
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		} else {
+			lines = append(lines, line[:cut])
+			line = line[cut+1:]
+		}
+	}
+
+	return append(lines, line)
+}
@@ -0,0 +1,75 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// checkPieces checks each piece fits in max bytes, is valid UTF-8, and that
+// together they are the line, less the spaces they were split at.
+func checkPieces(t *testing.T, line string, max int, pieces []string) {
+	t.Helper()
+
+	for i, piece := range pieces {
+		if len(piece) > max {
+			t.Errorf("piece %d is %d bytes, more than %d", i, len(piece), max)
+		}
+		if !utf8.ValidString(piece) {
+			t.Errorf("piece %d was cut inside a character: %q", i, piece)
+		}
+	}
+
+	joined := strings.Join(pieces, "")
+	if stripped := strings.Replace(line, " ", "", -1); strings.Replace(joined, " ", "", -1) != stripped {
+		t.Errorf("pieces %q don't make up the line", pieces)
+	}
+}
+
+func TestSplitIRCLine(t *testing.T) {
+	if pieces := splitIRCLine("hello there", 510); len(pieces) != 1 || pieces[0] != "hello there" {
+		t.Errorf("short line was split into %q", pieces)
+	}
+
+	words := strings.Repeat("hello ", 200)
+	pieces := splitIRCLine(words, 100)
+	checkPieces(t, words, 100, pieces)
+	for _, piece := range pieces[:len(pieces)-1] {
+		if strings.HasSuffix(piece, "hell") || strings.HasPrefix(piece, "o") {
+			t.Errorf("line was split inside a word: %q", piece)
+		}
+	}
+}
+
+func TestSplitIRCLineMultibyte(t *testing.T) {
+	max := ircLineLength
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		// é is two bytes, so the 510 byte boundary falls inside one
+		{"two bytes", "a" + strings.Repeat("é", 300)},
+		// 日 is three bytes
+		{"three bytes", strings.Repeat("日", 171)},
+		{"three bytes offset", "ab" + strings.Repeat("日", 200)},
+		// 😀 is four bytes
+		{"four bytes", "abc" + strings.Repeat("😀", 130)},
+		{"exactly the limit", strings.Repeat("日", 170)},
+		{"mixed", strings.Repeat("x", 508) + "😀😀 and more"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces := splitIRCLine(tt.line, max)
+			checkPieces(t, tt.line, max, pieces)
+
+			if len(tt.line) <= max && len(pieces) != 1 {
+				t.Errorf("line of %d bytes was split into %d pieces", len(tt.line), len(pieces))
+			}
+			if len(tt.line) > max && len(pieces) < 2 {
+				t.Errorf("line of %d bytes was not split", len(tt.line))
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// ircThrottle paces the lines written to an IRC connection, so that the server
+// doesn't disconnect it for excess flood, see Config.IRCSendRate.
+//
+// It is a token bucket: burst lines can be sent at once, and then rate lines
+// every second. A nil throttle never waits.
+type ircThrottle struct {
+	sync.Mutex
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// newIRCThrottle returns the throttle for a new connection, or nil if Config.IRCSendRate is zero.
+func (b *Bridge) newIRCThrottle() *ircThrottle {
+	if b.Config.IRCSendRate <= 0 {
+		return nil
+	}
+
+	burst := float64(b.Config.IRCSendBurst)
+	return &ircThrottle{
+		rate:   b.Config.IRCSendRate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until another line can be sent.
+//
+// Lines are sent in the order their callers got the lock, so callers that
+// need their lines to stay in order should send them from one goroutine.
+func (t *ircThrottle) wait() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+
+	if t.tokens < 1 {
+		time.Sleep(time.Duration((1 - t.tokens) / t.rate * float64(time.Second)))
+		t.tokens = 1
+		t.last = time.Now()
+	}
+	t.tokens--
+}
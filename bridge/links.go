@@ -0,0 +1,216 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// linkCodeTTL is how long a code from /link can be used for.
+var linkCodeTTL = time.Minute * 10
+
+// accountLinks remembers the Discord user each IRC account (as identified with
+// NickServ) belongs to, persisted at Config.LinksPath.
+//
+// Discord users are given a code with /link, and send it to the listener from IRC
+// whilst identified, which looks up their account before linking them.
+type accountLinks struct {
+	sync.Mutex
+	path string
+
+	// links is keyed by lowercase IRC account
+	links map[string]accountLink
+
+	// codes are waiting to be sent from IRC, keyed by code
+	codes map[string]linkCode
+}
+
+type accountLink struct {
+	DiscordID string `json:"discord_id"`
+
+	// Nick is the IRC nick they linked from, and is looked up when they join,
+	// so that we know who they are without waiting for them to link again
+	Nick string `json:"nick"`
+}
+
+type linkCode struct {
+	discordID string
+	expires   time.Time
+}
+
+// loadAccountLinks reads the links stored at path. A missing file is not an error.
+func loadAccountLinks(path string) (*accountLinks, error) {
+	l := &accountLinks{
+		path:  path,
+		links: make(map[string]accountLink),
+		codes: make(map[string]linkCode),
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read links file")
+	}
+
+	if err := json.Unmarshal(data, &l.links); err != nil {
+		return nil, errors.Wrap(err, "could not parse links file")
+	}
+
+	return l, nil
+}
+
+// Enabled returns true if /link can be used, which is only when links can be persisted.
+func (l *accountLinks) Enabled() bool {
+	return l.path != ""
+}
+
+// NewCode returns a code the Discord user can send from IRC to link their account,
+// replacing any code they were given before.
+func (l *accountLinks) NewCode(discordID string) (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "could not generate link code")
+	}
+	code := base32.StdEncoding.EncodeToString(buf)
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for c, existing := range l.codes {
+		if existing.discordID == discordID || now.After(existing.expires) {
+			delete(l.codes, c)
+		}
+	}
+
+	l.codes[code] = linkCode{discordID: discordID, expires: now.Add(linkCodeTTL)}
+	return code, nil
+}
+
+// CodeUser returns who the code was given to, if it can still be used.
+func (l *accountLinks) CodeUser(code string) (discordID string, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	c, ok := l.codes[strings.ToUpper(code)]
+	if !ok || time.Now().After(c.expires) {
+		return "", false
+	}
+	return c.discordID, true
+}
+
+// CancelCode stops the code from being used, returning false if it couldn't have been.
+func (l *accountLinks) CancelCode(code string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	code = strings.ToUpper(code)
+	_, ok := l.codes[code]
+	delete(l.codes, code)
+	return ok
+}
+
+// Link links the IRC account to the Discord user the code was given to, using up the code.
+// Any other account they had linked is unlinked.
+func (l *accountLinks) Link(code, account, nick string) (discordID string, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	code = strings.ToUpper(code)
+	c, ok := l.codes[code]
+	if !ok || time.Now().After(c.expires) {
+		return "", false
+	}
+	delete(l.codes, code)
+
+	for a, link := range l.links {
+		if link.DiscordID == c.discordID {
+			delete(l.links, a)
+		}
+	}
+	l.links[strings.ToLower(account)] = accountLink{DiscordID: c.discordID, Nick: nick}
+
+	l.save()
+	return c.discordID, true
+}
+
+// UnlinkAccount unlinks the IRC account, returning false if it wasn't linked.
+func (l *accountLinks) UnlinkAccount(account string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	account = strings.ToLower(account)
+	if _, ok := l.links[account]; !ok {
+		return false
+	}
+	delete(l.links, account)
+
+	l.save()
+	return true
+}
+
+// UnlinkDiscord unlinks the Discord user's IRC account, returning false if they didn't have one.
+func (l *accountLinks) UnlinkDiscord(discordID string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	unlinked := false
+	for account, link := range l.links {
+		if link.DiscordID == discordID {
+			delete(l.links, account)
+			unlinked = true
+		}
+	}
+
+	if unlinked {
+		l.save()
+	}
+	return unlinked
+}
+
+// Get returns who the IRC account is linked to.
+func (l *accountLinks) Get(account string) (discordID string, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	link, ok := l.links[strings.ToLower(account)]
+	return link.DiscordID, ok
+}
+
+// HasNick returns true if an account was linked from the nick, so is worth looking up.
+func (l *accountLinks) HasNick(nick string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, link := range l.links {
+		if strings.EqualFold(link.Nick, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// save must be called with the lock held.
+func (l *accountLinks) save() {
+	data, err := json.MarshalIndent(l.links, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(l.path, data)
+	}
+
+	if err != nil {
+		log.WithField("error", err).Errorln("could not save account links")
+	}
+}
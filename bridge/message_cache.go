@@ -0,0 +1,54 @@
+package bridge
+
+import (
+	"container/list"
+	"sync"
+)
+
+// messageCache is a small LRU set of Discord message IDs.
+//
+// It is used to remember which messages have actually been bridged,
+// so that edits are only relayed for messages IRC has already seen.
+type messageCache struct {
+	sync.Mutex
+
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newMessageCache(size int) *messageCache {
+	return &messageCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Add marks a message ID as recently used, evicting the oldest entry if full.
+func (c *messageCache) Add(id string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[id] = c.order.PushFront(id)
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(string))
+	}
+}
+
+// Contains reports whether the message ID is in the cache.
+func (c *messageCache) Contains(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.items[id]
+	return ok
+}
@@ -0,0 +1,261 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// messageQueue is an append only log of the IRC messages that haven't been
+// delivered to Discord yet, so that they can be sent after a restart.
+//
+// Each line of the file is a queueRecord. A message is pending from the line
+// adding it until a line marks it as done. The file is rewritten with only
+// the pending messages when it is opened, and whenever enough messages have
+// been marked as done.
+//
+// If path is empty nothing is persisted.
+type messageQueue struct {
+	sync.Mutex
+	path string
+	size int
+
+	file    *os.File
+	nextID  uint64
+	pending []queueRecord
+
+	// loaded are the messages that were pending when the queue was loaded
+	loaded []queueRecord
+
+	// done is the number of lines marking messages as done since the last rewrite
+	done int
+}
+
+type queueRecord struct {
+	ID      uint64      `json:"id"`
+	Message *IRCMessage `json:"msg,omitempty"`
+	Done    bool        `json:"done,omitempty"`
+}
+
+// loadMessageQueue reads the messages still pending at path. A missing file is not an error.
+func loadMessageQueue(path string, size int) (*messageQueue, error) {
+	q := &messageQueue{path: path, size: size, nextID: 1}
+	if path == "" {
+		return q, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not read queue file")
+	}
+
+	if err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var r queueRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				// The last line may be half written if we crashed
+				log.WithField("error", err).Warnln("Skipping unreadable line in message queue")
+				continue
+			}
+
+			if r.ID >= q.nextID {
+				q.nextID = r.ID + 1
+			}
+
+			if r.Done {
+				q.remove(r.ID)
+			} else if r.Message != nil {
+				q.pending = append(q.pending, r)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "could not read queue file")
+		}
+	}
+
+	if over := len(q.pending) - q.size; over > 0 {
+		log.WithField("count", over).Warnln("Dropping the oldest queued messages, the queue is full")
+		q.pending = q.pending[over:]
+	}
+
+	if err := q.rewrite(); err != nil {
+		return nil, errors.Wrap(err, "could not write queue file")
+	}
+
+	q.loaded = append([]queueRecord(nil), q.pending...)
+	return q, nil
+}
+
+// Pending returns the messages that had not been delivered when the queue was loaded.
+func (q *messageQueue) Pending() []queueRecord {
+	q.Lock()
+	defer q.Unlock()
+
+	return append([]queueRecord(nil), q.loaded...)
+}
+
+// Push adds the message to the queue, dropping the oldest message if it's full.
+// The returned ID should be passed to Done once the message has been delivered.
+func (q *messageQueue) Push(msg IRCMessage) uint64 {
+	if q.path == "" {
+		return 0
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	r := queueRecord{ID: q.nextID, Message: &msg}
+	q.nextID++
+
+	if len(q.pending) >= q.size {
+		oldest := q.pending[0]
+		log.WithFields(log.Fields{
+			"irc.channel": oldest.Message.IRCChannel,
+			"irc.nick":    oldest.Message.Username,
+		}).Warnln("Dropping the oldest queued message, the queue is full")
+		q.markDone(oldest.ID)
+	}
+
+	q.pending = append(q.pending, r)
+	q.append(r, true)
+
+	return r.ID
+}
+
+// Done removes the message from the queue.
+func (q *messageQueue) Done(id uint64) {
+	if q.path == "" {
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.markDone(id)
+
+	// Stop the file growing forever
+	if q.done >= q.size {
+		if err := q.rewrite(); err != nil {
+			log.WithField("error", err).Errorln("could not rewrite message queue")
+		}
+	}
+}
+
+// Close closes the queue file. Pending messages are kept for the next start.
+func (q *messageQueue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// markDone must be called with the lock held.
+func (q *messageQueue) markDone(id uint64) {
+	if !q.remove(id) {
+		return
+	}
+
+	q.done++
+	q.append(queueRecord{ID: id, Done: true}, false)
+}
+
+// remove must be called with the lock held.
+func (q *messageQueue) remove(id uint64) bool {
+	for i, r := range q.pending {
+		if r.ID == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// append must be called with the lock held. If sync is set the
+// line is flushed to disk before returning.
+func (q *messageQueue) append(r queueRecord, sync bool) {
+	if q.file == nil {
+		return
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.WithField("error", err).Errorln("could not encode queued message")
+		return
+	}
+
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		log.WithField("error", err).Errorln("could not write to message queue")
+		return
+	}
+
+	if sync {
+		if err := q.file.Sync(); err != nil {
+			log.WithField("error", err).Errorln("could not sync message queue")
+		}
+	}
+}
+
+// rewrite replaces the file with one containing only the pending messages.
+// It must be called with the lock held.
+func (q *messageQueue) rewrite() error {
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+
+	// Write to a temporary file first so that a crash can't lose the pending messages
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range q.pending {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return err
+	}
+
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600)
+	q.done = 0
+	return err
+}
@@ -0,0 +1,100 @@
+package bridge
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+
+	q, err := loadMessageQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := q.Push(IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "one"})
+	q.Push(IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "two"})
+	q.Done(first)
+	q.Push(IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "three"})
+	q.Push(IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "four"})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest message was dropped, as the queue only holds two
+	q, err = loadMessageQueue(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Only the messages from before loading are replayed
+	q.Push(IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "five"})
+
+	pending := q.Pending()
+	if len(pending) != 2 || pending[0].Message.Message != "three" || pending[1].Message.Message != "four" {
+		t.Errorf("pending = %+v, want three and four", pending)
+	}
+}
+
+// waitForQueue waits until the bridge's queue has want messages pending.
+func waitForQueue(t *testing.T, tb *testBridge, want int) []queueRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		tb.queue.Lock()
+		pending := append([]queueRecord(nil), tb.queue.pending...)
+		tb.queue.Unlock()
+
+		if len(pending) == want {
+			return pending
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages are queued, want %d", len(pending), want)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestFailedMessagesStayQueued(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.QueuePath = filepath.Join(t.TempDir(), "queue")
+	})
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "delivered"}
+	tb.webhooks.next(t)
+	waitForQueue(t, tb, 0)
+
+	tb.webhooks.Lock()
+	tb.webhooks.fail = errors.New("discord is down")
+	tb.webhooks.Unlock()
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "failed"}
+
+	deadline := time.Now().Add(testTimeout)
+	for len(tb.deliveryFailures.List()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the message did not fail")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	tb.webhooks.Lock()
+	tb.webhooks.fail = nil
+	tb.webhooks.Unlock()
+
+	// Messages to a channel are sent in order, so this is sent after the other has failed
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "alice", Message: "later"}
+	if msg := tb.webhooks.next(t); msg.params.Content != "later" {
+		t.Fatalf("sent %q, want the message after the failure", msg.params.Content)
+	}
+
+	// The failed message stays queued, to be sent again after a restart
+	if pending := waitForQueue(t, tb, 1); pending[0].Message.Message != "failed" {
+		t.Errorf("queued %q, want the message that failed", pending[0].Message.Message)
+	}
+}
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// multilineContinuation is prefixed to every line but the first
+// of a multi-line Discord message, in MultilineModeSplit.
+const multilineContinuation = "| "
+
+// pastePreviewLength is the most of the first line shown next to a paste link
+const pastePreviewLength = 100
+
+// multilineContent prepares a Discord message with several lines for IRC,
+// according to Config.MultilineMode. The lines are joined with \n.
+//
+// plain is the message without any IRC formatting, which is what gets pasted.
+func (b *Bridge) multilineContent(content, plain string) string {
+	lines := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if b.Config.MultilineMode == MultilineModeFlatten {
+		return strings.Join(lines, " ")
+	}
+
+	max := b.Config.MultilineMaxLines
+	if b.Config.MultilineMode == MultilineModePaste && len(lines) > 0 {
+		length := utf8.RuneCountInString(content)
+		if len(lines) > max || length > b.Config.PasteMaxLength {
+			ctx, cancel := context.WithTimeout(context.Background(), pasteTimeout)
+			defer cancel()
+
+			link, err := b.paste.Upload(ctx, plain)
+			if err == nil {
+				return TruncateString(pastePreviewLength, lines[0]) + " (full message: " + link + ")"
+			}
+			log.WithField("error", err).Warnln("could not paste long message, truncating it instead")
+
+			if length > b.Config.PasteMaxLength {
+				return TruncateString(b.Config.PasteMaxLength, strings.Join(lines, "\n"))
+			}
+		}
+	}
+
+	// Leave room to say how many lines were dropped, keeping at least the first
+	if len(lines) > max {
+		if max == 1 {
+			return fmt.Sprintf("%s (%d more lines)", lines[0], len(lines)-1)
+		}
+
+		dropped := len(lines) - max + 1
+		lines = append(lines[:max-1], fmt.Sprintf("(%d more lines)", dropped))
+	}
+
+	for i := 1; i < len(lines); i++ {
+		lines[i] = multilineContinuation + lines[i]
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,30 @@
+package bridge
+
+import "testing"
+
+func TestMultilineMaxLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		content string
+		want    string
+	}{
+		{"fits", 3, "one\ntwo\nthree", "one\n| two\n| three"},
+		{"blank lines", 3, "one\n\n  \ntwo", "one\n| two"},
+		{"too many", 3, "one\ntwo\nthree\nfour\nfive", "one\n| two\n| (3 more lines)"},
+		{"one line", 1, "one\ntwo\nthree", "one (2 more lines)"},
+		{"one line fits", 1, "one", "one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestBridge(t, func(conf *Config) {
+				conf.MultilineMaxLines = tt.max
+			})
+
+			if got := tb.multilineContent(tt.content, tt.content); got != tt.want {
+				t.Errorf("multilineContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
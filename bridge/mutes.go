@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// muteList contains the Discord users and IRC nicks whose messages aren't
+// bridged for a while, set with the mute command. It is forgotten on restart.
+type muteList struct {
+	sync.Mutex
+
+	// muted has a timer for each mute, which removes it when it expires
+	muted map[string]*time.Timer
+}
+
+func newMuteList() *muteList {
+	return &muteList{muted: make(map[string]*time.Timer)}
+}
+
+// discordMuteKey and ircMuteKey keep Discord IDs and IRC nicks from colliding
+func discordMuteKey(id string) string { return "discord " + id }
+func ircMuteKey(nick string) string   { return "irc " + strings.ToLower(nick) }
+
+// Mute mutes the key for the duration, replacing any mute it already has.
+func (l *muteList) Mute(key string, duration time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if timer, ok := l.muted[key]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		l.Lock()
+		defer l.Unlock()
+
+		// It may have been muted again since
+		if l.muted[key] == timer {
+			delete(l.muted, key)
+		}
+	})
+	l.muted[key] = timer
+}
+
+// Unmute returns false if the key wasn't muted.
+func (l *muteList) Unmute(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	timer, ok := l.muted[key]
+	if ok {
+		timer.Stop()
+		delete(l.muted, key)
+	}
+	return ok
+}
+
+func (l *muteList) IsMuted(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	_, ok := l.muted[key]
+	return ok
+}
+
+// ignoreOverrides are the Discord users ignored or unignored with /bridge ignore and
+// /bridge unignore, which take the place of Config.IgnoredDiscordIDs until it is reloaded.
+// The zero value has no overrides.
+type ignoreOverrides struct {
+	sync.Mutex
+
+	// ignored says whether each Discord user, keyed by ID, is ignored
+	ignored map[string]bool
+}
+
+// Set overrides whether the Discord user is ignored.
+func (o *ignoreOverrides) Set(id string, ignored bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.ignored == nil {
+		o.ignored = make(map[string]bool)
+	}
+	o.ignored[id] = ignored
+}
+
+// Get returns whether the Discord user is ignored, if it has been overridden.
+func (o *ignoreOverrides) Get(id string) (ignored, ok bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	ignored, ok = o.ignored[id]
+	return ignored, ok
+}
+
+// Reset forgets every override, for when the config is reloaded.
+func (o *ignoreOverrides) Reset() {
+	o.Lock()
+	defer o.Unlock()
+
+	o.ignored = nil
+}
+
+// muteKey returns the key for someone given to the mute command: a Discord mention
+// or ID, the IRC nick of a Discord user's connection, or any other IRC nick.
+func (b *Bridge) muteKey(target string) string {
+	id := strings.TrimSuffix(strings.TrimLeft(target, "<@!"), ">")
+	if snowflakeRegex.MatchString(id) {
+		return discordMuteKey(id)
+	}
+
+	b.ircManager.connectionsMu.RLock()
+	defer b.ircManager.connectionsMu.RUnlock()
+	for _, con := range b.ircManager.ircConnections {
+		if strings.EqualFold(con.nick, target) {
+			return discordMuteKey(con.discord.ID)
+		}
+	}
+
+	return ircMuteKey(target)
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+)
+
+// nickPlaceholder stands in for the nick when working out what Config.NickFormat adds to it
+const nickPlaceholder = "\x00"
+
+// nickFormatFields are available to Config.NickFormat
+type nickFormatFields struct {
+	Nick   string
+	Suffix string
+}
+
+// nickAffixes returns what the format puts before and after each nick,
+// e.g "[D]" and "" for "[D]{{.Nick}}".
+//
+// The nick must appear exactly once, so that the bridge can recognise its own users.
+func nickAffixes(format, suffix string) (prefix, after string, err error) {
+	tmpl, err := template.New("nick_format").Parse(format)
+	if err != nil {
+		return "", "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, nickFormatFields{Nick: nickPlaceholder, Suffix: suffix}); err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(buf.String(), nickPlaceholder)
+	if len(parts) != 2 {
+		return "", "", errors.New("it must contain {{.Nick}} exactly once")
+	}
+	return parts[0], parts[1], nil
+}
+
+// checkNickAffixes returns an error if nicks with the prefix and suffix can't be used on IRC.
+//
+// Networks differ in which characters they allow, so only those that no network
+// allows are rejected. Others, like the "~" in the usual suffix, are left to the server.
+func checkNickAffixes(prefix, suffix string) error {
+	if prefix != "" && (strings.IndexByte("-#&:$", prefix[0]) >= 0 || ircnick.IsDigit(prefix[0])) {
+		return errors.Errorf("nicks can't start with %q", prefix[0])
+	}
+
+	for _, c := range []byte(prefix + suffix) {
+		if c <= ' ' || strings.IndexByte(",*?!@.", c) >= 0 {
+			return errors.Errorf("nicks can't contain %q", c)
+		}
+	}
+
+	// Leave room for at least one character of the nick
+	if len(prefix)+len(suffix) >= ircnick.MAXLENGTH {
+		return errors.Errorf("nicks can only be %d characters long", ircnick.MAXLENGTH)
+	}
+	return nil
+}
+
+// isPuppetNick returns true if the nick looks like one of our Discord users,
+// even if the server added underscores to it.
+func (b *Bridge) isPuppetNick(nick string) bool {
+	nick = strings.TrimRight(nick, "_")
+	return strings.HasPrefix(nick, b.nickPrefix) && strings.HasSuffix(nick, b.nickSuffix)
+}
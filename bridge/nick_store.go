@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// nickStore persists the IRC nick assigned to each Discord user,
+// so that nicks stay the same across restarts.
+//
+// If path is empty nothing is persisted.
+type nickStore struct {
+	sync.Mutex
+	path string
+
+	nicks map[string]storedNick
+}
+
+type storedNick struct {
+	// DiscordNick is the Discord nick IRCNick was generated from.
+	// If they've changed their nick since, IRCNick is no longer valid.
+	DiscordNick string `json:"discord_nick"`
+	IRCNick     string `json:"irc_nick"`
+}
+
+// loadNickStore reads the nicks stored at path. A missing file is not an error.
+func loadNickStore(path string) (*nickStore, error) {
+	s := &nickStore{
+		path:  path,
+		nicks: make(map[string]storedNick),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read state file")
+	}
+
+	if err := json.Unmarshal(data, &s.nicks); err != nil {
+		return nil, errors.Wrap(err, "could not parse state file")
+	}
+
+	return s, nil
+}
+
+// Get returns the stored IRC nick for the user, if it's still valid.
+func (s *nickStore) Get(user DiscordUser) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.nicks[user.ID]
+	if !ok || stored.DiscordNick != user.Nick || stored.IRCNick == "" {
+		return "", false
+	}
+
+	return stored.IRCNick, true
+}
+
+// Set stores the IRC nick for the user, saving to disk if it has changed.
+func (s *nickStore) Set(user DiscordUser, nick string) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := storedNick{DiscordNick: user.Nick, IRCNick: nick}
+	if s.nicks[user.ID] == entry {
+		return
+	}
+	s.nicks[user.ID] = entry
+
+	if err := s.save(); err != nil {
+		log.WithField("error", err).Errorln("could not save nick state")
+	}
+}
+
+// save must be called with the lock held.
+func (s *nickStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.nicks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file at path with data.
+func writeFileAtomic(path string, data []byte) error {
+	// Write to a temporary file first so that a crash can't leave a half written file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
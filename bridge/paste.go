@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pasteTimeout is how long to wait for the paste service before giving up
+const pasteTimeout = time.Second * 10
+
+// PasteUploader uploads text to a paste service, returning a link to it.
+//
+// The text is POSTed as the request body. Services that respond with JSON containing
+// a "key" (like hastebin) are linked to as /key on the same host, otherwise the body
+// of the response is taken to be the link (like paste.rs).
+type PasteUploader struct {
+	URL string
+
+	// Client is used to make requests, so that it can be swapped out
+	Client *http.Client
+}
+
+// NewPasteUploader returns a PasteUploader that POSTs to serviceURL.
+func NewPasteUploader(serviceURL string) *PasteUploader {
+	return &PasteUploader{
+		URL:    serviceURL,
+		Client: &http.Client{Timeout: pasteTimeout},
+	}
+}
+
+// Upload pastes the content and returns its link.
+func (p *PasteUploader) Upload(ctx context.Context, content string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, p.URL, strings.NewReader(content))
+	if err != nil {
+		return "", errors.Wrap(err, "could not create request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "could not upload paste")
+	}
+	defer resp.Body.Close()
+
+	// Links are short, so there's no need to read much
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read paste response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errors.Errorf("paste service responded with %s", resp.Status)
+	}
+
+	var document struct {
+		Key string `json:"key"`
+	}
+	if json.Unmarshal(body, &document) == nil && document.Key != "" {
+		base, err := url.Parse(p.URL)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid paste service url")
+		}
+		return (&url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/" + document.Key}).String(), nil
+	}
+
+	link := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		return "", errors.Errorf("paste service responded with %q, which is not a link", link)
+	}
+	return link, nil
+}
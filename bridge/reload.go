@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload applies a new config whilst the bridge is running, without restarting any
+// connections. IRC channels are joined and parted to match the new channel mappings.
+//
+// Settings that are only used when connecting (like the IRC server or the Discord token)
+// can't be reloaded. If any of them are different, or the new config is invalid,
+// an error is returned and nothing is changed.
+//
+// The config is switched over to on the loop, so that nothing it does sees half of it.
+func (b *Bridge) Reload(conf *Config) error {
+	if err := ResolveSecrets(conf); err != nil {
+		return err
+	}
+
+	result := make(chan error)
+	b.reloadChan <- func() {
+		result <- b.reloadConfig(conf)
+	}
+	return <-result
+}
+
+// reloadConfig is Reload, run on the loop.
+func (b *Bridge) reloadConfig(conf *Config) error {
+	apply, err := b.load(conf)
+	if err != nil {
+		return err
+	}
+
+	// The defaults have been filled in, so that only settings that were really changed are compared
+	if changed := restartOnlyChanges(b.Config, conf); len(changed) > 0 {
+		return errors.Errorf("%s can only be changed by restarting the bridge", strings.Join(changed, ", "))
+	}
+
+	old := b.Config
+	apply()
+
+	if old.IRCListenerName != conf.IRCListenerName {
+		log.Printf("Changed irc listener name from '%s' to '%s'", old.IRCListenerName, conf.IRCListenerName)
+		b.ircListener.Nick(conf.IRCListenerName)
+	}
+
+	if old.DiscordStatus != conf.DiscordStatus || old.DiscordActivity != conf.DiscordActivity ||
+		old.DiscordActivityType != conf.DiscordActivityType || old.DiscordStatusIRCHealth != conf.DiscordStatusIRCHealth {
+		b.discord.updatePresence()
+	}
+
+	if old.Debug != conf.Debug {
+		b.SetDebugMode(conf.Debug)
+	}
+
+	return nil
+}
+
+// restartOnlyChanges returns the names of the settings that are different
+// between the two configs, but can't be changed whilst the bridge is running.
+func restartOnlyChanges(old, conf *Config) []string {
+	changed := []string{}
+	check := func(name string, different bool) {
+		if different {
+			changed = append(changed, name)
+		}
+	}
+
+	check("discord bot token", old.DiscordBotToken != conf.DiscordBotToken)
+	check("guilds", !reflect.DeepEqual(configGuildIDs(old), configGuildIDs(conf)))
+	check("irc server", old.IRCServer != conf.IRCServer)
+	check("irc server password", old.IRCServerPass != conf.IRCServerPass)
+	check("irc user", old.IRCUser != conf.IRCUser || old.IRCRealname != conf.IRCRealname)
+	check("webirc", old.WebIRCPass != conf.WebIRCPass || old.WebIRCGateway != conf.WebIRCGateway || old.WebIRCHostnameFormat != conf.WebIRCHostnameFormat)
+	check("irc sasl login", old.IRCSASLLogin != conf.IRCSASLLogin || old.IRCSASLPassword != conf.IRCSASLPassword)
+	check("no tls", old.NoTLS != conf.NoTLS)
+	check("insecure", old.InsecureSkipVerify != conf.InsecureSkipVerify)
+	check("irc ca file", old.IRCCAFile != conf.IRCCAFile)
+	check("irc client certificate", old.IRCClientCertFile != conf.IRCClientCertFile || old.IRCClientKeyFile != conf.IRCClientKeyFile)
+	check("simple mode", old.SimpleMode != conf.SimpleMode)
+	check("irc send rate", old.IRCSendRate != conf.IRCSendRate || old.IRCSendBurst != conf.IRCSendBurst)
+
+	// Our existing puppets would stop being recognised as our own
+	check("suffix", old.Suffix != conf.Suffix || old.NickFormat != conf.NickFormat)
+
+	check("webhook prefix", old.WebhookPrefix != conf.WebhookPrefix)
+	check("webhook limit", old.WebhookLimit != conf.WebhookLimit || old.WebhooksPerChannel != conf.WebhooksPerChannel)
+	check("webhook rate limit", old.WebhookRateLimit != conf.WebhookRateLimit || old.WebhookRateInterval != conf.WebhookRateInterval)
+	check("webhook delivery", old.WebhookWaitForDelivery != conf.WebhookWaitForDelivery || old.WebhookWorkers != conf.WebhookWorkers)
+	check("relay typing", old.RelayTyping != conf.RelayTyping)
+	check("state path", old.StatePath != conf.StatePath)
+	check("links path", old.LinksPath != conf.LinksPath)
+	check("echo window", old.EchoWindow != conf.EchoWindow)
+	check("queue", old.QueuePath != conf.QueuePath || old.QueueSize != conf.QueueSize)
+	check("http address", old.HTTPAddr != conf.HTTPAddr)
+	check("dm relay channel", !strings.EqualFold(old.DMRelayIRCChannel, conf.DMRelayIRCChannel))
+
+	return changed
+}
@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// reloadConfig returns the config newTestBridge starts with, mapping #irc to channel instead.
+func reloadConfig(tb *testBridge, channel string) *Config {
+	return &Config{
+		DiscordBotToken: tb.Config.DiscordBotToken,
+		GuildID:         testGuildID,
+		ChannelMappings: map[string]string{"#irc": channel},
+		IRCServer:       tb.Config.IRCServer,
+		IRCListenerName: tb.Config.IRCListenerName,
+		WebhookPrefix:   tb.Config.WebhookPrefix,
+		SimpleMode:      true,
+	}
+}
+
+func TestReload(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	author := tb.addUser("500000000000000001", "alice", "")
+
+	if err := tb.Reload(reloadConfig(tb, "200000000000000002")); err != nil {
+		t.Fatal(err)
+	}
+
+	// #irc is still mapped, so nothing is parted, and it is joined again
+	if got := tb.irc.next(t); got != "JOIN #irc" {
+		t.Errorf("sent %q to irc, want JOIN #irc", got)
+	}
+
+	tb.discordMessageEventsChan <- &DiscordMessage{
+		Message: &discordgo.Message{ChannelID: "200000000000000002", GuildID: testGuildID, Author: author},
+		Content: "hello",
+	}
+	if got, want := tb.irc.next(t), "PRIVMSG #irc :<a​lice> hello"; got != want {
+		t.Errorf("sent %q to irc, want %q", got, want)
+	}
+}
+
+func TestReloadPartsRemovedChannels(t *testing.T) {
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.ChannelMappings = map[string]string{
+			"#irc": testChannelID,
+			"#old": "200000000000000002",
+		}
+	})
+	user := DiscordUser{ID: "500000000000000001", Username: "alice"}
+	_, puppet := tb.addPuppet(user, "alice~d", "#irc", "#old")
+
+	if err := tb.Reload(reloadConfig(tb, testChannelID)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, writer := range []*fakeIRC{tb.irc, puppet} {
+		if got, want := writer.next(t), "PART #old"; got != want {
+			t.Errorf("sent %q to irc, want %q", got, want)
+		}
+		if got, want := writer.next(t), "JOIN #irc"; got != want {
+			t.Errorf("sent %q to irc, want %q", got, want)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	tb := newTestBridge(t, nil)
+	old := tb.Config
+
+	invalid := reloadConfig(tb, "200000000000000002")
+	invalid.ContentReplacements = []ContentReplacement{{Pattern: "("}}
+	if err := tb.Reload(invalid); err == nil {
+		t.Fatal("invalid config was reloaded")
+	}
+
+	restart := reloadConfig(tb, "200000000000000002")
+	restart.IRCServer = "irc.example.com:6697"
+	if err := tb.Reload(restart); err == nil {
+		t.Fatal("config with a different irc server was reloaded")
+	}
+
+	// Nothing is changed
+	if tb.Config != old {
+		t.Error("config was replaced")
+	}
+	if mapping := tb.GetMappingByDiscord(testChannelID); mapping == nil || mapping.IRCChannel != "#irc" {
+		t.Errorf("mapping for %s = %+v, want #irc", testChannelID, mapping)
+	}
+	tb.irc.none(t)
+}
+
+func TestReloadWhilstRelaying(t *testing.T) {
+	tb := newTestBridge(t, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "hello"}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if err := tb.Reload(reloadConfig(tb, testChannelID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	for i := 0; i < 20; i++ {
+		tb.webhooks.next(t)
+	}
+}
+
+func TestReloadChannelOverrides(t *testing.T) {
+	override := func(format string) []ChannelOverride {
+		return []ChannelOverride{{DiscordChannel: testChannelID, DiscordUsernameFormat: format}}
+	}
+
+	tb := newTestBridge(t, func(conf *Config) {
+		conf.ChannelOverrides = override("{{.Username}} (irc)")
+	})
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "hello"}
+	if msg := tb.webhooks.next(t); msg.params.Username != "bob (irc)" {
+		t.Errorf("message was sent as %q, want %q", msg.params.Username, "bob (irc)")
+	}
+
+	// Messages are still being delivered whilst the overrides are replaced
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "hello"}
+		}
+	}()
+
+	conf := reloadConfig(tb, testChannelID)
+	conf.ChannelOverrides = override("[{{.Username}}]")
+	if err := tb.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	for i := 0; i < 10; i++ {
+		if msg := tb.webhooks.next(t); msg.params.Username != "bob (irc)" && msg.params.Username != "[bob]" {
+			t.Errorf("message was sent as %q, want one of the overrides", msg.params.Username)
+		}
+	}
+
+	tb.discordMessagesChan <- IRCMessage{IRCChannel: "#irc", Username: "bob", Message: "hello"}
+	if msg := tb.webhooks.next(t); msg.params.Username != "[bob]" {
+		t.Errorf("message was sent as %q after reloading, want %q", msg.params.Username, "[bob]")
+	}
+}
@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// mircColors are the RGB values of the mIRC colour codes 2 to 13.
+// White, black and the greys are left out, as they can't be read on
+// every background.
+var mircColors = map[int][3]int{
+	2:  {0, 0, 127},
+	3:  {0, 147, 0},
+	4:  {255, 0, 0},
+	5:  {127, 0, 0},
+	6:  {156, 0, 156},
+	7:  {252, 127, 0},
+	8:  {255, 255, 0},
+	9:  {0, 252, 0},
+	10: {0, 147, 147},
+	11: {0, 255, 255},
+	12: {0, 0, 252},
+	13: {255, 0, 255},
+}
+
+// nearestMIRCColor returns the mIRC colour code closest to the Discord colour, e.g 0xff0000.
+func nearestMIRCColor(color int) int {
+	r, g, b := color>>16&0xff, color>>8&0xff, color&0xff
+
+	best, bestDistance := 0, -1
+	for code, rgb := range mircColors {
+		dr, dg, db := r-rgb[0], g-rgb[1], b-rgb[2]
+		distance := dr*dr + dg*dg + db*db
+
+		// Break ties by code, as map iteration order is random
+		if bestDistance < 0 || distance < bestDistance || (distance == bestDistance && code < best) {
+			best, bestDistance = code, distance
+		}
+	}
+	return best
+}
+
+// roleColors remembers the colour and position of each role, for Config.IRCRoleColors.
+// It is cleared whenever a guild's roles change.
+type roleColors struct {
+	sync.Mutex
+	roles map[string]roleColor
+}
+
+type roleColor struct {
+	color    int
+	position int
+}
+
+func newRoleColors() *roleColors {
+	return &roleColors{roles: make(map[string]roleColor)}
+}
+
+func (c *roleColors) clear() {
+	c.Lock()
+	c.roles = make(map[string]roleColor)
+	c.Unlock()
+}
+
+// OnGuildCreate is also called after reconnecting, when roles may have changed.
+func (c *roleColors) OnGuildCreate(s *discordgo.Session, e *discordgo.GuildCreate) {
+	c.clear()
+}
+
+func (c *roleColors) OnGuildRoleUpdate(s *discordgo.Session, e *discordgo.GuildRoleUpdate) {
+	c.clear()
+}
+
+func (c *roleColors) OnGuildRoleDelete(s *discordgo.Session, e *discordgo.GuildRoleDelete) {
+	c.clear()
+}
+
+// role looks up the role in the state if it isn't already known.
+func (c *roleColors) role(state *discordgo.State, guildID, roleID string) (roleColor, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if role, ok := c.roles[roleID]; ok {
+		return role, true
+	}
+
+	role, err := state.Role(guildID, roleID)
+	if err != nil {
+		return roleColor{}, false
+	}
+
+	c.roles[roleID] = roleColor{color: role.Color, position: role.Position}
+	return c.roles[roleID], true
+}
+
+// authorColor returns the mIRC colour code of the author's highest coloured role,
+// or -1 if they don't have one.
+func (d *discordBot) authorColor(m *discordgo.Message) int {
+	var roles []string
+	if member, err := d.State.Member(m.GuildID, m.Author.ID); err == nil {
+		roles = member.Roles
+	} else if m.Member != nil {
+		roles = m.Member.Roles
+	}
+
+	highest := roleColor{position: -1}
+	for _, roleID := range roles {
+		role, ok := d.roleColors.role(d.State, m.GuildID, roleID)
+		if ok && role.color != 0 && role.position > highest.position {
+			highest = role
+		}
+	}
+
+	if highest.position < 0 {
+		return -1
+	}
+	return nearestMIRCColor(highest.color)
+}
+
+// colorName colours the name with the author's role colour, if Config.IRCRoleColors is enabled.
+func (d *discordBot) colorName(m *discordgo.Message, name string) string {
+	if !d.bridge.Config.IRCRoleColors {
+		return name
+	}
+
+	if code := d.authorColor(m); code >= 0 {
+		// Two digits, so that names starting with a digit aren't taken as part of the code
+		return fmt.Sprintf("\x03%02d%s\x03", code, name)
+	}
+	return name
+}
@@ -0,0 +1,45 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ResolveSecrets reads the secrets that are given as files in the config,
+// like DiscordBotTokenFile, into their fields. A file takes precedence over
+// the secret itself, so resolving the same config twice does nothing new.
+//
+// New and Reload call this, but it can be used to Validate a config first.
+func ResolveSecrets(conf *Config) error {
+	secrets := []struct {
+		name  string
+		file  string
+		value *string
+	}{
+		{"discord bot token", conf.DiscordBotTokenFile, &conf.DiscordBotToken},
+		{"irc server password", conf.IRCServerPassFile, &conf.IRCServerPass},
+		{"webirc password", conf.WebIRCPassFile, &conf.WebIRCPass},
+		{"irc sasl password", conf.IRCSASLPasswordFile, &conf.IRCSASLPassword},
+	}
+
+	for _, s := range secrets {
+		if s.file == "" {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s file", s.name)
+		}
+
+		// Files written by editors and echo usually end with a newline
+		*s.value = strings.TrimRight(string(contents), "\r\n")
+		if *s.value == "" {
+			return errors.Errorf("%s file %s is empty", s.name, s.file)
+		}
+	}
+
+	return nil
+}
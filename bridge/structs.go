@@ -9,7 +9,11 @@ type DiscordMessage struct {
 	*discordgo.Message
 	Content  string
 	IsAction bool
+	IsEdit   bool   // is this an edit of a previously bridged message?
 	PmTarget string // target username, for PMs
+
+	// ParentChannelID is the channel a thread belongs to, for messages sent in threads
+	ParentChannelID string
 }
 
 // IRCMessage is a chat message sent to Discord (from IRCListener)
@@ -18,6 +22,9 @@ type IRCMessage struct {
 	Username   string
 	Message    string
 	IsAction   bool
+
+	// Mentions contains the IDs of the Discord users mentioned by their IRC nick
+	Mentions []string
 }
 
 // DiscordUser is information that IRC needs to know about a user
@@ -32,6 +39,62 @@ type DiscordUser struct {
 
 // Mapping is a mapping between a Discord channel and an IRC channel (essentially a tuple).
 type Mapping struct {
+	GuildID        string // the guild owning DiscordChannel
 	DiscordChannel string
 	IRCChannel     string
+
+	// IRCChannelKey is the key (password) needed to join IRCChannel, if any.
+	// It must never be logged or shown to Discord.
+	IRCChannelKey string
+
+	// Direction is which way messages are bridged, set by ChannelOverride.Direction.
+	// One of MappingDirectionBoth (default), MappingDirectionToIRC or MappingDirectionToDiscord.
+	Direction string
+}
+
+// ToIRC returns true if messages in the Discord channel are sent to IRC.
+func (m *Mapping) ToIRC() bool {
+	return m.Direction != MappingDirectionToDiscord
+}
+
+// ToDiscord returns true if messages in the IRC channel are sent to Discord.
+func (m *Mapping) ToDiscord() bool {
+	return m.Direction != MappingDirectionToIRC
+}
+
+// ircMessageFields are available to Config.IRCMessageFormat
+type ircMessageFields struct {
+	DisplayName   string // their nick in the guild, broken up so that it doesn't ping them on IRC
+	Nick          string // the username, broken up so that it doesn't ping them on IRC
+	Username      string
+	Discriminator string
+	Channel       string
+	Content       string
+}
+
+// webIRCHostnameFields are available to Config.WebIRCHostnameFormat
+type webIRCHostnameFields struct {
+	ID       string
+	Hash     string // the start of the SHA-256 of the ID in hex, which never changes
+	Username string
+	Bot      bool
+}
+
+// discordUsernameFields are available to Config.DiscordUsernameFormat
+type discordUsernameFields struct {
+	Username string // their IRC nick
+	Channel  string
+	Linked   string // the Discord name of the account they've linked, if any
+}
+
+// avatarFields are available to Config.DefaultAvatarURL
+type avatarFields struct {
+	Username string // their IRC nick
+	Channel  string
+}
+
+// stickerFields are available to Config.StickerFormat
+type stickerFields struct {
+	Name string
+	URL  string // empty for animated (Lottie) stickers
 }
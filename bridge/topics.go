@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	ircf "github.com/qaisjp/go-discord-irc/irc/format"
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// discordTopicLength is the maximum length of a Discord channel topic
+const discordTopicLength = 1024
+
+// topicRelay relays topic changes between IRC channels and their Discord channels.
+//
+// The last topic seen on each side is remembered, so that topics we set aren't
+// relayed straight back, and Discord channel updates that don't touch the topic are ignored.
+type topicRelay struct {
+	sync.Mutex
+	listener *ircListener
+
+	// irc contains the topic of each IRC channel, keyed by lowercase channel name
+	irc map[string]string
+
+	// discord contains the topic of each Discord channel, keyed by channel ID
+	discord map[string]string
+}
+
+func newTopicRelay(listener *ircListener) *topicRelay {
+	r := &topicRelay{
+		listener: listener,
+		irc:      make(map[string]string),
+		discord:  make(map[string]string),
+	}
+
+	// RPL_TOPIC, sent when we join a channel
+	listener.AddCallback("332", r.OnTopicReply)
+	listener.AddCallback("TOPIC", r.OnTopic)
+
+	// ERR_CHANOPRIVSNEEDED
+	listener.AddCallback("482", func(e *irc.Event) {
+		log.WithField("channel", e.Arguments[1]).Warnln("Could not change IRC topic as we are not a channel operator")
+	})
+
+	return r
+}
+
+func (r *topicRelay) OnTopicReply(e *irc.Event) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.irc[strings.ToLower(e.Arguments[1])] = e.Message()
+}
+
+func (r *topicRelay) OnTopic(e *irc.Event) {
+	channel, topic := e.Arguments[0], e.Message()
+
+	r.Lock()
+	r.irc[strings.ToLower(channel)] = topic
+	r.Unlock()
+
+	// We only set the topic when it was changed on Discord
+	if e.Nick == r.listener.GetNick() || !r.listener.bridge.Config.RelayTopicsToDiscord {
+		return
+	}
+
+	topic = ircf.Strip(colorRegex.ReplaceAllString(topic, ""))
+	if utf8.RuneCountInString(topic) > discordTopicLength {
+		topic = string([]rune(topic)[:discordTopicLength])
+	}
+
+	for _, mapping := range r.listener.bridge.GetMappingsByIRC(channel) {
+		if mapping.ToDiscord() {
+			r.setDiscordTopic(mapping.DiscordChannel, e.Nick, topic)
+		}
+	}
+}
+
+// setDiscordTopic changes the topic of the Discord channel, or if we aren't
+// allowed to, tells the channel about it instead.
+func (r *topicRelay) setDiscordTopic(channelID, nick, topic string) {
+	// Remember it first, so that the update we cause is ignored
+	r.Lock()
+	same := r.discord[channelID] == topic
+	r.discord[channelID] = topic
+	r.Unlock()
+
+	if same {
+		return
+	}
+
+	discord := r.listener.bridge.discord
+	_, err := discord.ChannelEdit(channelID, &discordgo.ChannelEdit{Topic: topic})
+	if err == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"error":   err,
+		"channel": channelID,
+	}).Warnln("could not set discord channel topic (does the bot have Manage Channels?), sending it instead")
+
+	_, err = discord.ChannelMessageSend(channelID, fmt.Sprintf("%s changed the topic to: %s", nick, topic))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"channel": channelID,
+		}).Errorln("could not relay topic to discord")
+	}
+}
+
+// OnDiscordChannels remembers the topics of Discord channels, so that
+// we can tell which channel updates change the topic.
+func (r *topicRelay) OnDiscordChannels(channels []*discordgo.Channel) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, channel := range channels {
+		r.discord[channel.ID] = channel.Topic
+	}
+}
+
+// OnDiscordChannelUpdate sets the topic of the IRC channel when the topic of its Discord channel changes.
+func (r *topicRelay) OnDiscordChannelUpdate(channel *discordgo.Channel) {
+	r.Lock()
+	old, known := r.discord[channel.ID]
+	r.discord[channel.ID] = channel.Topic
+	r.Unlock()
+
+	if !known || old == channel.Topic || !r.listener.bridge.Config.RelayTopicsToIRC {
+		return
+	}
+
+	mapping := r.listener.bridge.GetMappingByDiscord(channel.ID)
+	if mapping == nil || !mapping.ToIRC() {
+		return
+	}
+
+	// IRC topics are a single line
+	topic := strings.Join(strings.Fields(channel.Topic), " ")
+
+	r.Lock()
+	same := r.irc[strings.ToLower(mapping.IRCChannel)] == topic
+	r.Unlock()
+
+	if !same {
+		r.listener.SendRaw(fmt.Sprintf("TOPIC %s :%s", mapping.IRCChannel, topic))
+	}
+}
@@ -0,0 +1,327 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// snowflakeRegex matches Discord IDs
+var snowflakeRegex = regexp.MustCompile(`^\d{15,21}$`)
+
+// botTokenRegex matches the three dot separated parts of a Discord bot token
+var botTokenRegex = regexp.MustCompile(`^[\w-]+\.[\w-]+\.[\w-]+$`)
+
+// Validate checks the config without connecting to anything,
+// returning every problem found (as a *multierror.Error), or nil.
+//
+// The config is not modified.
+func Validate(conf *Config) error {
+	var result error
+	problem := func(format string, args ...interface{}) {
+		result = multierror.Append(result, errors.Errorf(format, args...))
+	}
+
+	if conf.DiscordBotToken == "" {
+		problem("discord bot token is missing")
+	} else if !botTokenRegex.MatchString(strings.TrimPrefix(conf.DiscordBotToken, "Bot ")) {
+		problem("discord bot token does not look like a bot token")
+	}
+
+	if conf.IRCServer == "" {
+		problem("irc server is missing")
+	}
+
+	if conf.IRCCAFile != "" {
+		if _, err := loadCAFile(conf.IRCCAFile); err != nil {
+			problem("irc ca file is invalid: %s", err)
+		}
+	}
+
+	if (conf.IRCClientCertFile == "") != (conf.IRCClientKeyFile == "") {
+		problem("irc client certificate and key must be given together")
+	} else if conf.IRCClientCertFile != "" {
+		if conf.NoTLS {
+			problem("irc client certificate needs tls")
+		} else if _, err := tls.LoadX509KeyPair(conf.IRCClientCertFile, conf.IRCClientKeyFile); err != nil {
+			problem("irc client certificate is invalid: %s", err)
+		}
+	}
+
+	if conf.IRCListenerName == "" {
+		problem("irc listener name is missing")
+	}
+
+	nickFormat := conf.NickFormat
+	if nickFormat == "" {
+		nickFormat = DefaultNickFormat
+	}
+	if prefix, suffix, err := nickAffixes(nickFormat, conf.Suffix); err != nil {
+		problem("nick format is invalid: %s", err)
+	} else if err := checkNickAffixes(prefix, suffix); err != nil {
+		problem("nick format or suffix is invalid: %s", err)
+	}
+
+	if strings.ContainsAny(conf.IRCUser, " @!") {
+		problem("irc user %q can't contain spaces, @ or !", conf.IRCUser)
+	}
+
+	if conf.DMRelayIRCChannel != "" && !strings.ContainsAny(conf.DMRelayIRCChannel[:1], "#&") {
+		problem("dm relay irc channel %q must start with # or &", conf.DMRelayIRCChannel)
+	}
+
+	if conf.WebhookPrefix == "" {
+		problem("webhook prefix is missing")
+	}
+
+	switch conf.IRCFormatting {
+	case "", IRCFormattingTranslate, IRCFormattingStrip:
+	default:
+		problem("irc formatting %q should be %q or %q", conf.IRCFormatting, IRCFormattingTranslate, IRCFormattingStrip)
+	}
+
+	switch conf.AttachmentMode {
+	case "", AttachmentModeURL, AttachmentModeURLWithMeta, AttachmentModeSuppress:
+	default:
+		problem("attachment mode %q should be %q, %q or %q", conf.AttachmentMode, AttachmentModeURL, AttachmentModeURLWithMeta, AttachmentModeSuppress)
+	}
+
+	switch conf.SpoilerMode {
+	case "", SpoilerModeRedact, SpoilerModeKeep:
+	default:
+		problem("spoiler mode %q should be %q or %q", conf.SpoilerMode, SpoilerModeRedact, SpoilerModeKeep)
+	}
+
+	switch conf.MultilineMode {
+	case "", MultilineModeSplit, MultilineModeFlatten:
+	case MultilineModePaste:
+		if conf.PasteServiceURL == "" {
+			problem("multiline mode %q needs a paste service url", conf.MultilineMode)
+		}
+	default:
+		problem("multiline mode %q should be %q, %q or %q", conf.MultilineMode, MultilineModeSplit, MultilineModeFlatten, MultilineModePaste)
+	}
+
+	if conf.PasteServiceURL != "" {
+		if u, err := url.Parse(conf.PasteServiceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("paste service url %q should be an http or https url", conf.PasteServiceURL)
+		}
+	}
+
+	switch conf.BotMentions {
+	case "", BotMentionsIgnore, BotMentionsStrip, BotMentionsRespond:
+	default:
+		problem("bot mentions %q should be %q, %q or %q", conf.BotMentions, BotMentionsIgnore, BotMentionsStrip, BotMentionsRespond)
+	}
+
+	switch discordgo.Status(conf.DiscordStatus) {
+	case "", discordgo.StatusOnline, discordgo.StatusIdle, discordgo.StatusDoNotDisturb, discordgo.StatusInvisible:
+	default:
+		problem("discord status %q should be online, idle, dnd or invisible", conf.DiscordStatus)
+	}
+
+	if _, ok := discordActivityTypes[conf.DiscordActivityType]; conf.DiscordActivityType != "" && !ok {
+		problem("discord activity type %q should be playing, listening, watching, competing or custom", conf.DiscordActivityType)
+	}
+
+	switch conf.IRCNotices {
+	case "", IRCNoticesPrefix, IRCNoticesDrop, IRCNoticesNicks:
+	default:
+		problem("irc notices %q should be %q, %q or %q", conf.IRCNotices, IRCNoticesPrefix, IRCNoticesDrop, IRCNoticesNicks)
+	}
+
+	switch conf.IRCMentions {
+	case "", IRCMentionsNicks, IRCMentionsAll, IRCMentionsNone:
+	default:
+		problem("irc mentions %q should be %q, %q or %q", conf.IRCMentions, IRCMentionsNicks, IRCMentionsAll, IRCMentionsNone)
+	}
+
+	if _, err := template.New("").Parse(conf.WebIRCHostnameFormat); err != nil {
+		problem("webirc hostname format is invalid: %s", err)
+	}
+
+	if strings.ContainsAny(conf.WebIRCGateway, " :") {
+		problem("webirc gateway %q can't contain spaces or :", conf.WebIRCGateway)
+	}
+
+	if _, err := template.New("").Parse(conf.IRCMessageFormat); err != nil {
+		problem("irc message format is invalid: %s", err)
+	}
+
+	if _, err := template.New("").Parse(conf.IRCActionFormat); err != nil {
+		problem("irc action format is invalid: %s", err)
+	}
+
+	if _, err := template.New("").Parse(conf.DiscordUsernameFormat); err != nil {
+		problem("discord username format is invalid: %s", err)
+	}
+
+	switch conf.AvatarSource {
+	case "", AvatarSourceURL:
+		if _, err := template.New("").Parse(conf.DefaultAvatarURL); err != nil {
+			problem("default avatar url is invalid: %s", err)
+		}
+	case AvatarSourceLocal:
+		if conf.HTTPAddr == "" {
+			problem("avatar source %q needs an http address to serve avatars on", conf.AvatarSource)
+		}
+
+		if u, err := url.Parse(conf.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("avatar source %q needs a public url (like https://bridge.example.com) for Discord to fetch avatars from", conf.AvatarSource)
+		}
+
+		for _, c := range conf.AvatarPalette {
+			if _, err := parseHexColor(c); err != nil {
+				problem("avatar palette is invalid: %s", err)
+			}
+		}
+	default:
+		problem("avatar source %q should be %q or %q", conf.AvatarSource, AvatarSourceURL, AvatarSourceLocal)
+	}
+
+	for _, kind := range conf.SystemMessages {
+		switch kind {
+		case SystemMessageJoins, SystemMessageBoosts, SystemMessageThreads:
+		default:
+			problem("system message %q should be %q, %q or %q", kind, SystemMessageJoins, SystemMessageBoosts, SystemMessageThreads)
+		}
+	}
+
+	if conf.IRCSendRate < 0 {
+		problem("irc send rate %v should not be negative", conf.IRCSendRate)
+	}
+
+	if conf.MaxPuppets < 0 {
+		problem("max puppets %d should not be negative", conf.MaxPuppets)
+	}
+
+	if conf.QueueSize < 0 {
+		problem("queue size %d should not be negative", conf.QueueSize)
+	}
+
+	if _, err := template.New("").Parse(conf.StickerFormat); err != nil {
+		problem("sticker format is invalid: %s", err)
+	}
+
+	for _, id := range conf.AdminRoleIDs {
+		if !snowflakeRegex.MatchString(id) {
+			problem("admin role id %q is not a Discord ID", id)
+		}
+	}
+
+	for _, r := range conf.ContentReplacements {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			problem("content replacement pattern %q is invalid: %s", r.Pattern, err)
+		}
+	}
+
+	guilds := []GuildConfig{{GuildID: conf.GuildID, ChannelMappings: conf.ChannelMappings}}
+	guilds = append(guilds, conf.Guilds...)
+
+	mappings := []*Mapping{}
+	for i, guild := range guilds {
+		if guild.GuildID == "" {
+			if i == 0 {
+				problem("guild id is missing")
+			} else {
+				problem("guild %d has no guild id", i)
+			}
+		} else if !snowflakeRegex.MatchString(guild.GuildID) {
+			problem("guild id %q is not a Discord ID", guild.GuildID)
+		}
+
+		mappings = append(mappings, mappingsFromMap(guild.GuildID, guild.ChannelMappings)...)
+	}
+
+	for _, mapping := range mappings {
+		if !strings.HasPrefix(mapping.IRCChannel, "#") && !strings.HasPrefix(mapping.IRCChannel, "&") {
+			problem("irc channel %q should start with #", mapping.IRCChannel)
+		}
+
+		if !snowflakeRegex.MatchString(mapping.DiscordChannel) {
+			problem("discord channel %q (mapped to %s) is not a Discord ID", mapping.DiscordChannel, mapping.IRCChannel)
+		}
+	}
+
+	for _, o := range conf.ChannelOverrides {
+		found := false
+		for _, mapping := range mappings {
+			found = found || mapping.DiscordChannel == o.DiscordChannel
+		}
+		if !found {
+			problem("channel override for %q does not match a mapped discord channel", o.DiscordChannel)
+		}
+
+		if _, err := template.New("").Parse(o.DiscordUsernameFormat); err != nil {
+			problem("discord username format for %s is invalid: %s", o.DiscordChannel, err)
+		}
+
+		if _, err := template.New("").Parse(o.DefaultAvatarURL); err != nil {
+			problem("default avatar url for %s is invalid: %s", o.DiscordChannel, err)
+		}
+
+		switch o.Direction {
+		case "", MappingDirectionBoth, MappingDirectionToIRC, MappingDirectionToDiscord:
+		default:
+			problem("direction %q for %s should be %q, %q or %q", o.Direction, o.DiscordChannel, MappingDirectionBoth, MappingDirectionToIRC, MappingDirectionToDiscord)
+		}
+
+		for _, f := range o.Filters {
+			if _, err := regexp.Compile(f.Pattern); err != nil {
+				problem("filter pattern %q for %s is invalid: %s", f.Pattern, o.DiscordChannel, err)
+			}
+
+			switch f.Direction {
+			case "", MappingDirectionBoth, MappingDirectionToIRC, MappingDirectionToDiscord:
+			default:
+				problem("filter direction %q for %s should be %q, %q or %q", f.Direction, o.DiscordChannel, MappingDirectionBoth, MappingDirectionToIRC, MappingDirectionToDiscord)
+			}
+		}
+	}
+
+	if conf.VoiceIRCChannel != "" {
+		found := false
+		for _, mapping := range mappings {
+			found = found || strings.EqualFold(mapping.IRCChannel, conf.VoiceIRCChannel)
+		}
+		if !found {
+			problem("voice irc channel %q is not a mapped irc channel", conf.VoiceIRCChannel)
+		}
+	}
+
+	if err := checkDuplicateMappings(mappings); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result
+}
+
+// checkDuplicateMappings returns an error naming every Discord channel that is mapped more than once.
+//
+// IRC channels can be mirrored to several Discord channels, but each Discord channel can only
+// be bridged to one IRC channel. Our webhook messages are never bridged back, so mirrors can't loop.
+func checkDuplicateMappings(mappings []*Mapping) error {
+	var result error
+
+	discordSeen := make(map[string]bool)
+	ircKeys := make(map[string]string)
+	for _, mapping := range mappings {
+		if discordSeen[mapping.DiscordChannel] {
+			result = multierror.Append(result, errors.Errorf("discord channel %s is mapped more than once", mapping.DiscordChannel))
+		}
+		discordSeen[mapping.DiscordChannel] = true
+
+		if key, ok := ircKeys[mapping.IRCChannel]; ok && key != mapping.IRCChannelKey {
+			result = multierror.Append(result, errors.Errorf("irc channel %s is mapped with different keys", mapping.IRCChannel))
+		}
+		ircKeys[mapping.IRCChannel] = mapping.IRCChannelKey
+	}
+
+	return result
+}
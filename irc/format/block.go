@@ -6,6 +6,7 @@ import "fmt"
 
 type Block struct {
 	Bold, Italic, Underline, Reverse bool
+	Strikethrough                    bool
 	Color, Highlight                 int
 	Text                             string
 }
@@ -23,6 +24,7 @@ func NewBlock(prev *Block, text string) *Block {
 		this.Italic = prev.Italic
 		this.Underline = prev.Underline
 		this.Reverse = prev.Reverse
+		this.Strikethrough = prev.Strikethrough
 		this.Color = prev.Color
 		this.Highlight = prev.Highlight
 	}
@@ -43,12 +45,13 @@ func (this Block) Equals(other Block) bool {
 		this.Italic == other.Italic &&
 		this.Underline == other.Underline &&
 		this.Reverse == other.Reverse &&
+		this.Strikethrough == other.Strikethrough &&
 		this.Color == other.Color &&
 		this.Highlight == other.Highlight
 }
 
 func (this Block) IsPlain() bool {
-	return (!this.Bold && !this.Italic && !this.Underline && !this.Reverse &&
+	return (!this.Bold && !this.Italic && !this.Underline && !this.Reverse && !this.Strikethrough &&
 		this.Color == -1 && this.Highlight == -1)
 }
 
@@ -81,6 +84,8 @@ func (this *Block) SetField(code string, val bool) {
 		this.Italic = val
 	} else if code == U {
 		this.Underline = val
+	} else if code == S {
+		this.Strikethrough = val
 	} else {
 		panic("Unknown code " + code)
 	}
@@ -93,6 +98,8 @@ func (this Block) GetField(code string) bool {
 		return this.Italic
 	} else if code == U {
 		return this.Underline
+	} else if code == S {
+		return this.Strikethrough
 	} else {
 		panic("Unknown code " + code)
 	}
@@ -9,6 +9,8 @@ import (
 const B = "\x02"
 const I = "\x1d"
 const U = "\x1f"
+const S = "\x1e"
+const M = "\x11"
 const C = "\x03"
 const R = "\x16"
 const O = "\x0f"
@@ -19,6 +21,7 @@ var Keys = map[string]string{
 	"\x02": "bold",
 	"\x1d": "italic",
 	"\x1f": "underline",
+	"\x1e": "strikethrough",
 }
 
 const TagBold = "b"
@@ -48,11 +51,13 @@ func Parse(text string) (result []*Block) {
 		nextStart := -1
 
 		switch ch {
-		// bold, italic, underline
+		// bold, italic, underline, strikethrough
 		case '\x02':
 			fallthrough
 		case '\x1d':
 			fallthrough
+		case '\x1e':
+			fallthrough
 		case '\x1f':
 			{
 				prev = current
@@ -86,6 +91,13 @@ func Parse(text string) (result []*Block) {
 				current.Reverse = !prev.Reverse
 			}
 
+		// monospace, which has no equivalent so only the code is removed
+		case '\x11':
+			{
+				prev = current
+				current = NewBlock(prev, "")
+			}
+
 		// reset
 		case '\x0f':
 			{
@@ -113,3 +125,12 @@ func Parse(text string) (result []*Block) {
 
 	return result
 }
+
+// Strip removes all formatting codes from text. Colors must be removed beforehand.
+func Strip(text string) string {
+	result := ""
+	for _, block := range Parse(text) {
+		result += block.Text
+	}
+	return result
+}
@@ -1,7 +1,23 @@
 package ircf
 
+import (
+	"regexp"
+	"strings"
+)
+
 // From https://github.com/reactiflux/discord-irc/blob/87a3458bdde48290960405f2bf0cf53b7ff17b5e/lib/formatting.js#L25
 
+// markers are the markdown equivalents of each style, outermost first
+var markers = []struct {
+	code   string
+	marker string
+}{
+	{I, "*"},
+	{B, "**"},
+	{U, "__"},
+	{S, "~~"},
+}
+
 func IRCToMarkdown(text string) string {
 	blocks := Parse(text)
 	for _, b := range blocks {
@@ -13,42 +29,168 @@ func IRCToMarkdown(text string) string {
 
 	mdText := ""
 
+	// The codes of the styles currently open, innermost last
+	open := []string{}
+
 	for i := 0; i <= len(blocks); i++ {
 		// Default to unstyled blocks when index out of range
 		block := &Block{}
 		if i < len(blocks) {
 			block = blocks[i]
 		}
-		prevBlock := &Block{}
-		if i > 0 {
-			prevBlock = blocks[i-1]
+
+		// Styles can overlap on IRC (e.g "\x02a\x1db\x02c\x1d") but markdown must nest.
+		// Find the outermost open style that is ending...
+		closeFrom := len(open)
+		for j, code := range open {
+			if !block.GetField(code) {
+				closeFrom = j
+				break
+			}
 		}
 
-		// Add start markers when style turns from false to true
-		if !prevBlock.Italic && block.Italic {
-			mdText += "*"
+		// ... then close it and everything inside it, in reverse order to maintain nesting
+		for j := len(open) - 1; j >= closeFrom; j-- {
+			mdText += markerFor(open[j])
 		}
-		if !prevBlock.Bold && block.Bold {
-			mdText += "**"
+		open = open[:closeFrom]
+
+		// Add start markers for any style that should be open but isn't,
+		// which includes the inner styles that were just closed
+		for _, m := range markers {
+			if block.GetField(m.code) && !contains(open, m.code) {
+				mdText += m.marker
+				open = append(open, m.code)
+			}
 		}
-		if !prevBlock.Underline && block.Underline {
-			mdText += "__"
+
+		mdText += block.Text
+	}
+
+	return mdText
+}
+
+func markerFor(code string) string {
+	for _, m := range markers {
+		if m.code == code {
+			return m.marker
 		}
+	}
+	panic("Unknown code " + code)
+}
 
-		// Add end markers when style turns from true to false
-		// (and apply in reverse order to maintain nesting)
-		if prevBlock.Underline && !block.Underline {
-			mdText += "__"
+func contains(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
 		}
-		if prevBlock.Bold && !block.Bold {
-			mdText += "**"
+	}
+	return false
+}
+
+// escapedMarkdown matches markdown characters escaped with a backslash
+var escapedMarkdown = regexp.MustCompile(`\\([*_~` + "`" + `|\\])`)
+
+// Markdown patterns in order of precedence. Code is handled separately.
+var markdownStyles = []struct {
+	pattern *regexp.Regexp
+	code    string
+}{
+	{regexp.MustCompile(`(?s)\*\*(.+?)\*\*`), B},
+	{regexp.MustCompile(`(?s)__(.+?)__`), U},
+	{regexp.MustCompile(`(?s)~~(.+?)~~`), S},
+	{regexp.MustCompile(`(?s)\*([^*\s](?:.*?[^*\s])?)\*`), I},
+	{regexp.MustCompile(`(?s)\b_([^_\s](?:.*?[^_\s])?)_\b`), I},
+}
+
+var codeBlock = regexp.MustCompile("(?s)```(?:[a-zA-Z0-9+-]*\n)?(.*?)```")
+var inlineCode = regexp.MustCompile("`([^`]+)`")
+
+// placeholders are private use characters that stand in for text
+// that must not be touched by the markdown patterns
+const placeholderBase = '\uE000'
+
+// MarkdownToIRC converts Discord markdown into IRC formatting codes.
+//
+// Styles are closed at the end of every line and reopened at the start of the next,
+// as each line is sent to IRC as a separate message.
+func MarkdownToIRC(text string) string {
+	protected := []string{}
+	protect := func(s string) string {
+		protected = append(protected, s)
+		return string(rune(placeholderBase + len(protected) - 1))
+	}
+
+	// Nothing inside code is formatted, and backslashes are literal
+	text = codeBlock.ReplaceAllStringFunc(text, func(s string) string {
+		return protect(M + strings.Trim(codeBlock.FindStringSubmatch(s)[1], "\n") + M)
+	})
+	text = inlineCode.ReplaceAllStringFunc(text, func(s string) string {
+		return protect(M + s[1:len(s)-1] + M)
+	})
+
+	// Escaped characters are kept as they are, without the backslash
+	text = escapedMarkdown.ReplaceAllStringFunc(text, func(s string) string {
+		return protect(s[1:])
+	})
+
+	for _, style := range markdownStyles {
+		text = style.pattern.ReplaceAllString(text, style.code+"$1"+style.code)
+	}
+
+	// Restore everything that was protected
+	text = replacePlaceholders(text, protected)
+
+	return balanceLines(text)
+}
+
+func replacePlaceholders(text string, protected []string) string {
+	result := strings.Builder{}
+	for _, r := range text {
+		if i := int(r - placeholderBase); r >= placeholderBase && i < len(protected) {
+			result.WriteString(protected[i])
+		} else {
+			result.WriteRune(r)
 		}
-		if prevBlock.Italic && !block.Italic {
-			mdText += "*"
+	}
+	return result.String()
+}
+
+// balanceLines closes any formatting left open at the end of a line,
+// and reopens it at the start of the next line.
+func balanceLines(text string) string {
+	lines := strings.Split(text, "\n")
+	open := []string{}
+
+	for i, line := range lines {
+		reopen := strings.Join(open, "")
+
+		for _, r := range line {
+			code := string(r)
+			switch code {
+			case B, I, U, S, M:
+				if j := indexOf(open, code); j >= 0 {
+					open = append(open[:j], open[j+1:]...)
+				} else {
+					open = append(open, code)
+				}
+			}
 		}
 
-		mdText += block.Text
+		for j := len(open) - 1; j >= 0; j-- {
+			line += open[j]
+		}
+		lines[i] = reopen + line
 	}
 
-	return mdText
+	return strings.Join(lines, "\n")
+}
+
+func indexOf(codes []string, code string) int {
+	for i, c := range codes {
+		if c == code {
+			return i
+		}
+	}
+	return -1
 }
@@ -1,27 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"reflect"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/qaisjp/go-discord-irc/bridge"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// shutdownTimeout is how long to wait for the bridge to close before giving up
+const shutdownTimeout = time.Second * 10
+
 func main() {
 	config := flag.String("config", "", "Config file to read configuration stuff from")
 	simple := flag.Bool("simple", false, "When in simple mode, the bridge will only spawn one IRC connection for listening and speaking")
 	debugMode := flag.Bool("debug", false, "Debug mode? (false = use value from settings)")
 	no_tls := flag.Bool("no-tls", false, "Avoids using TLS att all when connecting to IRC server ")
 	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification? (INSECURE MODE) (false = use value from settings)")
+	validate := flag.Bool("validate", false, "Check the config file for problems and exit, without connecting")
 
 	flag.Parse()
 
@@ -43,6 +49,11 @@ func main() {
 	viper.SetConfigType(configType)
 	viper.AddConfigPath(configPath)
 
+	// Secrets can also be given in the environment, e.g DISCORD_TOKEN
+	for _, key := range []string{"discord_token", "irc_pass", "webirc_pass", "irc_sasl_pass"} {
+		viper.BindEnv(key, strings.ToUpper(key))
+	}
+
 	log.WithFields(log.Fields{
 		"ConfigName": configName,
 		"ConfigType": configType,
@@ -54,64 +65,39 @@ func main() {
 		log.Fatalln(errors.Wrap(err, "could not read config"))
 	}
 
-	discordBotToken := viper.GetString("discord_token")             // Discord Bot User Token
-	channelMappings := viper.GetStringMapString("channel_mappings") // Discord:IRC mappings in format '#discord1:#irc1,#discord2:#irc2,...'
-	ircServer := viper.GetString("irc_server")                      // Server address to use, example `irc.freenode.net:7000`.
-	ircPassword := viper.GetString("irc_pass")                      // Optional password for connecting to the IRC server
-	guildID := viper.GetString("guild_id")                          // Guild to use
-	webIRCPass := viper.GetString("webirc_pass")                    // Password for WEBIRC
-	identify := viper.GetString("nickserv_identify")                // NickServ IDENTIFY for Listener
-	//
-	if !*debugMode {
-		*debugMode = viper.GetBool("debug")
+	flags := configFlags{
+		simple:   *simple,
+		debug:    *debugMode,
+		noTLS:    *no_tls,
+		insecure: *insecure,
 	}
-	//
-	if !*no_tls {
-		*no_tls = viper.GetBool("no_tls")
-	}
-	if !*insecure {
-		*insecure = viper.GetBool("insecure")
+
+	conf, err := readConfig(viper, flags)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	//
-	viper.SetDefault("irc_listener_name", "~d")
-	ircUsername := viper.GetString("irc_listener_name") // Name for IRC-side bot, for listening to messages.
-	//
-	viper.SetDefault("suffix", "~d")
-	suffix := viper.GetString("suffix") // The suffix to append to IRC connections (not in use when simple mode is on)
-	//
-	webhookPrefix := viper.GetString("webhook_prefix") // the unique prefix for this bottiful bot
-	//
-	viper.SetDefault("webhook_limit", 2)
-	webhookLimit := viper.GetInt("webhook_limit")
 
-	if webIRCPass == "" {
+	if conf.WebIRCPass == "" {
 		log.Warnln("webirc_pass is empty")
 	}
 
 	// Validate mappings
-	if len(channelMappings) == 0 {
+	if len(conf.ChannelMappings) == 0 && len(conf.Guilds) == 0 {
 		log.Warnln("Channel mappings are missing!")
 	}
 
-	SetLogDebug(*debugMode)
-
-	dib, err := bridge.New(&bridge.Config{
-		DiscordBotToken:    discordBotToken,
-		GuildID:            guildID,
-		IRCListenerName:    ircUsername,
-		IRCServer:          ircServer,
-		IRCServerPass:      ircPassword,
-		NickServIdentify:   identify,
-		WebIRCPass:         webIRCPass,
-		Debug:              *debugMode,
-		NoTLS:              *no_tls,
-		InsecureSkipVerify: *insecure,
-		Suffix:             suffix,
-		SimpleMode:         *simple,
-		ChannelMappings:    channelMappings,
-		WebhookPrefix:      webhookPrefix,
-		WebhookLimit:       webhookLimit,
-	})
+	SetLogDebug(conf.Debug)
+
+	if *validate {
+		if err := bridge.Validate(conf); err != nil {
+			logProblems(err)
+			log.Fatalln("Config is invalid.")
+		}
+		log.Infoln("Config is valid.")
+		return
+	}
+
+	dib, err := bridge.New(conf)
 
 	if err != nil {
 		log.WithField("error", err).Fatalln("Go-Discord-IRC failed to initialise.")
@@ -132,38 +118,34 @@ func main() {
 	// Inform the user that things are happening!
 	log.Infoln("Go-Discord-IRC is now running. Press Ctrl-C to exit.")
 
+	// Reads the config file again, for live changes and "/bridge reload"
+	reload := func() error {
+		conf, err := readConfig(viper, flags)
+		if err != nil {
+			return errors.Wrap(err, "could not read the new configuration")
+		}
+
+		if err := dib.Reload(conf); err != nil {
+			return err
+		}
+
+		SetLogDebug(conf.Debug)
+		return nil
+	}
+	dib.SetReloadFunc(reload)
+
 	// Start watching for live changes...
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		log.Println("Configuration file has changed!")
-		if newUsername := viper.GetString("irc_listener_name"); ircUsername != newUsername {
-			log.Printf("Changed irc_listener_name from '%s' to '%s'", ircUsername, newUsername)
-			// Listener name has changed
-			ircUsername = newUsername
-			dib.SetIRCListenerName(ircUsername)
-		}
 
-		if debug := viper.GetBool("debug"); *debugMode != debug {
-			log.Printf("Debug changed from %+v to %+v", *debugMode, debug)
-			*debugMode = debug
-			dib.SetDebugMode(debug)
-			SetLogDebug(debug)
+		if err := reload(); err != nil {
+			logProblems(err)
+			log.Errorln("The new configuration was not applied.")
+			return
 		}
 
-		chans := viper.GetStringMapString("channel_mappings")
-		equalChans := reflect.DeepEqual(chans, channelMappings)
-		if !equalChans {
-			log.Println("Channel mappings updated!")
-			if len(chans) == 0 {
-				log.Println("Channel mappings are missing!")
-			}
-
-			if err := dib.SetChannelMappings(chans); err != nil {
-				log.WithField("error", err).Errorln("could not set channel mappings")
-			} else {
-				channelMappings = chans
-			}
-		}
+		log.Infoln("The new configuration has been applied.")
 	})
 
 	// Watch for a shutdown signal
@@ -171,8 +153,410 @@ func main() {
 
 	log.Infoln("Shutting down Go-Discord-IRC...")
 
-	// Cleanly close down the bridge.
-	dib.Close()
+	// Cleanly close down the bridge, without hanging forever if something is stuck.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := dib.CloseContext(ctx); err != nil {
+		log.WithField("error", err).Errorln("Go-Discord-IRC did not shut down cleanly.")
+	}
+}
+
+// configFlags are the command line flags that can override the config file
+type configFlags struct {
+	simple, debug, noTLS, insecure bool
+}
+
+// readConfig reads the bridge config from the config file, applying any flags.
+func readConfig(viper *viper.Viper, flags configFlags) (*bridge.Config, error) {
+	discordBotToken := viper.GetString("discord_token")             // Discord Bot User Token
+	channelMappings := viper.GetStringMapString("channel_mappings") // Discord:IRC mappings in format '#discord1:#irc1,#discord2:#irc2,...'
+	ircServer := viper.GetString("irc_server")                      // Server address to use, example `irc.freenode.net:7000`.
+	ircPassword := viper.GetString("irc_pass")                      // Optional password for connecting to the IRC server
+	guildID := viper.GetString("guild_id")                          // Guild to use
+	webIRCPass := viper.GetString("webirc_pass")                    // Password for WEBIRC
+	identify := viper.GetString("nickserv_identify")                // NickServ IDENTIFY for Listener
+	nickServWait := viper.GetBool("nickserv_wait")                  // wait for NickServ before joining channels
+	saslLogin := viper.GetString("irc_sasl_login")                  // Optional SASL PLAIN account name
+	saslPassword := viper.GetString("irc_sasl_pass")                // Optional SASL PLAIN password
+	clientCertFile := viper.GetString("irc_client_cert")            // Optional PEM client certificate, for CertFP
+	clientKeyFile := viper.GetString("irc_client_key")              // and its key
+	//
+	discordBotTokenFile := viper.GetString("discord_token_file") // Optional files to read the secrets above from
+	ircPasswordFile := viper.GetString("irc_pass_file")
+	webIRCPassFile := viper.GetString("webirc_pass_file")
+	saslPasswordFile := viper.GetString("irc_sasl_pass_file")
+	//
+	webIRCGateway := viper.GetString("webirc_gateway")                // gateway name sent with WEBIRC, defaults to "discord"
+	webIRCHostnameFormat := viper.GetString("webirc_hostname_format") // e.g "{{.ID}}.discord"
+	//
+	debug := flags.debug || viper.GetBool("debug")
+	//
+	noTLS := flags.noTLS || viper.GetBool("no_tls")
+	insecure := flags.insecure || viper.GetBool("insecure")
+	ircCAFile := viper.GetString("irc_ca_file") // PEM bundle to verify the IRC server against
+	//
+	viper.SetDefault("irc_listener_name", "~d")
+	ircUsername := viper.GetString("irc_listener_name") // Name for IRC-side bot, for listening to messages.
+	ircUser := viper.GetString("irc_user")              // ident of the listener, defaults to discord
+	ircRealname := viper.GetString("irc_realname")      // realname of the listener, defaults to the ident
+	//
+	viper.SetDefault("suffix", "~d")
+	suffix := viper.GetString("suffix") // The suffix to append to IRC connections (not in use when simple mode is on)
+	//
+	nickFormat := viper.GetString("nick_format") // e.g "[D]{{.Nick}}", defaults to the nick followed by the suffix
+	//
+	webhookPrefix := viper.GetString("webhook_prefix") // the unique prefix for this bottiful bot
+	//
+	maxPuppets := viper.GetInt("max_puppets") // most IRC connections for Discord users, 0 for no limit
+	//
+	guilds, err := readGuilds(viper) // Additional guilds, each with their own channel mappings
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read guilds")
+	}
+	//
+	viper.SetDefault("webhook_limit", 2)
+	webhookLimit := viper.GetInt("webhook_limit")
+	viper.SetDefault("webhooks_per_channel", 1)
+	webhooksPerChannel := viper.GetInt("webhooks_per_channel") // webhooks each channel rotates between
+	//
+	viper.SetDefault("webhook_rate_limit", 5)
+	webhookRateLimit := viper.GetInt("webhook_rate_limit") // max messages per channel every webhook_rate_interval
+	viper.SetDefault("webhook_rate_interval", "2s")
+	webhookRateInterval := viper.GetDuration("webhook_rate_interval")
+	//
+	webhookWaitForDelivery := viper.GetBool("webhook_wait_for_delivery") // wait for Discord to create each message
+	viper.SetDefault("webhook_workers", 10)
+	webhookWorkers := viper.GetInt("webhook_workers") // most messages sent to Discord at once
+	//
+	notifyDeliveryFailures := viper.GetBool("notify_delivery_failures") // tell IRC when its messages aren't reaching Discord
+	//
+	ircFormatting := viper.GetString("irc_formatting") // "translate" or "strip" IRC formatting codes
+	viper.SetDefault("discord_formatting", true)
+	discordFormatting := viper.GetBool("discord_formatting") // translate Discord markdown to IRC formatting codes
+	attachmentMode := viper.GetString("attachment_mode")     // "url", "url-with-meta" or "suppress"
+	spoilerMode := viper.GetString("spoiler_mode")           // "redact" or "keep" Discord spoilers
+	multilineMode := viper.GetString("multiline_mode")       // "split", "flatten" or "paste" multi-line messages
+	multilineMaxLines := viper.GetInt("multiline_max_lines") // max IRC lines per Discord message
+	//
+	pasteServiceURL := viper.GetString("paste_service_url") // where to POST long messages in paste mode
+	pasteMaxLength := viper.GetInt("paste_max_length")      // longest message to send without pasting
+	//
+	ircMessageFormat := viper.GetString("irc_message_format")           // text/template for messages sent by the listener
+	ircActionFormat := viper.GetString("irc_action_format")             // text/template for actions sent by the listener
+	ircRoleColors := viper.GetBool("irc_role_colors")                   // colour listener names by Discord role
+	discordUsernameFormat := viper.GetString("discord_username_format") // text/template for webhook usernames
+	stickerFormat := viper.GetString("sticker_format")                  // text/template for Discord stickers
+	//
+	avatarSource := viper.GetString("avatar_source")          // "url" or "local" avatars for unknown IRC users
+	defaultAvatarURL := viper.GetString("default_avatar_url") // text/template for avatars of unknown IRC users
+	avatarPalette := viper.GetStringSlice("avatar_palette")   // colors for local avatars
+	publicURL := viper.GetString("public_url")                // where Discord can reach http_addr
+	//
+	relayJoinsParts := viper.GetBool("relay_joins_parts") // tell Discord when IRC users join or leave
+	relayTyping := viper.GetBool("relay_typing")          // tell IRC when Discord users are typing
+	//
+	ircRenameNotices := viper.GetBool("irc_rename_notices") // tell IRC channels when a Discord user's nick changes
+	//
+	relayTopicsToDiscord := viper.GetBool("relay_topics_to_discord") // set Discord channel topics from IRC
+	relayTopicsToIRC := viper.GetBool("relay_topics_to_irc")         // set IRC channel topics from Discord
+	relayVoiceStates := viper.GetBool("relay_voice_states")          // tell IRC when Discord users join voice
+	voiceIRCChannel := viper.GetString("voice_irc_channel")          // where to tell IRC about voice, if not by category
+	//
+	relayReactionSummaries := viper.GetBool("relay_reaction_summaries") // summarise Discord reactions to IRC
+	relayPins := viper.GetBool("relay_pins")                            // tell IRC when Discord messages are pinned
+	systemMessages := viper.GetStringSlice("system_messages")           // Discord system messages to tell IRC about
+	viper.SetDefault("reaction_summary_window", "30s")
+	reactionSummaryWindow := viper.GetDuration("reaction_summary_window") // at most one summary per message per window
+	//
+	viper.SetDefault("irc_reconnect_delay", "5s")
+	ircReconnectDelay := viper.GetDuration("irc_reconnect_delay")    // initial delay before reconnecting, doubled each attempt
+	ircReconnectRetries := viper.GetInt("irc_reconnect_max_retries") // 0 = retry forever
+	//
+	ircSendRate := viper.GetFloat64("irc_send_rate") // lines each IRC connection can send a second, 0 = no limit
+	viper.SetDefault("irc_send_burst", 5)
+	ircSendBurst := viper.GetInt("irc_send_burst") // lines that can be sent at once before irc_send_rate applies
+	//
+	viper.SetDefault("discord_resume_timeout", "2m")
+	discordResumeTimeout := viper.GetDuration("discord_resume_timeout") // open a new Discord session if discordgo hasn't reconnected by then
+	//
+	discordStatus := viper.GetString("discord_status")                   // "online", "idle", "dnd" or "invisible"
+	discordActivity := viper.GetString("discord_activity")               // e.g "#irc", shown as "Watching #irc"
+	discordActivityType := viper.GetString("discord_activity_type")      // "playing", "listening", "watching", "competing" or "custom"
+	discordStatusIRCHealth := viper.GetBool("discord_status_irc_health") // show the bot as idle whilst IRC is disconnected
+	//
+	floodLimit := viper.GetInt("flood_limit") // messages each user can send per flood_interval, 0 = unlimited
+	viper.SetDefault("flood_interval", "10s")
+	floodInterval := viper.GetDuration("flood_interval")
+	viper.SetDefault("flood_summary", true)
+	floodSummary := viper.GetBool("flood_summary") // say how many messages were dropped
+	//
+	presenceDebounce := viper.GetDuration("presence_debounce") // wait before treating Discord users as offline
+	//
+	echoWindow := viper.GetDuration("echo_window")  // ignore other bridges repeating what we sent, 0 = disabled
+	echoNicks := viper.GetStringSlice("echo_nicks") // IRC nicks (with * and ? wildcards) of other bridges
+	//
+	statePath := viper.GetString("state_path") // optional file to persist IRC nicks across restarts
+	httpAddr := viper.GetString("http_addr")   // optional address for the /healthz and /status endpoints
+	queuePath := viper.GetString("queue_path") // optional file to keep undelivered IRC messages across restarts
+	viper.SetDefault("queue_size", 1000)
+	queueSize := viper.GetInt("queue_size") // most messages kept in queue_path, the oldest are dropped
+	//
+	linksPath := viper.GetString("links_path") // optional file to store linked IRC and Discord accounts, enables /link
+	//
+	viper.SetDefault("reply_quote_length", 80)
+	replyQuoteLength := viper.GetInt("reply_quote_length") // max length of the quoted message in Discord replies
+	viper.SetDefault("thread_name_prefix", true)
+	threadNamePrefix := viper.GetBool("thread_name_prefix") // prefix Discord thread messages with the thread name
+	//
+	relayThreadCreation := viper.GetBool("relay_thread_creation") // tell IRC when Discord threads are started
+	//
+	commandPrefix := viper.GetString("command_prefix") // prefix for commands like !help, defaults to "!"
+	botMentions := viper.GetString("bot_mentions")     // "ignore", "strip" or "respond"
+	pingReply := viper.GetBool("ping_reply")           // reply "Pong!" to "ping" on Discord
+	ctcpVersion := viper.GetString("ctcp_version")     // reply to CTCP VERSION
+	//
+	dmRelayIRCChannel := viper.GetString("dm_relay_irc_channel") // IRC channel that DMs to the bot are sent to
+	//
+	adminRoleIDs := viper.GetStringSlice("admin_role_ids")   // Discord roles allowed to use /bridge
+	ircAdminHosts := viper.GetStringSlice("irc_admin_hosts") // nick!user@host masks allowed to use admin commands on IRC
+	//
+	ignoredDiscordIDs := viper.GetStringSlice("ignored_discord_ids") // Discord users (e.g bots) not to bridge
+	ignoredIRCNicks := viper.GetStringSlice("ignored_irc_nicks")     // IRC nicks (with * and ? wildcards) not to bridge
+	allowEveryoneFromIRC := viper.GetBool("allow_everyone_from_irc") // let IRC users ping @everyone and @here
+	ircMentions := viper.GetString("irc_mentions")                   // "nicks", "all" or "none"
+	//
+	minDiscordAccountAge := viper.GetDuration("min_discord_account_age") // don't bridge Discord accounts newer than this
+	minDiscordMemberAge := viper.GetDuration("min_discord_member_age")   // don't bridge members that joined more recently than this
+	//
+	ircNotices := viper.GetString("irc_notices")               // "prefix", "drop" or "nicks"
+	ircNoticeNicks := viper.GetStringSlice("irc_notice_nicks") // nicks whose notices are bridged with "nicks"
+	//
+	contentReplacements, err := readContentReplacements(viper)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read content replacements")
+	}
+	channelOverrides, err := readChannelOverrides(viper)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read channel overrides")
+	}
+
+	conf := &bridge.Config{
+		DiscordBotToken:        discordBotToken,
+		GuildID:                guildID,
+		IRCListenerName:        ircUsername,
+		IRCUser:                ircUser,
+		IRCRealname:            ircRealname,
+		IRCServer:              ircServer,
+		IRCServerPass:          ircPassword,
+		NickServIdentify:       identify,
+		NickServWait:           nickServWait,
+		IRCSASLLogin:           saslLogin,
+		IRCSASLPassword:        saslPassword,
+		DiscordBotTokenFile:    discordBotTokenFile,
+		IRCServerPassFile:      ircPasswordFile,
+		WebIRCPassFile:         webIRCPassFile,
+		IRCSASLPasswordFile:    saslPasswordFile,
+		IRCClientCertFile:      clientCertFile,
+		IRCClientKeyFile:       clientKeyFile,
+		WebIRCPass:             webIRCPass,
+		WebIRCGateway:          webIRCGateway,
+		WebIRCHostnameFormat:   webIRCHostnameFormat,
+		Debug:                  debug,
+		NoTLS:                  noTLS,
+		InsecureSkipVerify:     insecure,
+		IRCCAFile:              ircCAFile,
+		Suffix:                 suffix,
+		NickFormat:             nickFormat,
+		SimpleMode:             flags.simple,
+		MaxPuppets:             maxPuppets,
+		ChannelMappings:        channelMappings,
+		Guilds:                 guilds,
+		WebhookPrefix:          webhookPrefix,
+		WebhookLimit:           webhookLimit,
+		WebhooksPerChannel:     webhooksPerChannel,
+		WebhookWaitForDelivery: webhookWaitForDelivery,
+		WebhookWorkers:         webhookWorkers,
+		NotifyDeliveryFailures: notifyDeliveryFailures,
+		WebhookRateLimit:       webhookRateLimit,
+		WebhookRateInterval:    webhookRateInterval,
+		ReplyQuoteLength:       replyQuoteLength,
+		ThreadNamePrefix:       threadNamePrefix,
+		RelayThreadCreation:    relayThreadCreation,
+		IRCFormatting:          ircFormatting,
+		DiscordFormatting:      discordFormatting,
+		AttachmentMode:         attachmentMode,
+		SpoilerMode:            spoilerMode,
+		MultilineMode:          multilineMode,
+		MultilineMaxLines:      multilineMaxLines,
+		PasteServiceURL:        pasteServiceURL,
+		PasteMaxLength:         pasteMaxLength,
+		IRCMessageFormat:       ircMessageFormat,
+		IRCRoleColors:          ircRoleColors,
+		IRCActionFormat:        ircActionFormat,
+		DiscordUsernameFormat:  discordUsernameFormat,
+		StickerFormat:          stickerFormat,
+		AvatarSource:           avatarSource,
+		DefaultAvatarURL:       defaultAvatarURL,
+		AvatarPalette:          avatarPalette,
+		PublicURL:              publicURL,
+		RelayJoinsParts:        relayJoinsParts,
+		IRCRenameNotices:       ircRenameNotices,
+		RelayTyping:            relayTyping,
+		RelayTopicsToDiscord:   relayTopicsToDiscord,
+		RelayTopicsToIRC:       relayTopicsToIRC,
+		RelayVoiceStates:       relayVoiceStates,
+		VoiceIRCChannel:        voiceIRCChannel,
+		RelayReactionSummaries: relayReactionSummaries,
+		RelayPins:              relayPins,
+		SystemMessages:         systemMessages,
+		ReactionSummaryWindow:  reactionSummaryWindow,
+		IRCReconnectBaseDelay:  ircReconnectDelay,
+		IRCSendRate:            ircSendRate,
+		IRCSendBurst:           ircSendBurst,
+		IRCReconnectMaxRetries: ircReconnectRetries,
+		DiscordResumeTimeout:   discordResumeTimeout,
+		DiscordStatus:          discordStatus,
+		DiscordActivity:        discordActivity,
+		DiscordActivityType:    discordActivityType,
+		DiscordStatusIRCHealth: discordStatusIRCHealth,
+		FloodLimit:             floodLimit,
+		FloodInterval:          floodInterval,
+		FloodSummary:           floodSummary,
+		PresenceDebounce:       presenceDebounce,
+		StatePath:              statePath,
+		LinksPath:              linksPath,
+		EchoWindow:             echoWindow,
+		EchoNicks:              echoNicks,
+		QueuePath:              queuePath,
+		QueueSize:              queueSize,
+		HTTPAddr:               httpAddr,
+		CommandPrefix:          commandPrefix,
+		DMRelayIRCChannel:      dmRelayIRCChannel,
+		BotMentions:            botMentions,
+		PingReply:              pingReply,
+		CTCPVersion:            ctcpVersion,
+		AdminRoleIDs:           adminRoleIDs,
+		IRCAdminHosts:          ircAdminHosts,
+		IgnoredDiscordIDs:      ignoredDiscordIDs,
+		MinDiscordAccountAge:   minDiscordAccountAge,
+		MinDiscordMemberAge:    minDiscordMemberAge,
+		IgnoredIRCNicks:        ignoredIRCNicks,
+		AllowEveryoneFromIRC:   allowEveryoneFromIRC,
+		IRCMentions:            ircMentions,
+		IRCNotices:             ircNotices,
+		IRCNoticeNicks:         ircNoticeNicks,
+		ContentReplacements:    contentReplacements,
+		ChannelOverrides:       channelOverrides,
+	}
+
+	if err := bridge.ResolveSecrets(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// logProblems logs each problem with the config on its own line.
+func logProblems(err error) {
+	if merr, ok := err.(*multierror.Error); ok {
+		for _, problem := range merr.Errors {
+			log.Errorln(problem)
+		}
+		return
+	}
+	log.Errorln(err)
+}
+
+// readGuilds reads the list of additional guilds to bridge.
+//
+// guilds:
+//   - guild_id: 123
+//     channel_mappings:
+//     "#irc": 456
+func readGuilds(v *viper.Viper) ([]bridge.GuildConfig, error) {
+	var raw []struct {
+		GuildID         string            `mapstructure:"guild_id"`
+		ChannelMappings map[string]string `mapstructure:"channel_mappings"`
+	}
+
+	if err := v.UnmarshalKey("guilds", &raw); err != nil {
+		return nil, err
+	}
+
+	guilds := []bridge.GuildConfig{}
+	for _, g := range raw {
+		guilds = append(guilds, bridge.GuildConfig{
+			GuildID:         g.GuildID,
+			ChannelMappings: g.ChannelMappings,
+		})
+	}
+	return guilds, nil
+}
+
+// readContentReplacements reads the replacements made to Discord messages.
+//
+// content_replacements:
+//   - pattern: "(?i)secret"
+//     replacement: "[redacted]"
+func readContentReplacements(v *viper.Viper) ([]bridge.ContentReplacement, error) {
+	var raw []struct {
+		Pattern     string `mapstructure:"pattern"`
+		Replacement string `mapstructure:"replacement"`
+	}
+
+	if err := v.UnmarshalKey("content_replacements", &raw); err != nil {
+		return nil, err
+	}
+
+	replacements := []bridge.ContentReplacement{}
+	for _, r := range raw {
+		replacements = append(replacements, bridge.ContentReplacement{
+			Pattern:     r.Pattern,
+			Replacement: r.Replacement,
+		})
+	}
+	return replacements, nil
+}
+
+// readChannelOverrides reads the settings that are different for some Discord channels.
+//
+// channel_overrides:
+//   - discord_channel: 456
+//     discord_username_format: "{{.Username}} [IRC]"
+//     default_avatar_url: "https://example.com/{{urlquery .Username}}.png"
+//     filters: [{pattern: "^[.?]\\w+", direction: both}]
+func readChannelOverrides(v *viper.Viper) ([]bridge.ChannelOverride, error) {
+	var raw []struct {
+		DiscordChannel        string `mapstructure:"discord_channel"`
+		DiscordUsernameFormat string `mapstructure:"discord_username_format"`
+		DefaultAvatarURL      string `mapstructure:"default_avatar_url"`
+		Direction             string `mapstructure:"direction"`
+		Filters               []struct {
+			Pattern   string `mapstructure:"pattern"`
+			Direction string `mapstructure:"direction"`
+		} `mapstructure:"filters"`
+	}
+
+	if err := v.UnmarshalKey("channel_overrides", &raw); err != nil {
+		return nil, err
+	}
+
+	overrides := []bridge.ChannelOverride{}
+	for _, o := range raw {
+		filters := []bridge.MessageFilter{}
+		for _, f := range o.Filters {
+			filters = append(filters, bridge.MessageFilter{Pattern: f.Pattern, Direction: f.Direction})
+		}
+
+		overrides = append(overrides, bridge.ChannelOverride{
+			DiscordChannel:        o.DiscordChannel,
+			DiscordUsernameFormat: o.DiscordUsernameFormat,
+			DefaultAvatarURL:      o.DefaultAvatarURL,
+			Direction:             o.Direction,
+			Filters:               filters,
+		})
+	}
+	return overrides, nil
 }
 
 func SetLogDebug(debug bool) {
@@ -0,0 +1,128 @@
+package transmitter
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// RateLimit describes how many messages may be sent with a single webhook per interval.
+//
+// Discord allows roughly 5 messages per webhook every 2 seconds.
+type RateLimit struct {
+	Messages int
+	Interval time.Duration
+}
+
+// DefaultRateLimit is used when a RateLimit is not fully specified.
+var DefaultRateLimit = RateLimit{
+	Messages: 5,
+	Interval: 2 * time.Second,
+}
+
+// A bucket is a token bucket for a single webhook.
+//
+// Tokens are allowed to go negative so that callers queue up
+// in the order in which they reserved their token.
+type bucket struct {
+	sync.Mutex
+
+	tokens   float64
+	capacity float64
+	perToken time.Duration
+
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newBucket(limit RateLimit) *bucket {
+	return &bucket{
+		tokens:   float64(limit.Messages),
+		capacity: float64(limit.Messages),
+		perToken: limit.Interval / time.Duration(limit.Messages),
+		last:     time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.
+func (b *bucket) reserve() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+
+	// Refill tokens for the time that has passed
+	b.tokens += float64(now.Sub(b.last)) / float64(b.perToken)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens * float64(b.perToken))
+	}
+
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+
+	return wait
+}
+
+// backoff stops anyone from sending to this channel for the given duration.
+func (b *bucket) backoff(d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if until := time.Now().Add(d); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// wait blocks until the given webhook is allowed to send another message.
+func (t *Transmitter) wait(webhook string) {
+	t.bucketsMu.Lock()
+	b, ok := t.buckets[webhook]
+	if !ok {
+		b = newBucket(t.rateLimit)
+		t.buckets[webhook] = b
+	}
+	t.bucketsMu.Unlock()
+
+	if d := b.reserve(); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// backoff delays all future messages sent with the webhook by d.
+func (t *Transmitter) backoff(webhook string, d time.Duration) {
+	t.bucketsMu.Lock()
+	b, ok := t.buckets[webhook]
+	t.bucketsMu.Unlock()
+
+	if ok {
+		b.backoff(d)
+	}
+}
+
+// retryAfter returns how long Discord has asked us to wait, if err is a 429.
+func retryAfter(err error) (time.Duration, bool) {
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok || restErr.Response == nil || restErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	// Retry-After is given in seconds, but may contain a fraction
+	secs, err := strconv.ParseFloat(restErr.Response.Header.Get("Retry-After"), 64)
+	if err != nil || secs <= 0 {
+		return time.Second, true
+	}
+
+	return time.Duration(secs * float64(time.Second)), true
+}
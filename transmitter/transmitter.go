@@ -1,13 +1,14 @@
 // Package transmitter provides functionality for transmitting
 // arbitrary webhook messages on Discord.
 //
-// Existing webhooks are used for messages sent, and if necessary,
-// new webhooks are created to ensure messages in multiple popular channels
-// don't cause messages to be registered as new users.
+// Each channel is given a small pool of webhooks, which messages rotate between,
+// so that busy channels aren't held up by the rate limit of a single webhook.
 package transmitter
 
 import (
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 
@@ -15,17 +16,56 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Session is the part of *discordgo.Session a Transmitter uses,
+// so that it can be given a fake one in tests.
+type Session interface {
+	GuildWebhooks(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error)
+	WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+	WebhookEdit(webhookID, name, avatar, channelID string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+	WebhookDelete(webhookID string, options ...discordgo.RequestOption) error
+	WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+}
+
 // A Transmitter represents a message manager instance for a single guild.
 type Transmitter struct {
-	session *discordgo.Session
+	session Session
 	guild   string
 	prefix  string
 
-	webhook *discordgo.Webhook
+	// limit is the most webhooks to create in the guild, or zero for no limit
+	limit int
+
+	// perChannel is the most webhooks to create in each channel
+	perChannel int
+
+	pools   map[string]*pool
+	poolsMu sync.Mutex
+
+	rateLimit RateLimit
+	buckets   map[string]*bucket
+	bucketsMu sync.Mutex
+
+	// waitForDelivery makes Message wait for Discord to create the message
+	waitForDelivery bool
+}
+
+// A pool contains the webhooks for a single channel.
+type pool struct {
+	webhooks []*discordgo.Webhook
+	next     int
+	lastUsed time.Time
 }
 
-// New returns a new Transmitter given a Discord session, guild ID, and webhook prefix.
-func New(session *discordgo.Session, guild string, prefix string, limit int) (*Transmitter, error) {
+// maxRateLimitRetries is the number of times a message is retried after a 429.
+const maxRateLimitRetries = 3
+
+// New returns a new Transmitter given a Discord session, guild ID, webhook prefix,
+// the limits on the number of webhooks to create in the guild and in each channel,
+// and the rate at which messages may be sent with each webhook.
+//
+// If waitForDelivery is set, Message waits until Discord has created each message
+// and returns it, otherwise Discord responds as soon as it has accepted the message.
+func New(session Session, guild string, prefix string, limit int, perChannel int, rateLimit RateLimit, waitForDelivery bool) (*Transmitter, error) {
 	// Get all existing webhooks
 	hooks, err := session.GuildWebhooks(guild)
 
@@ -48,12 +88,27 @@ func New(session *discordgo.Session, guild string, prefix string, limit int) (*T
 		}
 	}
 
+	if rateLimit.Messages <= 0 || rateLimit.Interval <= 0 {
+		rateLimit = DefaultRateLimit
+	}
+
+	if perChannel <= 0 {
+		perChannel = 1
+	}
+
 	t := &Transmitter{
 		session: session,
 		guild:   guild,
 		prefix:  prefix,
 
-		webhook: nil,
+		limit:      limit,
+		perChannel: perChannel,
+		pools:      make(map[string]*pool),
+
+		rateLimit: rateLimit,
+		buckets:   make(map[string]*bucket),
+
+		waitForDelivery: waitForDelivery,
 	}
 
 	return t, nil
@@ -61,69 +116,82 @@ func New(session *discordgo.Session, guild string, prefix string, limit int) (*T
 
 // Close immediately stops all active webhook timers and deletes webhooks.
 func (t *Transmitter) Close() error {
+	t.poolsMu.Lock()
+	defer t.poolsMu.Unlock()
+
 	var result error
 
 	// Delete all the webhooks
-	if wh := t.webhook; wh != nil {
-		err := t.session.WebhookDelete(wh.ID)
-		if err != nil {
-			result = multierror.Append(result, errors.Wrapf(err, "could not remove hook %s", wh.ID)).ErrorOrNil()
+	for _, p := range t.pools {
+		for _, wh := range p.webhooks {
+			err := t.session.WebhookDelete(wh.ID)
+			if err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "could not remove hook %s", wh.ID))
+			}
 		}
 	}
+	t.pools = make(map[string]*pool)
 
 	return result
 }
 
 // Message transmits a message to the given channel with the given username, avatarURL, and content.
 //
+// Only the mentions allowed by mentions will ping anyone. If nil, Discord's default is used,
+// which is to allow all mentions, including @everyone.
+//
 // Note that this function will wait until Discord responds with an answer.
-func (t *Transmitter) Message(channel string, username string, avatarURL string, content string) (err error) {
-	// Create a webhook if there is no free webhook
-	if t.webhook == nil {
-		err = t.createWebhook(channel)
-		if err != nil {
-			return err // this error is already wrapped by us
-		}
+// Messages exceeding the rate limit for the webhook are delayed, not dropped.
+//
+// The created message is only returned if the Transmitter waits for delivery.
+func (t *Transmitter) Message(channel string, username string, avatarURL string, content string, mentions *discordgo.MessageAllowedMentions) (msg *discordgo.Message, err error) {
+	wh, err := t.webhook(channel)
+	if err != nil {
+		return nil, err // this error is already wrapped by us
 	}
 
 	params := discordgo.WebhookParams{
-		Username:  username,
-		AvatarURL: avatarURL,
-		Content:   content,
+		Username:        username,
+		AvatarURL:       avatarURL,
+		Content:         content,
+		AllowedMentions: mentions,
 	}
 
-	wh := t.webhook
+	for attempt := 0; ; attempt++ {
+		t.wait(wh.ID)
+		msg, err = t.session.WebhookExecute(wh.ID, wh.Token, t.waitForDelivery, &params)
 
-	_, err = t.session.WebhookEdit(wh.ID, "", "", channel)
-	if err != nil {
-		exists, checkErr := t.checkAndDeleteWebhook(channel)
-
-		// If there was error performing the check, compose the list
-		if checkErr != nil {
-			err = multierror.Append(err, checkErr).ErrorOrNil()
-		}
-
-		// If the webhook exists OR there was an error performing the check
-		// return the error to the caller
-		if exists || checkErr != nil {
-			return errors.Wrap(err, "could not edit existing webhook")
+		d, limited := retryAfter(err)
+		if !limited || attempt >= maxRateLimitRetries {
+			break
 		}
+		t.backoff(wh.ID, d)
+	}
 
-		// Otherwise just try and send the message again
-		return t.Message(channel, username, avatarURL, content)
+	// Someone may have deleted our webhook, so forget it and try again with another
+	if isUnknownWebhook(err) {
+		t.forgetWebhook(wh)
+		return t.Message(channel, username, avatarURL, content, mentions)
 	}
 
-	_, err = t.session.WebhookExecute(wh.ID, wh.Token, true, &params)
 	if err != nil {
-		return errors.Wrap(err, "could not execute existing webhook")
+		return nil, errors.Wrap(err, "could not execute existing webhook")
 	}
 
-	return nil
+	return msg, nil
 }
 
-func (t *Transmitter) GetID() string {
-	if t.webhook == nil {
-		return ""
+// HasWebhook returns true if the webhook with the given ID was created by the Transmitter.
+func (t *Transmitter) HasWebhook(id string) bool {
+	t.poolsMu.Lock()
+	defer t.poolsMu.Unlock()
+
+	for _, p := range t.pools {
+		for _, wh := range p.webhooks {
+			if wh.ID == id {
+				return true
+			}
+		}
 	}
-	return t.webhook.ID
+	return false
 }
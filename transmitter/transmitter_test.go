@@ -0,0 +1,133 @@
+package transmitter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errUnknownWebhook = &discordgo.RESTError{
+	Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownWebhook},
+}
+
+// fakeSession keeps webhooks in memory, remembering which channel each message was sent to.
+type fakeSession struct {
+	hooks   map[string]*discordgo.Webhook
+	created int
+	sent    []string
+}
+
+func newFakeSession(existing ...*discordgo.Webhook) *fakeSession {
+	s := &fakeSession{hooks: make(map[string]*discordgo.Webhook)}
+	for _, wh := range existing {
+		s.hooks[wh.ID] = wh
+	}
+	return s
+}
+
+func (s *fakeSession) GuildWebhooks(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error) {
+	hooks := []*discordgo.Webhook{}
+	for _, wh := range s.hooks {
+		hooks = append(hooks, wh)
+	}
+	return hooks, nil
+}
+
+func (s *fakeSession) WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	s.created++
+	wh := &discordgo.Webhook{ID: fmt.Sprintf("hook%d", s.created), Name: name, ChannelID: channelID}
+	s.hooks[wh.ID] = wh
+	return wh, nil
+}
+
+func (s *fakeSession) WebhookEdit(webhookID, name, avatar, channelID string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	wh, ok := s.hooks[webhookID]
+	if !ok {
+		return nil, errUnknownWebhook
+	}
+	wh.ChannelID = channelID
+	return wh, nil
+}
+
+func (s *fakeSession) WebhookDelete(webhookID string, options ...discordgo.RequestOption) error {
+	delete(s.hooks, webhookID)
+	return nil
+}
+
+func (s *fakeSession) WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	wh, ok := s.hooks[webhookID]
+	if !ok {
+		return nil, errUnknownWebhook
+	}
+	s.sent = append(s.sent, wh.ChannelID+" "+data.Content)
+	return &discordgo.Message{ChannelID: wh.ChannelID, Content: data.Content}, nil
+}
+
+func TestNewDeletesOldWebhooks(t *testing.T) {
+	s := newFakeSession(
+		&discordgo.Webhook{ID: "old", Name: "bridge 1:00:00PM"},
+		&discordgo.Webhook{ID: "other", Name: "someone else's"},
+	)
+
+	if _, err := New(s, "guild", "bridge", 0, 1, RateLimit{}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.hooks["old"]; ok {
+		t.Error("webhook with our prefix was not deleted")
+	}
+	if _, ok := s.hooks["other"]; !ok {
+		t.Error("webhook without our prefix was deleted")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	s := newFakeSession()
+	tm, err := New(s, "guild", "bridge", 1, 1, RateLimit{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, channel := range []string{"a", "a", "b", "a"} {
+		if _, err := tm.Message(channel, "alice", "", "hi", nil); err != nil {
+			t.Fatalf("could not send to %s: %s", channel, err)
+		}
+	}
+
+	// The guild only allows one webhook, which is moved between channels
+	if s.created != 1 {
+		t.Errorf("created %d webhooks, want 1", s.created)
+	}
+
+	want := []string{"a hi", "a hi", "b hi", "a hi"}
+	if fmt.Sprint(s.sent) != fmt.Sprint(want) {
+		t.Errorf("sent %q, want %q", s.sent, want)
+	}
+}
+
+func TestMessageDeletedWebhook(t *testing.T) {
+	s := newFakeSession()
+	tm, err := New(s, "guild", "bridge", 0, 1, RateLimit{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tm.Message("a", "alice", "", "one", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone deletes our webhook, so another should be made
+	s.hooks = make(map[string]*discordgo.Webhook)
+
+	if _, err := tm.Message("a", "alice", "", "two", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.created != 2 {
+		t.Errorf("created %d webhooks, want 2", s.created)
+	}
+	if tm.HasWebhook("hook1") || !tm.HasWebhook("hook2") {
+		t.Error("the deleted webhook was not replaced")
+	}
+}
@@ -1,52 +1,131 @@
 package transmitter
 
 import (
+	"net/http"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 )
 
-var webhookExpiry = time.Second * 30
+// webhook returns the next webhook to use for the channel.
+//
+// New webhooks are created until the channel has perChannel of them, as long as the guild
+// is within its limit. If the channel has none and the limit has been reached, the webhook of
+// the channel that has gone unused the longest is moved over.
+func (t *Transmitter) webhook(channel string) (*discordgo.Webhook, error) {
+	t.poolsMu.Lock()
+	defer t.poolsMu.Unlock()
+
+	p, ok := t.pools[channel]
+	if !ok {
+		p = &pool{}
+		t.pools[channel] = p
+	}
+
+	// Only make a new webhook when it's the turn of one we don't have yet
+	if p.next >= len(p.webhooks) && len(p.webhooks) < t.perChannel && !t.atLimit() {
+		wh, err := t.session.WebhookCreate(channel, t.prefix+time.Now().Format(" 3:04:05PM"), "")
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create webhook")
+		}
+		p.webhooks = append(p.webhooks, wh)
+	}
+
+	if len(p.webhooks) == 0 {
+		wh, err := t.stealWebhook(channel)
+		if err != nil {
+			return nil, err
+		}
+		p.webhooks = append(p.webhooks, wh)
+	}
+
+	wh := p.webhooks[p.next%len(p.webhooks)]
+	p.next = (p.next + 1) % t.perChannel
+	p.lastUsed = time.Now()
 
-// createWebhook creates a webhook for a specific channel.
-func (t *Transmitter) createWebhook(channel string) error {
-	wh, err := t.session.WebhookCreate(channel, t.prefix+time.Now().Format(" 3:04:05PM"), "")
+	return wh, nil
+}
 
-	if err != nil {
-		return errors.Wrap(err, "could not create webhook")
+// atLimit returns true if no more webhooks can be created in the guild.
+//
+// Must be called with poolsMu held.
+func (t *Transmitter) atLimit() bool {
+	if t.limit <= 0 {
+		return false
 	}
 
-	t.webhook = wh
-	return nil
+	total := 0
+	for _, p := range t.pools {
+		total += len(p.webhooks)
+	}
+	return total >= t.limit
 }
 
-// checkAndDeleteWebhook checks to see if the webhook exists, and will delete accordingly.
+// stealWebhook moves a webhook from the channel that has gone unused the longest.
+//
+// Messages still being sent with the webhook may end up in the new channel,
+// so the limit should be high enough that this is rare.
 //
-// If the transmitter does not know about the webhook, false is returned.
-// If the transmitter does know about the webhook:
-// 		- false is returned if Discord doesn't know.
-//		- true is returned if Discord does know it exists
-// If Discord returns an error, this function will return an error for the second argument.
-func (t *Transmitter) checkAndDeleteWebhook(channel string) (bool, error) {
-	wh := t.webhook
-
-	// If no webhook, return false
-	if wh == nil {
-		return false, nil
-	}
-
-	_, err := t.session.Webhook(wh.ID)
-	if err != nil {
-		// Check if the error is a known REST error (UnknownWebhook)
-		err, ok := err.(*discordgo.RESTError)
-		if ok && err.Message != nil && err.Message.Code == discordgo.ErrCodeUnknownWebhook {
-			// Retry the message because the webhook is dead
-			t.webhook = nil
-			return false, nil
+// Must be called with poolsMu held.
+func (t *Transmitter) stealWebhook(channel string) (*discordgo.Webhook, error) {
+	var oldest *pool
+	for id, p := range t.pools {
+		if id != channel && len(p.webhooks) > 0 && (oldest == nil || p.lastUsed.Before(oldest.lastUsed)) {
+			oldest = p
+		}
+	}
+
+	if oldest == nil {
+		return nil, errors.New("no webhooks can be created or reused")
+	}
+
+	wh := oldest.webhooks[len(oldest.webhooks)-1]
+	oldest.webhooks = oldest.webhooks[:len(oldest.webhooks)-1]
+
+	if _, err := t.session.WebhookEdit(wh.ID, "", "", channel); err != nil {
+		if !isUnknownWebhook(err) {
+			oldest.webhooks = append(oldest.webhooks, wh)
+		}
+		return nil, errors.Wrap(err, "could not move webhook")
+	}
+	return wh, nil
+}
+
+// forgetWebhook stops using a webhook that no longer exists.
+func (t *Transmitter) forgetWebhook(wh *discordgo.Webhook) {
+	t.poolsMu.Lock()
+	defer t.poolsMu.Unlock()
+
+	for _, p := range t.pools {
+		for i, other := range p.webhooks {
+			if other.ID == wh.ID {
+				p.webhooks = append(p.webhooks[:i], p.webhooks[i+1:]...)
+				return
+			}
 		}
+	}
+}
+
+// isUnknownWebhook returns true if Discord says the webhook doesn't exist.
+func isUnknownWebhook(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownWebhook
+}
+
+// IsPermissionError returns true if Discord refused a request because the bot
+// is missing a permission in the channel, or can't see it, even if the error was wrapped.
+func IsPermissionError(err error) bool {
+	restErr, ok := errors.Cause(err).(*discordgo.RESTError)
+	if !ok {
+		return false
+	}
 
-		return false, err
+	if restErr.Message != nil {
+		switch restErr.Message.Code {
+		case discordgo.ErrCodeMissingPermissions, discordgo.ErrCodeMissingAccess:
+			return true
+		}
 	}
-	return true, nil
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
 }